@@ -0,0 +1,49 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/colinrgodsey/sealed-ftpd/pkg/db"
+)
+
+const fsckUsage = `usage: ftpserver [flags] fsck [-repair]
+
+Checks the database for inconsistencies and runs SQLite's integrity check.
+Without -repair it only reads and may run while the server is up. With
+-repair, problems that can be fixed are fixed; it refuses to run until the
+server is stopped.`
+
+// runFsckCommand implements the "fsck" subcommand. It fails if problems
+// remain, so it can be used in scripts.
+func runFsckCommand(sqliteDB *sql.DB, args []string) error {
+	cmd := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := cmd.Bool("repair", false, "Fix the problems found where possible")
+	if err := cmd.Parse(args); err != nil {
+		return err
+	}
+	if cmd.NArg() != 0 {
+		return errors.New(fsckUsage)
+	}
+
+	problems, err := db.Check(sqliteDB, *repair)
+	if err != nil {
+		return err
+	}
+	remaining := 0
+	for _, p := range problems {
+		fmt.Println(p)
+		if !p.Repaired {
+			remaining++
+		}
+	}
+	if remaining > 0 {
+		return fmt.Errorf("%d problems found", remaining)
+	}
+	if len(problems) == 0 {
+		fmt.Println("no problems found")
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/colinrgodsey/sealed-ftpd/pkg/config"
+	"github.com/colinrgodsey/sealed-ftpd/pkg/db"
+)
+
+const rekeyUsage = `usage: ftpserver [flags] rekey [-new-key key | -new-key-file file]
+
+Re-encrypts all stored content under a new master key. The current master key
+is taken from --master-key, --master-key-file or $` + config.MasterKeyEnv + ` and may be
+omitted when the database is not encrypted yet. When no new key is given it
+is read from standard input. The server must be stopped first.`
+
+// masterKey returns the configured master key, or nil if none is configured.
+func masterKey(cfg *config.Config) ([]byte, error) {
+	text, err := cfg.MasterKeyText()
+	if err != nil || strings.TrimSpace(text) == "" {
+		return nil, err
+	}
+	return db.ParseMasterKey(text)
+}
+
+// runRekeyCommand implements the "rekey" subcommand.
+func runRekeyCommand(sqliteDB *sql.DB, cfg *config.Config, args []string) error {
+	cmd := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	newKey := cmd.String("new-key", "", "New master key (hex or base64)")
+	newKeyFile := cmd.String("new-key-file", "", "File containing the new master key")
+	if err := cmd.Parse(args); err != nil {
+		return err
+	}
+	if cmd.NArg() != 0 || (*newKey != "" && *newKeyFile != "") {
+		return errors.New(rekeyUsage)
+	}
+
+	oldMaster, err := masterKey(cfg)
+	if err != nil {
+		return err
+	}
+
+	text := *newKey
+	switch {
+	case *newKeyFile != "":
+		data, err := os.ReadFile(*newKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read new master key: %w", err)
+		}
+		text = string(data)
+	case text == "":
+		fmt.Fprint(os.Stderr, "New master key: ")
+		if text, err = readLine(); err != nil {
+			return err
+		}
+	}
+	newMaster, err := db.ParseMasterKey(text)
+	if err != nil {
+		return err
+	}
+
+	if err := db.Rekey(sqliteDB, oldMaster, newMaster); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "All content re-encrypted under the new master key.")
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"flag"
+
+	"github.com/colinrgodsey/sealed-ftpd/pkg/vfs"
+)
+
+const linkUsage = `usage: ftpserver [flags] link [-s] <target> <name>
+
+Creates <name> as a hard link to the file <target>, sharing its content, or
+with -s as a symbolic link pointing to <target>. Paths are absolute paths in
+the stored tree.`
+
+// runLinkCommand implements the "link" subcommand. Clients can create
+// symbolic links with SITE SYMLINK, but FTP has no command for hard links.
+func runLinkCommand(driver *vfs.MainDriver, args []string) error {
+	cmd := flag.NewFlagSet("link", flag.ContinueOnError)
+	symbolic := cmd.Bool("s", false, "Create a symbolic link")
+	if err := cmd.Parse(args); err != nil {
+		return err
+	}
+	if cmd.NArg() != 2 {
+		return errors.New(linkUsage)
+	}
+	return driver.Link(cmd.Arg(0), cmd.Arg(1), *symbolic)
+}
@@ -1,21 +1,28 @@
 package main
 
 import (
+	"flag"
 	"fmt"        // For Sprintf
 	stdlog "log" // Alias standard log
 	"log/slog"   // Standard library slog
+	"net/http"
 	"os"
 	"strings"
 
+	"github.com/colinrgodsey/sealed-ftpd/pkg/admin"
 	"github.com/colinrgodsey/sealed-ftpd/pkg/config" // New config package
 	"github.com/colinrgodsey/sealed-ftpd/pkg/db"
 	"github.com/colinrgodsey/sealed-ftpd/pkg/vfs"
 
 	ftpserver "github.com/fclairamb/ftpserverlib"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
 	cfg := config.ParseFlags()
+	if err := cfg.Validate(); err != nil {
+		stdlog.Fatalf("Invalid configuration: %v", err)
+	}
 
 	// Initialize the database
 	sqliteDB, err := db.InitDB(cfg.DBPath)
@@ -24,8 +31,104 @@ func main() {
 	}
 	defer sqliteDB.Close()
 
+	// Subcommands operate on the database and exit without starting the server
+	if flag.NArg() > 0 {
+		var cmdErr error
+		switch flag.Arg(0) {
+		case "user":
+			cmdErr = runUserCommand(sqliteDB, flag.Args()[1:])
+		case "stats":
+			cmdErr = runStatsCommand(sqliteDB)
+		case "rekey":
+			cmdErr = runRekeyCommand(sqliteDB, cfg, flag.Args()[1:])
+		case "fsck":
+			cmdErr = runFsckCommand(sqliteDB, flag.Args()[1:])
+		case "link":
+			cmdErr = runLinkCommand(vfs.NewMainDriver(sqliteDB, cfg, nil), flag.Args()[1:])
+		default:
+			cmdErr = fmt.Errorf("unknown command %q", flag.Arg(0))
+		}
+		if cmdErr != nil {
+			stdlog.Fatalf("%v", cmdErr)
+		}
+		return
+	}
+
+	// Hold the database for as long as the server runs, so rekey refuses to
+	// discard the data keys loaded below
+	lock, err := db.Lock(sqliteDB, false)
+	if err != nil {
+		stdlog.Fatalf("Failed to lock database: %v", err)
+	}
+	defer lock.Close()
+
+	// Unlock the data keys when content is encrypted at rest
+	master, err := masterKey(cfg)
+	if err != nil {
+		stdlog.Fatalf("Invalid master key: %v", err)
+	}
+	keys, err := db.LoadKeyring(sqliteDB, master)
+	if err != nil {
+		stdlog.Fatalf("Failed to load encryption keys: %v", err)
+	}
+	encoding := db.Encoding{Codec: cfg.Codec(), Keys: keys}
+
+	// Store content of legacy rows in the blob store and finish uploads cut
+	// short by a crash before serving clients
+	if err := db.CommitStagedFiles(sqliteDB, encoding); err != nil {
+		stdlog.Fatalf("Failed to commit staged content: %v", err)
+	}
+
 	// Create our MainDriver
-	mainDriver := vfs.NewMainDriver(sqliteDB, cfg.PassivePortStart, cfg.PassivePortEnd, cfg.ListenAddr, cfg.ConnectionTimeout)
+	mainDriver := vfs.NewMainDriver(sqliteDB, cfg, keys)
+
+	// A quota set through the admin API outlasts restarts
+	if quota, ok, err := db.QuotaOverride(sqliteDB); err != nil {
+		stdlog.Fatalf("Failed to load storage quota: %v", err)
+	} else if ok {
+		mainDriver.SetStorageQuota(quota)
+	}
+
+	// Load (or generate) the TLS certificate up front so problems surface at startup
+	tlsConfig, err := mainDriver.GetTLSConfig()
+	if err != nil {
+		stdlog.Fatalf("Failed to set up TLS: %v", err)
+	}
+
+	// Permanently delete expired trash entries and revisions in the background
+	go mainDriver.RunPurger(nil)
+
+	// The admin API uses the FTP server's certificate; without one the
+	// configuration only lets it listen on loopback
+	if cfg.AdminListenAddr != "" {
+		adminServer := &http.Server{
+			Addr:      cfg.AdminListenAddr,
+			Handler:   admin.NewServer(sqliteDB, mainDriver, cfg),
+			TLSConfig: tlsConfig,
+		}
+		go func() {
+			var err error
+			if tlsConfig != nil {
+				stdlog.Printf("Starting admin API on https://%s...", cfg.AdminListenAddr)
+				err = adminServer.ListenAndServeTLS("", "")
+			} else {
+				stdlog.Printf("Starting admin API on http://%s...", cfg.AdminListenAddr)
+				err = adminServer.ListenAndServe()
+			}
+			stdlog.Fatalf("Admin API failed: %v", err)
+		}()
+	}
+
+	if cfg.MetricsListenAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			stdlog.Printf("Serving metrics on %s/metrics...", cfg.MetricsListenAddr)
+			if err := http.ListenAndServe(cfg.MetricsListenAddr, metricsMux); err != nil {
+				stdlog.Fatalf("Metrics listener failed: %v", err)
+			}
+		}()
+	}
 
 	// Create the FTP server
 	ftpServer := ftpserver.NewFtpServer(mainDriver)
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/colinrgodsey/sealed-ftpd/pkg/db"
+)
+
+// runStatsCommand implements the "stats" subcommand, which prints how much
+// space file content takes before and after deduplication and compression.
+func runStatsCommand(sqliteDB *sql.DB) error {
+	stats, err := db.GetStorageStats(sqliteDB)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("logical size:\t%d bytes\n", stats.LogicalBytes)
+	fmt.Printf("unique content:\t%d bytes\n", stats.UniqueBytes)
+	fmt.Printf("stored:\t\t%d bytes\n", stats.StoredBytes)
+	if stats.LogicalBytes > 0 {
+		fmt.Printf("savings:\t%.1f%%\n", 100*(1-float64(stats.StoredBytes)/float64(stats.LogicalBytes)))
+	}
+	return nil
+}
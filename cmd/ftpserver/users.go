@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/colinrgodsey/sealed-ftpd/pkg/db"
+)
+
+const userUsage = `usage: ftpserver [flags] user <command> [args]
+
+commands:
+  add [-password pw] [-home dir] <name>
+                                create an account
+  passwd [-password pw] <name>  change the password of an account
+  home <name> [dir]             set the home directory of an account
+                                (an empty dir selects <home-root>/<name>)
+  gid <name> <gid>              set the primary group of an account
+                                (new accounts get a private group, gid = uid)
+  disable <name>                prevent an account from logging in
+  enable <name>                 allow a disabled account to log in again
+  delete <name>                 remove an account
+  list                          list all accounts
+
+When -password is omitted the password is read from standard input.`
+
+// runUserCommand implements the "user" subcommand used to manage accounts.
+func runUserCommand(sqliteDB *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(userUsage)
+	}
+
+	cmd := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	password := cmd.String("password", "", "Password for the account (read from stdin if empty)")
+	home := cmd.String("home", "", "Home directory of the account (default <home-root>/<name>)")
+	if err := cmd.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if args[0] == "list" {
+		users, err := db.ListUsers(sqliteDB)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			status := "enabled"
+			if u.Disabled {
+				status = "disabled"
+			}
+			lastLogin := "never"
+			if u.LastLogin.Valid {
+				lastLogin = u.LastLogin.Time.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%s\tuid=%d gid=%d\t%s\tlast login: %s\n", u.Username, u.ID, u.GID, status, lastLogin)
+		}
+		return nil
+	}
+
+	if args[0] == "home" && (cmd.NArg() == 1 || cmd.NArg() == 2) {
+		return db.SetUserHome(sqliteDB, cmd.Arg(0), cmd.Arg(1))
+	}
+
+	if args[0] == "gid" && cmd.NArg() == 2 {
+		gid, err := strconv.ParseInt(cmd.Arg(1), 10, 64)
+		if err != nil || gid < 0 {
+			return fmt.Errorf("invalid gid %q", cmd.Arg(1))
+		}
+		return db.SetUserGID(sqliteDB, cmd.Arg(0), gid)
+	}
+
+	if cmd.NArg() != 1 {
+		return errors.New(userUsage)
+	}
+	name := cmd.Arg(0)
+
+	switch args[0] {
+	case "add", "passwd":
+		pw := *password
+		if pw == "" {
+			var err error
+			if pw, err = readPassword(); err != nil {
+				return err
+			}
+		}
+		if args[0] == "add" {
+			tx, err := sqliteDB.Begin()
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			if err := db.CreateUser(tx, name, pw); err != nil {
+				return err
+			}
+			if *home != "" {
+				if err := db.SetUserHome(tx, name, *home); err != nil {
+					return err
+				}
+			}
+			return tx.Commit()
+		}
+		return db.SetUserPassword(sqliteDB, name, pw)
+	case "disable":
+		return db.SetUserDisabled(sqliteDB, name, true)
+	case "enable":
+		return db.SetUserDisabled(sqliteDB, name, false)
+	case "delete":
+		return db.DeleteUser(sqliteDB, name)
+	default:
+		return errors.New(userUsage)
+	}
+}
+
+// readPassword prompts for a password and reads it from standard input.
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	pw, err := readLine()
+	if err != nil {
+		return "", err
+	}
+	if pw == "" {
+		return "", errors.New("password must not be empty")
+	}
+	return pw, nil
+}
+
+// readLine reads a single line from standard input without its line ending.
+func readLine() (string, error) {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read from standard input: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
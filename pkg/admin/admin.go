@@ -0,0 +1,518 @@
+// Package admin serves an HTTP API for inspecting and managing a running
+// server: connected sessions, accounts, a runtime override of the storage
+// quota, the file tree,
+// backups, consistency checks and statistics. Every request must carry the
+// configured token as "Authorization: Bearer <token>", and requests and
+// responses are JSON.
+package admin
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/colinrgodsey/sealed-ftpd/pkg/config"
+	"github.com/colinrgodsey/sealed-ftpd/pkg/db"
+	"github.com/colinrgodsey/sealed-ftpd/pkg/vfs"
+)
+
+// Directory listings return at most maxListLimit entries per request, and
+// defaultListLimit unless asked for fewer or more.
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 10000
+)
+
+// Server is the admin API. It implements http.Handler.
+type Server struct {
+	db        *sql.DB
+	driver    *vfs.MainDriver
+	token     string
+	backupDir string
+	quota     int64 // the configured storage quota
+	started   time.Time
+	mux       *http.ServeMux
+}
+
+// NewServer returns the admin API for the server run by driver on sqliteDB,
+// configured by cfg.
+func NewServer(sqliteDB *sql.DB, driver *vfs.MainDriver, cfg *config.Config) *Server {
+	s := &Server{
+		db:        sqliteDB,
+		driver:    driver,
+		token:     cfg.AdminTokenText(),
+		backupDir: cfg.BackupDir,
+		quota:     cfg.StorageQuota,
+		started:   time.Now(),
+		mux:       http.NewServeMux(),
+	}
+	if s.backupDir == "" {
+		s.backupDir = filepath.Dir(cfg.DBPath)
+	}
+
+	s.mux.HandleFunc("GET /api/sessions", s.listSessions)
+	s.mux.HandleFunc("DELETE /api/sessions/{id}", s.disconnectSession)
+	s.mux.HandleFunc("GET /api/users", s.listUsers)
+	s.mux.HandleFunc("POST /api/users", s.createUser)
+	s.mux.HandleFunc("PATCH /api/users/{name}", s.updateUser)
+	s.mux.HandleFunc("DELETE /api/users/{name}", s.deleteUser)
+	s.mux.HandleFunc("GET /api/storage-quota", s.getQuota)
+	s.mux.HandleFunc("PUT /api/storage-quota/override", s.overrideQuota)
+	s.mux.HandleFunc("DELETE /api/storage-quota/override", s.clearQuotaOverride)
+	s.mux.HandleFunc("GET /api/files", s.browse)
+	s.mux.HandleFunc("POST /api/backup", s.backup)
+	s.mux.HandleFunc("POST /api/fsck", s.fsck)
+	s.mux.HandleFunc("GET /api/stats", s.stats)
+	return s
+}
+
+// ServeHTTP checks the admin token and dispatches the request.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, errorResponse{"invalid or missing admin token"})
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// badRequest is an error in what the client sent.
+type badRequest string
+
+func (e badRequest) Error() string { return string(e) }
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers with the status matching err.
+func writeError(w http.ResponseWriter, err error) {
+	var bad badRequest
+	status := http.StatusInternalServerError
+	switch {
+	case errors.As(err, &bad):
+		status = http.StatusBadRequest
+	case errors.Is(err, db.ErrUserNotFound), errors.Is(err, vfs.ErrSessionNotFound), errors.Is(err, os.ErrNotExist):
+		status = http.StatusNotFound
+	}
+	writeJSON(w, status, errorResponse{err.Error()})
+}
+
+// readJSON decodes the request body into v, rejecting unknown fields.
+func readJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return badRequest("invalid request body: " + err.Error())
+	}
+	return nil
+}
+
+type sessionResponse struct {
+	ID          uint32    `json:"id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	User        string    `json:"user,omitempty"`
+	TLS         bool      `json:"tls"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastCommand string    `json:"last_command,omitempty"`
+}
+
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := []sessionResponse{}
+	for _, sess := range s.driver.Sessions() {
+		sessions = append(sessions, sessionResponse(sess))
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (s *Server) disconnectSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	if err != nil {
+		writeError(w, badRequest("invalid session id"))
+		return
+	}
+	if err := s.driver.Disconnect(uint32(id)); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type userResponse struct {
+	Username  string     `json:"username"`
+	UID       int64      `json:"uid"`
+	GID       int64      `json:"gid"`
+	HomeDir   string     `json:"home_dir"`
+	Disabled  bool       `json:"disabled"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastLogin *time.Time `json:"last_login"`
+}
+
+func newUserResponse(u db.User) userResponse {
+	resp := userResponse{
+		Username:  u.Username,
+		UID:       u.ID,
+		GID:       u.GID,
+		HomeDir:   u.HomeDir,
+		Disabled:  u.Disabled,
+		CreatedAt: u.CreatedAt,
+	}
+	if u.LastLogin.Valid {
+		resp.LastLogin = &u.LastLogin.Time
+	}
+	return resp
+}
+
+// userRequest creates or changes an account. Fields left out are not changed.
+type userRequest struct {
+	Username string  `json:"username"`
+	Password *string `json:"password"`
+	HomeDir  *string `json:"home_dir"`
+	GID      *int64  `json:"gid"`
+	Disabled *bool   `json:"disabled"`
+}
+
+func (s *Server) listUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := db.ListUsers(s.db)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := []userResponse{}
+	for _, u := range users {
+		resp = append(resp, newUserResponse(u))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	var req userRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Username == "" || req.Password == nil {
+		writeError(w, badRequest("username and password are required"))
+		return
+	}
+	err := s.inTx(func(tx *sql.Tx) error {
+		if err := db.CreateUser(tx, req.Username, *req.Password); err != nil {
+			return err
+		}
+		req.Password = nil
+		return applyUser(tx, req.Username, req)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.writeUser(w, http.StatusCreated, req.Username)
+}
+
+func (s *Server) updateUser(w http.ResponseWriter, r *http.Request) {
+	var req userRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Username != "" {
+		writeError(w, badRequest("accounts cannot be renamed"))
+		return
+	}
+	username := r.PathValue("name")
+	if err := s.inTx(func(tx *sql.Tx) error { return applyUser(tx, username, req) }); err != nil {
+		writeError(w, err)
+		return
+	}
+	// A disabled account keeps no sessions
+	if req.Disabled != nil && *req.Disabled {
+		s.driver.DisconnectUser(username)
+	}
+	s.writeUser(w, http.StatusOK, username)
+}
+
+// inTx runs fn in a transaction, committed if fn succeeds.
+func (s *Server) inTx(fn func(*sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// applyUser makes the changes in req to the account.
+func applyUser(q db.Querier, username string, req userRequest) error {
+	var err error
+	if req.Password != nil {
+		err = db.SetUserPassword(q, username, *req.Password)
+	}
+	if err == nil && req.HomeDir != nil {
+		err = db.SetUserHome(q, username, *req.HomeDir)
+	}
+	if err == nil && req.GID != nil {
+		err = db.SetUserGID(q, username, *req.GID)
+	}
+	if err == nil && req.Disabled != nil {
+		err = db.SetUserDisabled(q, username, *req.Disabled)
+	}
+	return err
+}
+
+// writeUser answers with the account.
+func (s *Server) writeUser(w http.ResponseWriter, status int, username string) {
+	users, err := db.ListUsers(s.db)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, u := range users {
+		if u.Username == username {
+			writeJSON(w, status, newUserResponse(u))
+			return
+		}
+	}
+	writeError(w, db.ErrUserNotFound)
+}
+
+// deleteUser removes an account and closes its sessions.
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("name")
+	if err := db.DeleteUser(s.db, username); err != nil {
+		writeError(w, err)
+		return
+	}
+	s.driver.DisconnectUser(username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// The storage quota is a single limit on the total size of all files, set by
+// --storage-quota. The API can override it; the override is stored in the
+// database, so it stays in effect across restarts until it is cleared.
+
+type quotaResponse struct {
+	Quota      int64 `json:"quota"`      // in effect, 0 for no limit
+	Configured int64 `json:"configured"` // set at startup
+	Overridden bool  `json:"overridden"` // an override is stored
+	Used       int64 `json:"used"`
+}
+
+func (s *Server) getQuota(w http.ResponseWriter, r *http.Request) {
+	used, err := db.UsedBytes(s.db)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	_, overridden, err := db.QuotaOverride(s.db)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, quotaResponse{
+		Quota:      s.driver.StorageQuota(),
+		Configured: s.quota,
+		Overridden: overridden,
+		Used:       used,
+	})
+}
+
+// overrideQuota replaces the storage quota until the override is cleared.
+func (s *Server) overrideQuota(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Quota *int64 `json:"quota"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Quota == nil || *req.Quota < 0 {
+		writeError(w, badRequest("quota must be given and not negative"))
+		return
+	}
+	if err := db.SetQuotaOverride(s.db, *req.Quota); err != nil {
+		writeError(w, err)
+		return
+	}
+	s.driver.SetStorageQuota(*req.Quota)
+	s.getQuota(w, r)
+}
+
+// clearQuotaOverride puts the configured storage quota back in effect.
+func (s *Server) clearQuotaOverride(w http.ResponseWriter, r *http.Request) {
+	if err := db.ClearQuotaOverride(s.db); err != nil {
+		writeError(w, err)
+		return
+	}
+	s.driver.SetStorageQuota(s.quota)
+	s.getQuota(w, r)
+}
+
+type entryResponse struct {
+	Name      string     `json:"name"`
+	Type      string     `json:"type"` // "file", "dir" or "symlink"
+	Size      int64      `json:"size"`
+	Mode      string     `json:"mode"` // octal permission bits
+	UID       int64      `json:"uid"`
+	GID       int64      `json:"gid"`
+	Modify    time.Time  `json:"modify"`
+	Create    *time.Time `json:"create,omitempty"`
+	Unique    string     `json:"unique,omitempty"`
+	MediaType string     `json:"media_type,omitempty"`
+	SHA256    string     `json:"sha256,omitempty"`
+	Target    string     `json:"target,omitempty"` // of a symbolic link
+}
+
+func (s *Server) newEntryResponse(dir string, fi os.FileInfo) entryResponse {
+	facts, _ := fi.Sys().(vfs.Facts)
+	e := entryResponse{
+		Name:      fi.Name(),
+		Type:      facts.Type,
+		Size:      fi.Size(),
+		Mode:      fmt.Sprintf("%04o", fi.Mode().Perm()),
+		UID:       facts.UID,
+		GID:       facts.GID,
+		Modify:    fi.ModTime().UTC(),
+		Unique:    facts.Unique,
+		MediaType: facts.MediaType,
+		SHA256:    facts.SHA256,
+	}
+	if !facts.Create.IsZero() {
+		e.Create = &facts.Create
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		e.Type = "symlink"
+		e.Target, _ = s.driver.Readlink(path.Join(dir, fi.Name()))
+	}
+	return e
+}
+
+type browseResponse struct {
+	Path    string          `json:"path"`
+	Entry   entryResponse   `json:"entry"`
+	Entries []entryResponse `json:"entries,omitempty"` // of a directory
+	Next    string          `json:"next,omitempty"`    // "after" for the next page, if there may be one
+}
+
+// browse describes the entry at the path query parameter and, for a
+// directory, lists up to limit entries following the name after.
+func (s *Server) browse(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := path.Clean("/" + q.Get("path"))
+	limit := defaultListLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 || n > maxListLimit {
+			writeError(w, badRequest(fmt.Sprintf("limit must be between 1 and %d", maxListLimit)))
+			return
+		}
+		limit = n
+	}
+
+	fi, err := s.driver.Stat(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := browseResponse{Path: name, Entry: s.newEntryResponse(path.Dir(name), fi)}
+	if fi.IsDir() {
+		infos, err := s.driver.ReadDir(name, q.Get("after"), limit)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp.Entries = []entryResponse{}
+		for _, info := range infos {
+			resp.Entries = append(resp.Entries, s.newEntryResponse(name, info))
+		}
+		if len(infos) == limit {
+			resp.Next = infos[len(infos)-1].Name()
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// backup writes a copy of the database to the backup directory.
+func (s *Server) backup(w http.ResponseWriter, r *http.Request) {
+	name := filepath.Join(s.backupDir, "sealed-ftpd-"+time.Now().UTC().Format("20060102T150405Z")+".db")
+	if err := db.Backup(s.db, name); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, struct {
+		Path string `json:"path"`
+	}{name})
+}
+
+type problemResponse struct {
+	Kind   string `json:"kind"`
+	Path   string `json:"path,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// fsck checks a snapshot of the live database without repairing anything;
+// repairs are left to the fsck subcommand, run while the server is stopped.
+func (s *Server) fsck(w http.ResponseWriter, r *http.Request) {
+	problems, err := db.Check(s.db, false)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := []problemResponse{}
+	for _, p := range problems {
+		resp = append(resp, problemResponse{Kind: p.Kind, Path: p.Path, Detail: p.Detail})
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Problems []problemResponse `json:"problems"`
+	}{resp})
+}
+
+type statsResponse struct {
+	LogicalBytes  int64   `json:"logical_bytes"`
+	UniqueBytes   int64   `json:"unique_bytes"`
+	StoredBytes   int64   `json:"stored_bytes"`
+	Quota         int64   `json:"quota"`
+	Sessions      int     `json:"sessions"`
+	SchemaVersion int     `json:"schema_version"`
+	Uptime        float64 `json:"uptime_seconds"`
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	storage, err := db.GetStorageStats(s.db)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	version, err := db.SchemaVersion(s.db)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statsResponse{
+		LogicalBytes:  storage.LogicalBytes,
+		UniqueBytes:   storage.UniqueBytes,
+		StoredBytes:   storage.StoredBytes,
+		Quota:         s.driver.StorageQuota(),
+		Sessions:      len(s.driver.Sessions()),
+		SchemaVersion: version,
+		Uptime:        time.Since(s.started).Seconds(),
+	})
+}
@@ -0,0 +1,323 @@
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/colinrgodsey/sealed-ftpd/pkg/config"
+	"github.com/colinrgodsey/sealed-ftpd/pkg/db"
+	"github.com/colinrgodsey/sealed-ftpd/pkg/vfs"
+	ftpserver "github.com/fclairamb/ftpserverlib"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const testToken = "let-me-in"
+
+func setupTestServer(t *testing.T) (*sql.DB, *vfs.MainDriver, *httptest.Server) {
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.DBPath = filepath.Join(dir, "test.db")
+	cfg.BackupDir = filepath.Join(dir, "backups")
+	cfg.AdminToken = testToken
+
+	dbConn, err := sql.Open("sqlite3", cfg.DBPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := db.CreateSchema(dbConn); err != nil {
+		t.Fatalf("Failed to create schema: %v", err)
+	}
+	if err := os.Mkdir(cfg.BackupDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	driver := vfs.NewMainDriver(dbConn, cfg, nil)
+	srv := httptest.NewServer(NewServer(dbConn, driver, cfg))
+	t.Cleanup(func() {
+		srv.Close()
+		dbConn.Close()
+	})
+	return dbConn, driver, srv
+}
+
+// call makes an authenticated request and decodes the JSON response into
+// out, if given, returning the status code.
+func call(t *testing.T, srv *httptest.Server, method, path, body string, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: bad response %q: %v", method, path, data, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAuthToken(t *testing.T) {
+	_, _, srv := setupTestServer(t)
+
+	for _, auth := range []string{"", "Bearer wrong", testToken} {
+		req, _ := http.NewRequest("GET", srv.URL+"/api/stats", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: expected 401, got %d", auth, resp.StatusCode)
+		}
+	}
+
+	var stats statsResponse
+	if code := call(t, srv, "GET", "/api/stats", "", &stats); code != http.StatusOK {
+		t.Fatalf("Expected 200 with the token, got %d", code)
+	}
+	if stats.SchemaVersion == 0 {
+		t.Errorf("Expected a schema version in %+v", stats)
+	}
+}
+
+func TestUsersAndQuota(t *testing.T) {
+	dbConn, driver, srv := setupTestServer(t)
+
+	var user userResponse
+	if code := call(t, srv, "POST", "/api/users", `{"username":"alice","password":"secret","gid":100}`, &user); code != http.StatusCreated {
+		t.Fatalf("Create user: expected 201, got %d", code)
+	}
+	if user.Username != "alice" || user.GID != 100 || user.LastLogin != nil {
+		t.Errorf("Unexpected new user %+v", user)
+	}
+	if code := call(t, srv, "POST", "/api/users", `{"username":"bob"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("Create without password: expected 400, got %d", code)
+	}
+
+	if code := call(t, srv, "PATCH", "/api/users/alice", `{"home_dir":"/srv/alice","disabled":true}`, &user); code != http.StatusOK {
+		t.Fatalf("Update user: expected 200, got %d", code)
+	}
+	if user.HomeDir != "/srv/alice" || !user.Disabled {
+		t.Errorf("Update not applied: %+v", user)
+	}
+	if _, err := driver.AuthUser(nil, "alice", "secret"); err == nil {
+		t.Error("Expected a disabled account to be refused")
+	}
+	if code := call(t, srv, "PATCH", "/api/users/nobody", `{"disabled":true}`, nil); code != http.StatusNotFound {
+		t.Errorf("Update unknown user: expected 404, got %d", code)
+	}
+
+	var users []userResponse
+	call(t, srv, "GET", "/api/users", "", &users)
+	if len(users) != 1 || users[0].Username != "alice" {
+		t.Errorf("Unexpected users %+v", users)
+	}
+	if code := call(t, srv, "DELETE", "/api/users/alice", "", nil); code != http.StatusNoContent {
+		t.Errorf("Delete user: expected 204, got %d", code)
+	}
+	if users, err := db.ListUsers(dbConn); err != nil || len(users) != 0 {
+		t.Errorf("Expected no users left, got %+v, %v", users, err)
+	}
+
+	var quota quotaResponse
+	if code := call(t, srv, "PUT", "/api/storage-quota/override", `{"quota":1024}`, &quota); code != http.StatusOK {
+		t.Fatalf("Override quota: expected 200, got %d", code)
+	}
+	if quota.Quota != 1024 || quota.Configured != 0 || !quota.Overridden || driver.StorageQuota() != 1024 {
+		t.Errorf("Override not applied: %+v", quota)
+	}
+	if stored, ok, err := db.QuotaOverride(dbConn); err != nil || !ok || stored != 1024 {
+		t.Errorf("Override not stored for the next start: %d, %v, %v", stored, ok, err)
+	}
+	if code := call(t, srv, "PUT", "/api/storage-quota/override", `{"quota":-1}`, nil); code != http.StatusBadRequest {
+		t.Errorf("Negative quota: expected 400, got %d", code)
+	}
+	quota = quotaResponse{}
+	if code := call(t, srv, "DELETE", "/api/storage-quota/override", "", &quota); code != http.StatusOK {
+		t.Fatalf("Clear override: expected 200, got %d", code)
+	}
+	if quota.Quota != 0 || quota.Overridden || driver.StorageQuota() != 0 {
+		t.Errorf("Override not cleared: %+v", quota)
+	}
+	if _, ok, err := db.QuotaOverride(dbConn); err != nil || ok {
+		t.Errorf("Override still stored after clearing: %v, %v", ok, err)
+	}
+}
+
+func TestBrowse(t *testing.T) {
+	dbConn, driver, srv := setupTestServer(t)
+
+	if err := db.CreateUser(dbConn, "alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := driver.AuthUser(nil, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a.txt", "/b.txt", "/c.txt"} {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("hello"))
+		f.Close()
+	}
+	fs.Mkdir("/sub", 0o755)
+
+	var page browseResponse
+	if code := call(t, srv, "GET", "/api/files?path=/home/alice&limit=2", "", &page); code != http.StatusOK {
+		t.Fatalf("Browse: expected 200, got %d", code)
+	}
+	if page.Entry.Type != "dir" || len(page.Entries) != 2 || page.Next != "b.txt" {
+		t.Fatalf("Unexpected first page %+v", page)
+	}
+	if e := page.Entries[0]; e.Name != "a.txt" || e.Size != 5 || e.SHA256 == "" || e.MediaType != "text/plain" {
+		t.Errorf("Unexpected entry %+v", e)
+	}
+	var next browseResponse
+	call(t, srv, "GET", "/api/files?path=/home/alice&limit=2&after="+page.Next, "", &next)
+	if len(next.Entries) != 2 || next.Entries[0].Name != "c.txt" || next.Entries[1].Type != "dir" {
+		t.Errorf("Unexpected second page %+v", next)
+	}
+
+	var file browseResponse
+	call(t, srv, "GET", "/api/files?path=/home/alice/a.txt", "", &file)
+	if file.Entry.Name != "a.txt" || file.Entries != nil {
+		t.Errorf("Unexpected file entry %+v", file)
+	}
+	if code := call(t, srv, "GET", "/api/files?path=/missing", "", nil); code != http.StatusNotFound {
+		t.Errorf("Browse missing path: expected 404, got %d", code)
+	}
+}
+
+func TestBackupAndFsck(t *testing.T) {
+	_, _, srv := setupTestServer(t)
+
+	var backup struct{ Path string }
+	if code := call(t, srv, "POST", "/api/backup", "", &backup); code != http.StatusCreated {
+		t.Fatalf("Backup: expected 201, got %d", code)
+	}
+	copyDB, err := sql.Open("sqlite3", backup.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copyDB.Close()
+	if v, err := db.SchemaVersion(copyDB); err != nil || v == 0 {
+		t.Errorf("Backup at %s not readable: %d, %v", backup.Path, v, err)
+	}
+
+	var fsck struct{ Problems []problemResponse }
+	if code := call(t, srv, "POST", "/api/fsck", "", &fsck); code != http.StatusOK {
+		t.Fatalf("Fsck: expected 200, got %d", code)
+	}
+	if len(fsck.Problems) != 0 {
+		t.Errorf("Expected a clean database, got %+v", fsck.Problems)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	_, _, srv := setupTestServer(t)
+
+	var sessions []sessionResponse
+	if code := call(t, srv, "GET", "/api/sessions", "", &sessions); code != http.StatusOK || len(sessions) != 0 {
+		t.Errorf("Expected no sessions, got %d %+v", code, sessions)
+	}
+	if code := call(t, srv, "DELETE", "/api/sessions/42", "", nil); code != http.StatusNotFound {
+		t.Errorf("Disconnect unknown session: expected 404, got %d", code)
+	}
+	if code := call(t, srv, "DELETE", "/api/sessions/x", "", nil); code != http.StatusBadRequest {
+		t.Errorf("Disconnect bad id: expected 400, got %d", code)
+	}
+}
+
+// fakeClient is a connected client for session tests. Methods the driver
+// doesn't call are left to the nil embedded interface.
+type fakeClient struct {
+	ftpserver.ClientContext
+	id     uint32
+	closed atomic.Bool
+}
+
+func (c *fakeClient) ID() uint32 { return c.id }
+func (c *fakeClient) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(c.id)}
+}
+func (c *fakeClient) HasTLSForControl() bool { return false }
+func (c *fakeClient) GetLastCommand() string { return "" }
+func (c *fakeClient) Path() string           { return "/" }
+func (c *fakeClient) Close() error           { c.closed.Store(true); return nil }
+
+func TestUserSessionsClosed(t *testing.T) {
+	_, driver, srv := setupTestServer(t)
+
+	for _, name := range []string{"alice", "bob"} {
+		body := `{"username":"` + name + `","password":"secret"}`
+		if code := call(t, srv, "POST", "/api/users", body, nil); code != http.StatusCreated {
+			t.Fatalf("Create %s: expected 201, got %d", name, code)
+		}
+	}
+	clients := map[string]*fakeClient{}
+	for i, name := range []string{"alice", "bob", "carol"} {
+		cc := &fakeClient{id: uint32(i + 1)}
+		driver.ClientConnected(cc)
+		defer driver.ClientDisconnected(cc)
+		if name != "carol" {
+			if _, err := driver.AuthUser(cc, name, "secret"); err != nil {
+				t.Fatalf("Login as %s failed: %v", name, err)
+			}
+		}
+		clients[name] = cc
+	}
+
+	if code := call(t, srv, "PATCH", "/api/users/alice", `{"disabled":true}`, nil); code != http.StatusOK {
+		t.Fatalf("Disable user: expected 200, got %d", code)
+	}
+	if !clients["alice"].closed.Load() || clients["bob"].closed.Load() || clients["carol"].closed.Load() {
+		t.Errorf("Expected only alice's session to be closed on disabling, got alice %v, bob %v, carol %v",
+			clients["alice"].closed.Load(), clients["bob"].closed.Load(), clients["carol"].closed.Load())
+	}
+	if code := call(t, srv, "DELETE", "/api/users/bob", "", nil); code != http.StatusNoContent {
+		t.Fatalf("Delete user: expected 204, got %d", code)
+	}
+	if !clients["bob"].closed.Load() || clients["carol"].closed.Load() {
+		t.Errorf("Expected bob's session to be closed on deletion, got bob %v, carol %v", clients["bob"].closed.Load(), clients["carol"].closed.Load())
+	}
+}
+
+func TestCreateUserAtomic(t *testing.T) {
+	dbConn, _, srv := setupTestServer(t)
+
+	// A failure after the account row is written leaves no account behind
+	_, err := dbConn.Exec(`
+		CREATE TRIGGER refuse_home BEFORE UPDATE OF home_dir ON users
+		BEGIN SELECT RAISE(ABORT, 'home refused'); END
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"username":"alice","password":"secret","home_dir":"/srv/alice"}`
+	if code := call(t, srv, "POST", "/api/users", body, nil); code != http.StatusInternalServerError {
+		t.Fatalf("Create user: expected 500, got %d", code)
+	}
+	if users, err := db.ListUsers(dbConn); err != nil || len(users) != 0 {
+		t.Errorf("Expected the failed account to be rolled back, got %+v, %v", users, err)
+	}
+}
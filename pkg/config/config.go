@@ -1,10 +1,18 @@
 package config
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
 	"time"
 )
 
+// DefaultMaxFileSize is the per-file size limit used when none is configured.
+const DefaultMaxFileSize = 10 * 1024 * 1024 // 10MB
+
 // Config holds all application configuration
 type Config struct {
 	ListenAddr        string
@@ -13,20 +21,183 @@ type Config struct {
 	ConnectionTimeout time.Duration
 	DBPath            string
 	LogLevel          string
+	MaxFileSize       int64         // Maximum size of a single file in bytes
+	StorageQuota      int64         // Maximum total bytes stored across all files, 0 for unlimited
+	AllowAnonymous    bool          // Accept "anonymous"/"ftp" logins without a users table entry
+	HomeRoot          string        // Parent of the <HomeRoot>/<username> homes of users without an explicit home_dir
+	AnonymousRoot     string        // Directory anonymous sessions are confined to
+	TLSMode           string        // "explicit" (AUTH TLS on the plain port) or "implicit" (TLS from the first byte)
+	TLSCertFile       string        // PEM certificate file; takes precedence over TLSSelfSigned
+	TLSKeyFile        string        // PEM private key file matching TLSCertFile
+	TLSSelfSigned     bool          // Generate a self-signed certificate on first start and keep it in the database
+	TLSRequireControl bool          // Refuse logins over a cleartext control channel
+	TLSRequireData    bool          // Refuse transfers and listings over a cleartext data channel
+	Umask             uint32        // Permission bits cleared from newly created files and directories
+	MaxVersions       int           // Previous revisions kept per file, 0 disables versioning
+	VersionMaxAge     time.Duration // Age after which previous revisions are discarded, 0 for no limit
+	TrashRetention    time.Duration // How long deleted entries stay in the trash, 0 deletes immediately
+	Compression       string        // Codec for newly stored content: "none" or "gzip"
+	MasterKey         string        // Master key for at-rest encryption, hex or base64; see MasterKeyText
+	MasterKeyFile     string        // File holding the master key
+	AdminListenAddr   string        // Address of the admin HTTP API, "" to disable it; HTTPS when TLS is configured
+	AdminToken        string        // Bearer token required by the admin API; see AdminTokenText
+	BackupDir         string        // Directory backups are written to, "" for the database's directory
+	MetricsListenAddr string        // Address serving Prometheus metrics on /metrics, "" to disable it
+}
+
+// MasterKeyEnv is the environment variable consulted for the master key when
+// neither --master-key nor --master-key-file is given.
+const MasterKeyEnv = "SEALED_FTPD_MASTER_KEY"
+
+// AdminTokenEnv is the environment variable consulted for the admin token
+// when --admin-token is not given.
+const AdminTokenEnv = "SEALED_FTPD_ADMIN_TOKEN"
+
+// Default returns a Config populated with the default value of every setting
+func Default() *Config {
+	return &Config{
+		ListenAddr:        "127.0.0.1:2121",
+		PassivePortStart:  20000,
+		PassivePortEnd:    20009,
+		ConnectionTimeout: 5 * time.Minute,
+		DBPath:            "./ftp-mimic.db",
+		LogLevel:          "info",
+		MaxFileSize:       DefaultMaxFileSize,
+		HomeRoot:          "/home",
+		AnonymousRoot:     "/",
+		TLSMode:           "explicit",
+		Umask:             0022,
+		Compression:       "none",
+	}
 }
 
 // ParseFlags parses command-line flags into a Config struct
 func ParseFlags() *Config {
-	cfg := &Config{}
+	cfg := Default()
 
-	flag.StringVar(&cfg.ListenAddr, "listen-addr", "127.0.0.1:2121", "Address to listen on (e.g., 0.0.0.0:2121)")
-	flag.IntVar(&cfg.PassivePortStart, "passive-port-start", 20000, "Start of the passive port range")
-	flag.IntVar(&cfg.PassivePortEnd, "passive-port-end", 20009, "End of the passive port range")
-	flag.DurationVar(&cfg.ConnectionTimeout, "connection-timeout", 5*time.Minute, "Connection timeout duration (e.g., 5m)")
-	flag.StringVar(&cfg.DBPath, "db-path", "./ftp-mimic.db", "Path to the SQLite database file")
-	flag.StringVar(&cfg.LogLevel, "log-level", "info", "Logging level (debug, info, warn, error)")
+	flag.StringVar(&cfg.ListenAddr, "listen-addr", cfg.ListenAddr, "Address to listen on (e.g., 0.0.0.0:2121)")
+	flag.IntVar(&cfg.PassivePortStart, "passive-port-start", cfg.PassivePortStart, "Start of the passive port range")
+	flag.IntVar(&cfg.PassivePortEnd, "passive-port-end", cfg.PassivePortEnd, "End of the passive port range")
+	flag.DurationVar(&cfg.ConnectionTimeout, "connection-timeout", cfg.ConnectionTimeout, "Connection timeout duration (e.g., 5m)")
+	flag.StringVar(&cfg.DBPath, "db-path", cfg.DBPath, "Path to the SQLite database file")
+	flag.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Logging level (debug, info, warn, error)")
+	flag.Int64Var(&cfg.MaxFileSize, "max-file-size", cfg.MaxFileSize, "Maximum size of a single file in bytes")
+	flag.Int64Var(&cfg.StorageQuota, "storage-quota", cfg.StorageQuota, "Maximum total bytes stored across all files (0 for unlimited)")
+	flag.StringVar(&cfg.HomeRoot, "home-root", cfg.HomeRoot, "Directory containing per-user home directories")
+	flag.StringVar(&cfg.AnonymousRoot, "anonymous-root", cfg.AnonymousRoot, "Directory anonymous users are confined to")
+	flag.BoolVar(&cfg.AllowAnonymous, "allow-anonymous", cfg.AllowAnonymous, "Allow anonymous logins (user \"anonymous\" or \"ftp\", any password)")
+
+	flag.StringVar(&cfg.TLSMode, "tls-mode", cfg.TLSMode, "TLS mode when a certificate is available (explicit, implicit)")
+	flag.StringVar(&cfg.TLSCertFile, "tls-cert", cfg.TLSCertFile, "Path to a PEM encoded TLS certificate")
+	flag.StringVar(&cfg.TLSKeyFile, "tls-key", cfg.TLSKeyFile, "Path to the PEM encoded private key for --tls-cert")
+	flag.BoolVar(&cfg.TLSSelfSigned, "tls-self-signed", cfg.TLSSelfSigned, "Generate a self-signed certificate and store it in the database")
+	flag.BoolVar(&cfg.TLSRequireControl, "tls-require-control", cfg.TLSRequireControl, "Require TLS on the control channel before login")
+	flag.BoolVar(&cfg.TLSRequireData, "tls-require-data", cfg.TLSRequireData, "Require TLS (PROT P) on data channels")
+	flag.IntVar(&cfg.MaxVersions, "max-versions", cfg.MaxVersions, "Previous revisions kept per file (0 disables versioning)")
+	flag.DurationVar(&cfg.VersionMaxAge, "version-max-age", cfg.VersionMaxAge, "Discard previous revisions older than this (0 for no limit)")
+	flag.DurationVar(&cfg.TrashRetention, "trash-retention", cfg.TrashRetention, "How long deleted files stay in the trash (0 deletes immediately)")
+	flag.StringVar(&cfg.Compression, "compression", cfg.Compression, "Compression applied to newly stored content (none, gzip)")
+	flag.StringVar(&cfg.MasterKey, "master-key", cfg.MasterKey, "Master key encrypting stored content (hex or base64; prefer --master-key-file or $"+MasterKeyEnv+")")
+	flag.StringVar(&cfg.MasterKeyFile, "master-key-file", cfg.MasterKeyFile, "File containing the master key")
+	flag.StringVar(&cfg.AdminListenAddr, "admin-listen-addr", cfg.AdminListenAddr, "Address of the admin HTTP API, served over HTTPS when TLS is configured (e.g., 127.0.0.1:8021; empty disables it)")
+	flag.StringVar(&cfg.AdminToken, "admin-token", cfg.AdminToken, "Bearer token for the admin API (prefer $"+AdminTokenEnv+")")
+	flag.StringVar(&cfg.BackupDir, "backup-dir", cfg.BackupDir, "Directory database backups are written to (default: the database's directory)")
+	flag.StringVar(&cfg.MetricsListenAddr, "metrics-listen-addr", cfg.MetricsListenAddr, "Address serving Prometheus metrics on /metrics (e.g., 127.0.0.1:9121; empty disables it)")
+	flag.Func("umask", "Octal permission bits cleared from new files and directories (default 022)", func(s string) error {
+		mask, err := strconv.ParseUint(s, 8, 32)
+		if err != nil || mask > 0777 {
+			return fmt.Errorf("invalid umask %q", s)
+		}
+		cfg.Umask = uint32(mask)
+		return nil
+	})
 
 	flag.Parse()
 
 	return cfg
 }
+
+// TLSEnabled reports whether a certificate source has been configured.
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" || c.TLSSelfSigned
+}
+
+// Codec returns the storage codec selected by Compression.
+func (c *Config) Codec() string {
+	if c.Compression == "none" {
+		return ""
+	}
+	return c.Compression
+}
+
+// MasterKeyText returns the encoded master key from --master-key,
+// --master-key-file or the MasterKeyEnv environment variable, in that order,
+// or "" if none is configured.
+func (c *Config) MasterKeyText() (string, error) {
+	switch {
+	case c.MasterKey != "":
+		return c.MasterKey, nil
+	case c.MasterKeyFile != "":
+		data, err := os.ReadFile(c.MasterKeyFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read master key file: %w", err)
+		}
+		return string(data), nil
+	default:
+		return os.Getenv(MasterKeyEnv), nil
+	}
+}
+
+// AdminTokenText returns the admin token from --admin-token or the
+// AdminTokenEnv environment variable, or "" if none is configured.
+func (c *Config) AdminTokenText() string {
+	if c.AdminToken != "" {
+		return c.AdminToken
+	}
+	return os.Getenv(AdminTokenEnv)
+}
+
+// Validate checks the configuration for inconsistent settings.
+func (c *Config) Validate() error {
+	if c.TLSMode != "explicit" && c.TLSMode != "implicit" {
+		return fmt.Errorf("invalid tls-mode %q (expected explicit or implicit)", c.TLSMode)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("tls-cert and tls-key must be given together")
+	}
+	if !c.TLSEnabled() && (c.TLSMode == "implicit" || c.TLSRequireControl || c.TLSRequireData) {
+		return errors.New("TLS is required but neither tls-cert nor tls-self-signed is set")
+	}
+	if c.MaxVersions < 0 || c.VersionMaxAge < 0 {
+		return errors.New("max-versions and version-max-age must not be negative")
+	}
+	if c.MasterKey != "" && c.MasterKeyFile != "" {
+		return errors.New("master-key and master-key-file are mutually exclusive")
+	}
+	if c.Compression != "none" && c.Compression != "gzip" {
+		return fmt.Errorf("invalid compression %q (expected none or gzip)", c.Compression)
+	}
+	if c.TrashRetention < 0 {
+		return errors.New("trash-retention must not be negative")
+	}
+	if c.AdminListenAddr != "" && c.AdminTokenText() == "" {
+		return errors.New("admin-listen-addr requires an admin token (--admin-token or $" + AdminTokenEnv + ")")
+	}
+	if c.AdminListenAddr != "" && !c.TLSEnabled() && !isLoopback(c.AdminListenAddr) {
+		return errors.New("admin-listen-addr must be a loopback address unless TLS is configured (tls-cert or tls-self-signed)")
+	}
+	return nil
+}
+
+// isLoopback reports whether addr only listens on the loopback interface.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,16 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Backup writes a consistent copy of the database to path with VACUUM INTO,
+// while the database stays in use. The copy is compacted and holds the data
+// as of the start of the backup. path must not exist yet.
+func Backup(db *sql.DB, path string) error {
+	if _, err := db.Exec("VACUUM INTO ?", path); err != nil {
+		return fmt.Errorf("failed to back up database to %s: %w", path, err)
+	}
+	return nil
+}
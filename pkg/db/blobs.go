@@ -0,0 +1,362 @@
+package db
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// File content is stored once per distinct SHA-256 in blobs/blob_chunks and
+// referenced from files.blob_hash and file_versions.blob_hash. Content being
+// written is staged in upload_chunks and moved into a blob when the upload
+// completes; file_chunks only holds content of rows written before the blob
+// store existed. Reference counts are kept by triggers, and a blob is deleted
+// together with its last reference.
+
+// CreateBlobTables creates the content-addressed blob store and the triggers
+// maintaining its reference counts.
+func CreateBlobTables(db Querier) error {
+	if _, err := addColumnIfMissing(db, "files", "blob_hash", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "file_versions", "blob_hash", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS blobs (
+		hash TEXT PRIMARY KEY,
+		size INTEGER NOT NULL,
+		refcount INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS blob_chunks (
+		hash TEXT NOT NULL,
+		chunk_index INTEGER NOT NULL,
+		data BLOB NOT NULL,
+		PRIMARY KEY (hash, chunk_index)
+	);
+	`); err != nil {
+		return fmt.Errorf("failed to create blob tables: %w", err)
+	}
+
+	// Blobs written before compression existed are stored as they are
+	added, err := addColumnIfMissing(db, "blobs", "stored_size", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	if added {
+		if _, err := db.Exec("UPDATE blobs SET stored_size = size"); err != nil {
+			return fmt.Errorf("failed to initialize stored blob sizes: %w", err)
+		}
+	}
+	if _, err := addColumnIfMissing(db, "blob_chunks", "codec", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// Blobs stored before these existed get them the next time their content
+	// is committed
+	for _, column := range []string{"md5", "crc32"} {
+		if _, err := addColumnIfMissing(db, "blobs", column, "TEXT"); err != nil {
+			return err
+		}
+	}
+
+	schema := `
+	CREATE TRIGGER IF NOT EXISTS trg_blobs_release AFTER UPDATE OF refcount ON blobs
+	WHEN NEW.refcount <= 0
+	BEGIN
+		DELETE FROM blobs WHERE hash = NEW.hash;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS trg_blobs_delete_chunks AFTER DELETE ON blobs
+	BEGIN
+		DELETE FROM blob_chunks WHERE hash = OLD.hash;
+	END;
+	`
+	for _, table := range []string{"files", "file_versions"} {
+		schema += fmt.Sprintf(`
+	CREATE TRIGGER IF NOT EXISTS trg_%[1]s_blob_insert AFTER INSERT ON %[1]s
+	WHEN NEW.blob_hash IS NOT NULL
+	BEGIN
+		UPDATE blobs SET refcount = refcount + 1 WHERE hash = NEW.blob_hash;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS trg_%[1]s_blob_update AFTER UPDATE OF blob_hash ON %[1]s
+	BEGIN
+		UPDATE blobs SET refcount = refcount + 1 WHERE hash = NEW.blob_hash;
+		UPDATE blobs SET refcount = refcount - 1 WHERE hash = OLD.blob_hash;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS trg_%[1]s_blob_delete AFTER DELETE ON %[1]s
+	WHEN OLD.blob_hash IS NOT NULL
+	BEGIN
+		UPDATE blobs SET refcount = refcount - 1 WHERE hash = OLD.blob_hash;
+	END;
+	`, table)
+	}
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create blob tables: %w", err)
+	}
+	return nil
+}
+
+// chunkReader returns chunk idx of content being committed, padded or
+// trimmed to its logical length.
+type chunkReader func(q Querier, idx int64) ([]byte, error)
+
+// padChunk pads or trims stored chunk data of chunk idx to the logical
+// length of the chunk in content of the given size. Missing chunks are holes
+// and read as zeros.
+func padChunk(data []byte, size, idx int64) []byte {
+	length := min(size-idx*ChunkSize, ChunkSize)
+	if int64(len(data)) > length {
+		return data[:length]
+	}
+	return append(data, make([]byte, length-int64(len(data)))...)
+}
+
+// stagedChunk returns chunk idx of the content staged in file_chunks for a
+// file of the given size.
+func stagedChunk(q Querier, fileID, size, idx int64) ([]byte, error) {
+	var data []byte
+	err := q.QueryRow("SELECT data FROM file_chunks WHERE file_id = ? AND chunk_index = ?", fileID, idx).Scan(&data)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to read chunk %d of file %d: %w", idx, fileID, err)
+	}
+	return padChunk(data, size, idx), nil
+}
+
+// Digests are the hex encoded checksums of a blob's content. The SHA-256 is
+// also the blob's hash.
+type Digests struct {
+	SHA256 string
+	MD5    string // "" for blobs stored before digests were recorded
+	CRC32  string // "" for blobs stored before digests were recorded
+}
+
+// digestContent computes the digests of content of the given size. Empty
+// content references no blob and gets no digests.
+func digestContent(q Querier, size int64, read chunkReader) (Digests, error) {
+	if size == 0 {
+		return Digests{}, nil
+	}
+	sha, md, crc := sha256.New(), md5.New(), crc32.NewIEEE()
+	w := io.MultiWriter(sha, md, crc)
+	for idx := int64(0); idx*ChunkSize < size; idx++ {
+		data, err := read(q, idx)
+		if err != nil {
+			return Digests{}, err
+		}
+		w.Write(data)
+	}
+	return Digests{
+		SHA256: hex.EncodeToString(sha.Sum(nil)),
+		MD5:    hex.EncodeToString(md.Sum(nil)),
+		CRC32:  hex.EncodeToString(crc.Sum(nil)),
+	}, nil
+}
+
+// BlobDigests returns the recorded digests of a blob.
+func BlobDigests(q Querier, hash string) (Digests, error) {
+	d := Digests{SHA256: hash}
+	err := q.QueryRow("SELECT COALESCE(md5, ''), COALESCE(crc32, '') FROM blobs WHERE hash = ?", hash).Scan(&d.MD5, &d.CRC32)
+	if err != nil {
+		return Digests{}, fmt.Errorf("failed to read digests of blob %s: %w", hash, err)
+	}
+	return d, nil
+}
+
+// storeBlob stores content with the given digests as part of tx unless a
+// blob with that hash already exists. New blobs are stored with enc.
+func storeBlob(tx *sql.Tx, d Digests, size int64, read chunkReader, enc Encoding) error {
+	hash := d.SHA256
+	// Writing first takes the write lock up front, so concurrent commits
+	// of the same content serialize instead of failing
+	res, err := tx.Exec("INSERT OR IGNORE INTO blobs (hash, size, md5, crc32) VALUES (?, ?, ?, ?)", hash, size, d.MD5, d.CRC32)
+	if err != nil {
+		return fmt.Errorf("failed to store blob %s: %w", hash, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err := tx.Exec("UPDATE blobs SET md5 = ?, crc32 = ? WHERE hash = ? AND md5 IS NULL", d.MD5, d.CRC32, hash)
+		if err != nil {
+			return fmt.Errorf("failed to record digests of blob %s: %w", hash, err)
+		}
+		return nil
+	}
+
+	var stored int64
+	for idx := int64(0); idx*ChunkSize < size; idx++ {
+		data, err := read(tx, idx)
+		if err != nil {
+			return err
+		}
+		data, used, err := encodeChunk(enc.Codec, data)
+		if err != nil {
+			return err
+		}
+		var keyID sql.NullInt64
+		if enc.Keys != nil {
+			if data, keyID.Int64, err = enc.Keys.encrypt(hash, idx, data); err != nil {
+				return err
+			}
+			keyID.Valid = true
+		}
+		_, err = tx.Exec("INSERT INTO blob_chunks (hash, chunk_index, data, codec, key_id) VALUES (?, ?, ?, ?, ?)",
+			hash, idx, data, used, keyID)
+		if err != nil {
+			return fmt.Errorf("failed to store chunk %d of blob %s: %w", idx, hash, err)
+		}
+		stored += int64(len(data))
+	}
+	if _, err := tx.Exec("UPDATE blobs SET stored_size = ? WHERE hash = ?", stored, hash); err != nil {
+		return fmt.Errorf("failed to record size of blob %s: %w", hash, err)
+	}
+	return nil
+}
+
+// CommitBlob moves the content staged in file_chunks for a file into the blob
+// store, reusing an existing blob with the same SHA-256, and points the file
+// at it. New blobs are stored with enc. Empty files reference no blob. It
+// returns the hash, or "" for an empty file.
+func CommitBlob(db *sql.DB, fileID int64, enc Encoding) (string, error) {
+	var size int64
+	if err := db.QueryRow("SELECT size FROM files WHERE id = ?", fileID).Scan(&size); err != nil {
+		return "", fmt.Errorf("failed to look up file %d: %w", fileID, err)
+	}
+	read := func(q Querier, idx int64) ([]byte, error) {
+		return stagedChunk(q, fileID, size, idx)
+	}
+
+	digests, err := digestContent(db, size, read)
+	if err != nil {
+		return "", err
+	}
+	hash := digests.SHA256
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if hash != "" {
+		if err := storeBlob(tx, digests, size, read, enc); err != nil {
+			return "", err
+		}
+	}
+	if _, err := tx.Exec("UPDATE files SET blob_hash = NULLIF(?, '') WHERE id = ?", hash, fileID); err != nil {
+		return "", fmt.Errorf("failed to reference blob from file %d: %w", fileID, err)
+	}
+	if _, err := tx.Exec("DELETE FROM file_chunks WHERE file_id = ?", fileID); err != nil {
+		return "", fmt.Errorf("failed to clear staged content of file %d: %w", fileID, err)
+	}
+	return hash, tx.Commit()
+}
+
+// ReadBlobChunk returns the decrypted and decoded content of chunk idx of a
+// blob, or nil if the blob has no such chunk.
+func ReadBlobChunk(q Querier, keys *Keyring, hash string, idx int64) ([]byte, error) {
+	var data []byte
+	var codec string
+	var keyID sql.NullInt64
+	err := q.QueryRow("SELECT data, codec, key_id FROM blob_chunks WHERE hash = ? AND chunk_index = ?", hash, idx).Scan(&data, &codec, &keyID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %d of blob %s: %w", idx, hash, err)
+	}
+	if keyID.Valid {
+		if data, err = keys.decrypt(hash, idx, keyID.Int64, data); err != nil {
+			return nil, err
+		}
+	}
+	return DecodeChunk(codec, data)
+}
+
+// CommitStagedFiles moves content left in file_chunks by rows written before
+// the blob store existed into blobs, and finishes uploads interrupted by a
+// crash. As when a connection drops, a resumable upload keeps the content
+// received so far, so the client can continue it with REST, and any other
+// upload is discarded. It must only run while no uploads are in progress.
+func CommitStagedFiles(db *sql.DB, enc Encoding) error {
+	if err := commitResumableUploads(db, enc); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM uploads"); err != nil {
+		return fmt.Errorf("failed to discard interrupted uploads: %w", err)
+	}
+
+	// Staged content of a file that references a blob was superseded by it
+	_, err := db.Exec("DELETE FROM file_chunks WHERE file_id IN (SELECT id FROM files WHERE blob_hash IS NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("failed to clear stale staged content: %w", err)
+	}
+
+	rows, err := db.Query("SELECT DISTINCT c.file_id FROM file_chunks c JOIN files f ON f.id = c.file_id")
+	if err != nil {
+		return fmt.Errorf("failed to find staged content: %w", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if _, err := CommitBlob(db, id, enc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitResumableUploads commits the content staged by resumable uploads. A
+// chunk still cached by the writer when it stopped is lost, so the file ends
+// after the last chunk that reached upload_chunks.
+func commitResumableUploads(db *sql.DB, enc Encoding) error {
+	rows, err := db.Query(`
+		SELECT u.id, MAX(f.size, COALESCE(MAX(c.chunk_index * ? + length(c.data)), 0))
+		FROM uploads u JOIN files f ON f.id = u.file_id
+		LEFT JOIN upload_chunks c ON c.upload_id = u.id
+		WHERE u.resumable
+		GROUP BY u.id
+	`, ChunkSize)
+	if err != nil {
+		return fmt.Errorf("failed to find interrupted uploads: %w", err)
+	}
+	staged := map[int64]int64{}
+	for rows.Next() {
+		var id, size int64
+		if err := rows.Scan(&id, &size); err != nil {
+			rows.Close()
+			return err
+		}
+		staged[id] = size
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, size := range staged {
+		_, err := CommitUpload(db, id, CommitOptions{Size: size, ModTime: time.Now(), Encoding: enc})
+		if err != nil && !errors.Is(err, ErrUploadGone) {
+			return fmt.Errorf("failed to keep interrupted upload %d: %w", id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// CreateCertificatesTable creates the table holding TLS certificates that the
+// server generates for itself.
+func CreateCertificatesTable(db Querier) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS tls_certificates (
+		name TEXT PRIMARY KEY,
+		cert_pem BLOB NOT NULL,
+		key_pem BLOB NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create tls_certificates table: %w", err)
+	}
+	return nil
+}
+
+// addCertificateKeyID records which data key, if any, a private key is
+// encrypted with.
+func addCertificateKeyID(db Querier) error {
+	_, err := addColumnIfMissing(db, "tls_certificates", "key_id", "INTEGER") // NULL for plaintext keys
+	return err
+}
+
+// LoadCertificate returns the PEM encoded certificate and key stored under
+// name, or sql.ErrNoRows if there is none. An encrypted key needs keys to be
+// read; a key stored in plaintext before a master key was set is encrypted in
+// place once keys are given.
+func LoadCertificate(db *sql.DB, keys *Keyring, name string) (certPEM, keyPEM []byte, err error) {
+	var keyID sql.NullInt64
+	err = db.QueryRow("SELECT cert_pem, key_pem, key_id FROM tls_certificates WHERE name = ?", name).Scan(&certPEM, &keyPEM, &keyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if keyID.Valid {
+		if keyPEM, err = keys.decryptCertKey(name, keyID.Int64, keyPEM); err != nil {
+			return nil, nil, err
+		}
+		return certPEM, keyPEM, nil
+	}
+
+	if keys != nil {
+		sealed, id, err := keys.encryptCertKey(name, keyPEM)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = db.Exec("UPDATE tls_certificates SET key_pem = ?, key_id = ? WHERE name = ? AND key_id IS NULL", sealed, id, name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encrypt key of certificate %s: %w", name, err)
+		}
+	}
+	return certPEM, keyPEM, nil
+}
+
+// SaveCertificate stores a PEM encoded certificate and key under name,
+// replacing any previous one. The key is encrypted when keys is set, like
+// blob chunks.
+func SaveCertificate(db *sql.DB, keys *Keyring, name string, certPEM, keyPEM []byte) error {
+	var keyID sql.NullInt64
+	if keys != nil {
+		var err error
+		if keyPEM, keyID.Int64, err = keys.encryptCertKey(name, keyPEM); err != nil {
+			return err
+		}
+		keyID.Valid = true
+	}
+
+	_, err := db.Exec(`
+		INSERT OR REPLACE INTO tls_certificates (name, cert_pem, key_pem, key_id, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, name, certPEM, keyPEM, keyID, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to save certificate %s: %w", name, err)
+	}
+	return nil
+}
+
+// rekeyCertificates re-encrypts every stored private key with the active
+// key of keys, decrypting those that were encrypted with old.
+func rekeyCertificates(tx Querier, old, keys *Keyring) error {
+	type stored struct {
+		name   string
+		keyPEM []byte
+		keyID  sql.NullInt64
+	}
+	rows, err := tx.Query("SELECT name, key_pem, key_id FROM tls_certificates")
+	if err != nil {
+		return fmt.Errorf("failed to read certificates: %w", err)
+	}
+	var certs []stored
+	for rows.Next() {
+		var c stored
+		if err := rows.Scan(&c.name, &c.keyPEM, &c.keyID); err != nil {
+			rows.Close()
+			return err
+		}
+		certs = append(certs, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range certs {
+		keyPEM := c.keyPEM
+		if c.keyID.Valid {
+			if keyPEM, err = old.decryptCertKey(c.name, c.keyID.Int64, keyPEM); err != nil {
+				return err
+			}
+		}
+		sealed, id, err := keys.encryptCertKey(c.name, keyPEM)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE tls_certificates SET key_pem = ?, key_id = ? WHERE name = ?", sealed, id, c.name); err != nil {
+			return fmt.Errorf("failed to store key of certificate %s: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+// certKeyAAD binds an encrypted private key to its certificate's name.
+func certKeyAAD(name string) []byte {
+	return fmt.Appendf(nil, "tls:%s", name)
+}
+
+// encryptCertKey seals the private key of certificate name with the active
+// data key and returns the key id.
+func (k *Keyring) encryptCertKey(name string, keyPEM []byte) ([]byte, int64, error) {
+	sealed, err := seal(k.aeads[k.active], keyPEM, certKeyAAD(name))
+	return sealed, k.active, err
+}
+
+// decryptCertKey opens the private key of certificate name sealed with data
+// key keyID.
+func (k *Keyring) decryptCertKey(name string, keyID int64, sealed []byte) ([]byte, error) {
+	if k == nil {
+		return nil, ErrMasterKeyRequired
+	}
+	aead, ok := k.aeads[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown data key %d", keyID)
+	}
+	plain, err := open(aead, sealed, certKeyAAD(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt key of certificate %s: %w", name, err)
+	}
+	return plain, nil
+}
@@ -0,0 +1,576 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// LostFoundDir is where Check reattaches entries whose parent directory is
+// missing.
+const LostFoundDir = "/lost+found"
+
+// Problem kinds reported by Check.
+const (
+	ProblemIntegrity    = "integrity"     // reported by PRAGMA integrity_check; not repairable
+	ProblemMissingRoot  = "missing-root"  // the root directory row is missing
+	ProblemOrphan       = "orphan"        // parent_id names no directory
+	ProblemCycle        = "cycle"         // parent_ids loop without reaching the root
+	ProblemBrokenLink   = "broken-link"   // a hard link whose body is missing
+	ProblemMissingBlob  = "missing-blob"  // blob_hash names no blob; the content is lost
+	ProblemSizeMismatch = "size-mismatch" // size disagrees with the stored content
+	ProblemBadModTime   = "bad-mod-time"  // mod_time is NULL or not a timestamp
+	ProblemRefcount     = "refcount"      // a blob's refcount disagrees with its references
+	ProblemStrayChunks  = "stray-chunks"  // chunks belonging to no file, version, upload or blob
+	ProblemUsage        = "usage"         // storage_usage disagrees with the file sizes
+)
+
+// Problem is an inconsistency found by Check.
+type Problem struct {
+	Kind     string
+	Path     string // affected entry, "" when the problem is not about one
+	Detail   string
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	s := p.Kind
+	if p.Path != "" {
+		s += " " + p.Path
+	}
+	if p.Detail != "" {
+		s += ": " + p.Detail
+	}
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// Check looks for inconsistencies in the database and, if repair is set,
+// fixes those it can. Orphaned entries and entries cut off from the root by a
+// parent_id cycle are moved below LostFoundDir, hard
+// links whose content is gone are removed, sizes
+// are taken from the stored content, unreadable mod_times are reset to the
+// current time, files whose content is gone are emptied, and the derived
+// counters are recomputed.
+//
+// Without repair the checks only read, from a single snapshot of the
+// database, so they may run on a live server and report its state at one
+// moment. With repair every fix is made in one transaction, which must only
+// run while the server is stopped, so Check takes an exclusive Lock and fails
+// with ErrInUse while a server holds the database.
+func Check(db *sql.DB, repair bool) ([]Problem, error) {
+	var problems []Problem
+	run := func(q Querier) error {
+		for _, check := range []func(Querier, bool) ([]Problem, error){
+			checkIntegrity,
+			checkRoot,
+			checkOrphans,
+			checkCycles,
+			checkLinks,
+			checkContent,
+			checkModTimes,
+			checkRefcounts,
+			checkStrayChunks,
+			checkUsage,
+		} {
+			found, err := check(q, repair)
+			if err != nil {
+				return err
+			}
+			problems = append(problems, found...)
+		}
+		return nil
+	}
+	if !repair {
+		return problems, snapshot(db, run)
+	}
+
+	lock, err := Lock(db, true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := run(tx); err != nil {
+		return problems, err
+	}
+	return problems, tx.Commit()
+}
+
+// snapshot runs fn in a read transaction, which sees one consistent state of
+// the database while the server goes on writing to it. The transaction is
+// begun by hand on a dedicated connection, as db.Begin takes the write lock
+// right away (see _txlock in InitDB), and it is always rolled back.
+func snapshot(db *sql.DB, fn func(Querier) error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "BEGIN DEFERRED"); err != nil {
+		return fmt.Errorf("failed to begin read transaction: %w", err)
+	}
+	defer conn.ExecContext(ctx, "ROLLBACK")
+	return fn(connQuerier{conn})
+}
+
+// connQuerier runs queries on a single connection.
+type connQuerier struct {
+	conn *sql.Conn
+}
+
+func (c connQuerier) QueryRow(query string, args ...any) *sql.Row {
+	return c.conn.QueryRowContext(context.Background(), query, args...)
+}
+
+func (c connQuerier) Query(query string, args ...any) (*sql.Rows, error) {
+	return c.conn.QueryContext(context.Background(), query, args...)
+}
+
+func (c connQuerier) Exec(query string, args ...any) (sql.Result, error) {
+	return c.conn.ExecContext(context.Background(), query, args...)
+}
+
+func checkIntegrity(db Querier, _ bool) ([]Problem, error) {
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return nil, fmt.Errorf("failed to run integrity check: %w", err)
+	}
+	defer rows.Close()
+
+	var problems []Problem
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return nil, err
+		}
+		if msg != "ok" {
+			problems = append(problems, Problem{Kind: ProblemIntegrity, Detail: msg})
+		}
+	}
+	return problems, rows.Err()
+}
+
+func checkRoot(db Querier, repair bool) ([]Problem, error) {
+	var isDir bool
+	err := db.QueryRow("SELECT is_dir FROM files WHERE parent_id IS NULL ORDER BY id LIMIT 1").Scan(&isDir)
+	if err == nil && isDir {
+		return nil, nil
+	} else if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to check for root directory: %w", err)
+	}
+	p := Problem{Kind: ProblemMissingRoot, Path: "/"}
+	if err == nil {
+		// A file at "/" cannot be fixed without losing it
+		p.Detail = "root is not a directory"
+		return []Problem{p}, nil
+	}
+	if repair {
+		if err := EnsureRoot(db); err != nil {
+			return nil, err
+		}
+		p.Repaired = true
+	}
+	return []Problem{p}, nil
+}
+
+func checkOrphans(db Querier, repair bool) ([]Problem, error) {
+	type orphan struct {
+		id, parentID int64
+		name         string
+	}
+	var orphans []orphan
+	rows, err := db.Query(`
+		SELECT id, parent_id, name FROM files f
+		WHERE parent_id IS NOT NULL AND NOT EXISTS (
+			SELECT 1 FROM files p WHERE p.id = f.parent_id AND p.is_dir = 1
+		) AND NOT (parent_id = 0 AND EXISTS (
+			SELECT 1 FROM files l WHERE l.body_id = f.id
+		))
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find orphaned entries: %w", err)
+	}
+	for rows.Next() {
+		var o orphan
+		if err := rows.Scan(&o.id, &o.parentID, &o.name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		orphans = append(orphans, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	for _, o := range orphans {
+		// An orphan has no path any more; it is reported by its name
+		p := Problem{Kind: ProblemOrphan, Path: o.name, Detail: fmt.Sprintf("parent directory %d is missing", o.parentID)}
+		if repair {
+			name := fmt.Sprintf("%d-%s", o.id, o.name)
+			if err := reattach(db, o.id, name); err != nil {
+				return nil, err
+			}
+			p.Detail += "; moved to " + LostFoundDir + "/" + name
+			p.Repaired = true
+		}
+		problems = append(problems, p)
+	}
+	return problems, nil
+}
+
+// checkCycles finds entries whose parent_id chain loops instead of reaching
+// the root. Everything in and below such a loop is unreachable. Repairing
+// moves one entry of each loop, the one with the lowest id, to LostFoundDir,
+// which reattaches the rest through it.
+func checkCycles(db Querier, repair bool) ([]Problem, error) {
+	type member struct {
+		parentID int64
+		name     string
+	}
+	members := make(map[int64]member)
+	var ids []int64
+	rows, err := db.Query(`
+		WITH RECURSIVE reach(id) AS (
+			SELECT id FROM files WHERE parent_id IS NULL
+			UNION SELECT f.id FROM files f JOIN reach r ON f.parent_id = r.id
+		), up(start, id) AS (
+			SELECT id, parent_id FROM files WHERE parent_id IS NOT NULL AND id NOT IN (SELECT id FROM reach)
+			UNION SELECT up.start, f.parent_id FROM up JOIN files f ON f.id = up.id WHERE f.parent_id IS NOT NULL
+		)
+		SELECT id, parent_id, name FROM files
+		WHERE id IN (SELECT start FROM up WHERE id = start)
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find parent_id cycles: %w", err)
+	}
+	for rows.Next() {
+		var id int64
+		var m member
+		if err := rows.Scan(&id, &m.parentID, &m.name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		members[id] = m
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Every loop is reported once, by its lowest id, which comes first
+	var problems []Problem
+	for _, id := range ids {
+		head, ok := members[id]
+		if !ok {
+			continue
+		}
+		var loop []int64
+		for next := id; ; {
+			m, ok := members[next]
+			if !ok {
+				break
+			}
+			loop = append(loop, next)
+			delete(members, next)
+			next = m.parentID
+		}
+		// Like an orphan, an unreachable entry is reported by its name
+		p := Problem{Kind: ProblemCycle, Path: head.name, Detail: fmt.Sprintf("entries %v form a parent_id cycle", loop)}
+		if repair {
+			name := fmt.Sprintf("%d-%s", id, head.name)
+			if err := reattach(db, id, name); err != nil {
+				return nil, err
+			}
+			p.Detail += "; moved to " + LostFoundDir + "/" + name
+			p.Repaired = true
+		}
+		problems = append(problems, p)
+	}
+	return problems, nil
+}
+
+// reattach moves an orphaned entry, with everything below it, into
+// LostFoundDir under the given name.
+func reattach(db Querier, id int64, name string) error {
+	_, err := db.Exec(`
+		INSERT OR IGNORE INTO files (parent_id, name, is_dir, size, mod_time, create_time, mode)
+		SELECT id, ?1, 1, 0, ?2, ?2, 448 FROM files WHERE parent_id IS NULL -- 0700
+	`, LostFoundDir[1:], time.Now().UnixNano())
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", LostFoundDir, err)
+	}
+	var dirID int64
+	var isDir bool
+	err = db.QueryRow(`
+		SELECT id, is_dir FROM files
+		WHERE name = ? AND parent_id = (SELECT id FROM files WHERE parent_id IS NULL)
+	`, LostFoundDir[1:]).Scan(&dirID, &isDir)
+	if err != nil {
+		return fmt.Errorf("failed to find %s: %w", LostFoundDir, err)
+	}
+	if !isDir {
+		return fmt.Errorf("%s exists and is not a directory", LostFoundDir)
+	}
+	_, err = db.Exec("UPDATE files SET parent_id = ?, name = ? WHERE id = ?", dirID, name, id)
+	if err != nil {
+		return fmt.Errorf("failed to move %s: %w", name, err)
+	}
+	return nil
+}
+
+func checkLinks(db Querier, repair bool) ([]Problem, error) {
+	type link struct {
+		id   int64
+		path string
+		body int64
+	}
+	var broken []link
+	rows, err := db.Query(`
+		SELECT f.id, COALESCE(p.path, f.name), f.body_id
+		FROM files f LEFT JOIN file_paths p ON p.id = f.id
+		WHERE f.body_id IS NOT NULL AND NOT EXISTS (
+			SELECT 1 FROM files b WHERE b.id = f.body_id AND b.is_dir = 0 AND b.body_id IS NULL
+		)
+		ORDER BY 2
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check hard links: %w", err)
+	}
+	for rows.Next() {
+		var l link
+		if err := rows.Scan(&l.id, &l.path, &l.body); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		broken = append(broken, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	for _, l := range broken {
+		p := Problem{Kind: ProblemBrokenLink, Path: l.path, Detail: fmt.Sprintf("file %d is missing", l.body)}
+		if repair {
+			if _, err := db.Exec("DELETE FROM files WHERE id = ?", l.id); err != nil {
+				return nil, fmt.Errorf("failed to remove %s: %w", l.path, err)
+			}
+			p.Detail += "; removed"
+			p.Repaired = true
+		}
+		problems = append(problems, p)
+	}
+	return problems, nil
+}
+
+func checkContent(db Querier, repair bool) ([]Problem, error) {
+	type mismatch struct {
+		id, size  int64
+		path      string
+		blobSize  sql.NullInt64
+		blobFound bool
+	}
+	var found []mismatch
+	rows, err := db.Query(`
+		SELECT f.id, COALESCE(p.path, f.name), f.size, b.size, b.hash IS NOT NULL
+		FROM files f LEFT JOIN blobs b ON b.hash = f.blob_hash LEFT JOIN file_paths p ON p.id = f.id
+		WHERE f.blob_hash IS NOT NULL AND (b.hash IS NULL OR b.size != f.size)
+		ORDER BY 2
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compare file sizes: %w", err)
+	}
+	for rows.Next() {
+		var m mismatch
+		if err := rows.Scan(&m.id, &m.path, &m.size, &m.blobSize, &m.blobFound); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		found = append(found, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	for _, m := range found {
+		var p Problem
+		var fix string
+		var args []any
+		if !m.blobFound {
+			p = Problem{Kind: ProblemMissingBlob, Path: m.path, Detail: "content is missing"}
+			fix, args = "UPDATE files SET blob_hash = NULL, size = 0 WHERE id = ?", []any{m.id}
+		} else {
+			p = Problem{Kind: ProblemSizeMismatch, Path: m.path,
+				Detail: fmt.Sprintf("size %d, content has %d bytes", m.size, m.blobSize.Int64)}
+			fix, args = "UPDATE files SET size = ? WHERE id = ?", []any{m.blobSize.Int64, m.id}
+		}
+		if repair {
+			if _, err := db.Exec(fix, args...); err != nil {
+				return nil, fmt.Errorf("failed to repair %s: %w", m.path, err)
+			}
+			p.Repaired = true
+		}
+		problems = append(problems, p)
+	}
+	return problems, nil
+}
+
+func checkModTimes(db Querier, repair bool) ([]Problem, error) {
+	type entry struct {
+		id   int64
+		path string
+		raw  sql.NullString
+	}
+	var bad []entry
+	// Names of hard links keep their metadata in the body row
+	rows, err := db.Query(`
+		SELECT f.id, COALESCE(p.path, f.name), CAST(f.mod_time AS TEXT)
+		FROM files f LEFT JOIN file_paths p ON p.id = f.id
+		WHERE f.body_id IS NULL AND typeof(f.mod_time) != 'integer'
+		ORDER BY 2
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check modification times: %w", err)
+	}
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.id, &e.path, &e.raw); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		bad = append(bad, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	now := time.Now().UnixNano()
+	for _, e := range bad {
+		p := Problem{Kind: ProblemBadModTime, Path: e.path, Detail: fmt.Sprintf("mod_time %q", e.raw.String)}
+		if !e.raw.Valid {
+			p.Detail = "mod_time is NULL"
+		}
+		if repair {
+			if _, err := db.Exec("UPDATE files SET mod_time = ? WHERE id = ?", now, e.id); err != nil {
+				return nil, fmt.Errorf("failed to repair %s: %w", e.path, err)
+			}
+			p.Repaired = true
+		}
+		problems = append(problems, p)
+	}
+	return problems, nil
+}
+
+func checkRefcounts(db Querier, repair bool) ([]Problem, error) {
+	type count struct {
+		hash         string
+		stored, refs int64
+	}
+	var wrong []count
+	rows, err := db.Query(`
+		SELECT hash, refcount, refs FROM (
+			SELECT b.hash, b.refcount,
+				(SELECT COUNT(*) FROM files WHERE blob_hash = b.hash) +
+				(SELECT COUNT(*) FROM file_versions WHERE blob_hash = b.hash) AS refs
+			FROM blobs b
+		) WHERE refcount != refs
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count blob references: %w", err)
+	}
+	for rows.Next() {
+		var c count
+		if err := rows.Scan(&c.hash, &c.stored, &c.refs); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		wrong = append(wrong, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	for _, c := range wrong {
+		p := Problem{Kind: ProblemRefcount, Detail: fmt.Sprintf("blob %s has refcount %d but %d references", c.hash, c.stored, c.refs)}
+		if repair {
+			// A count of zero releases the blob through trg_blobs_release
+			if _, err := db.Exec("UPDATE blobs SET refcount = ? WHERE hash = ?", c.refs, c.hash); err != nil {
+				return nil, fmt.Errorf("failed to repair blob %s: %w", c.hash, err)
+			}
+			p.Repaired = true
+		}
+		problems = append(problems, p)
+	}
+	return problems, nil
+}
+
+func checkStrayChunks(db Querier, repair bool) ([]Problem, error) {
+	var problems []Problem
+	for _, c := range []struct{ table, where string }{
+		{"file_chunks", "file_id NOT IN (SELECT id FROM files)"},
+		{"version_chunks", "version_id NOT IN (SELECT id FROM file_versions)"},
+		{"upload_chunks", "upload_id NOT IN (SELECT id FROM uploads)"},
+		{"blob_chunks", "hash NOT IN (SELECT hash FROM blobs)"},
+	} {
+		var n int64
+		if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", c.table, c.where)).Scan(&n); err != nil {
+			return nil, fmt.Errorf("failed to check %s: %w", c.table, err)
+		}
+		if n == 0 {
+			continue
+		}
+		p := Problem{Kind: ProblemStrayChunks, Detail: fmt.Sprintf("%d rows in %s", n, c.table)}
+		if repair {
+			if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", c.table, c.where)); err != nil {
+				return nil, fmt.Errorf("failed to clean up %s: %w", c.table, err)
+			}
+			p.Repaired = true
+		}
+		problems = append(problems, p)
+	}
+	return problems, nil
+}
+
+func checkUsage(db Querier, repair bool) ([]Problem, error) {
+	var tracked, actual int64
+	err := db.QueryRow(`
+		SELECT (SELECT used_bytes FROM storage_usage WHERE id = 1),
+		       (SELECT COALESCE(SUM(size), 0) FROM files) + (SELECT COALESCE(SUM(size), 0) FROM file_versions)
+	`).Scan(&tracked, &actual)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check storage usage: %w", err)
+	}
+	if tracked == actual {
+		return nil, nil
+	}
+	p := Problem{Kind: ProblemUsage, Detail: fmt.Sprintf("tracked %d bytes, files and revisions hold %d", tracked, actual)}
+	if repair {
+		if _, err := db.Exec("UPDATE storage_usage SET used_bytes = ? WHERE id = 1", actual); err != nil {
+			return nil, fmt.Errorf("failed to repair storage usage: %w", err)
+		}
+		p.Repaired = true
+	}
+	return []Problem{p}, nil
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Codecs applied to stored blob chunks. The codec of each chunk is recorded
+// in blob_chunks.codec, so chunks written with different settings coexist.
+const (
+	CodecNone = ""
+	CodecGzip = "gzip"
+)
+
+// Encoding controls how new blob chunks are stored.
+type Encoding struct {
+	Codec string   // compression codec, CodecNone or CodecGzip
+	Keys  *Keyring // encrypts chunks when set; also needed to read encrypted chunks
+}
+
+// encodeChunk encodes data with codec. Chunks that do not get smaller are
+// stored as they are, and the codec actually used is returned.
+func encodeChunk(codec string, data []byte) ([]byte, string, error) {
+	switch codec {
+	case CodecNone:
+		return data, CodecNone, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, "", err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, "", err
+		}
+		if buf.Len() >= len(data) {
+			return data, CodecNone, nil
+		}
+		return buf.Bytes(), CodecGzip, nil
+	default:
+		return nil, "", fmt.Errorf("unknown codec %q", codec)
+	}
+}
+
+// DecodeChunk reverses encodeChunk for a chunk stored with codec.
+func DecodeChunk(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return data, nil
+	case CodecGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode chunk: %w", err)
+		}
+		defer zr.Close()
+		out, err := io.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode chunk: %w", err)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+}
@@ -0,0 +1,275 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Blob chunks are encrypted with AES-256-GCM under a random data key. Data
+// keys are stored in data_keys wrapped (AES-256-GCM encrypted) by a master
+// key that never touches the database, so a copy of the database file alone
+// does not reveal file contents.
+
+// MasterKeySize is the length in bytes of a master key.
+const MasterKeySize = 32
+
+var (
+	ErrMasterKeyRequired = errors.New("database contains encrypted content; a master key is required")
+	ErrWrongMasterKey    = errors.New("master key does not match the database")
+)
+
+// Keyring holds the unwrapped data keys of a database.
+type Keyring struct {
+	active int64 // data key used for new chunks
+	aeads  map[int64]cipher.AEAD
+}
+
+// ParseMasterKey decodes a master key given as 64 hex digits or as base64.
+func ParseMasterKey(text string) ([]byte, error) {
+	text = strings.TrimSpace(text)
+	if key, err := hex.DecodeString(text); err == nil && len(key) == MasterKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == MasterKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("master key must be %d bytes encoded as hex or base64", MasterKeySize)
+}
+
+// CreateKeysTable creates the table holding wrapped data keys.
+func CreateKeysTable(db Querier) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS data_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		wrapped BLOB NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create data_keys table: %w", err)
+	}
+	_, err := addColumnIfMissing(db, "blob_chunks", "key_id", "INTEGER") // NULL for plaintext chunks
+	return err
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with aead, prefixing the random nonce.
+func seal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// open reverses seal.
+func open(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+}
+
+// LoadKeyring unwraps the data keys of the database with master, creating
+// the first data key if there is none. Without a master key it returns nil,
+// meaning content is stored unencrypted, unless the database already holds
+// data keys.
+func LoadKeyring(db *sql.DB, master []byte) (*Keyring, error) {
+	if master == nil {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM data_keys").Scan(&count); err != nil {
+			return nil, fmt.Errorf("failed to check data keys: %w", err)
+		}
+		if count > 0 {
+			return nil, ErrMasterKeyRequired
+		}
+		return nil, nil
+	}
+
+	k, err := loadKeyring(db, master)
+	if err != nil || k.active != 0 {
+		return k, err
+	}
+	if _, err := addDataKey(db, master); err != nil {
+		return nil, err
+	}
+	return loadKeyring(db, master)
+}
+
+func loadKeyring(q Querier, master []byte) (*Keyring, error) {
+	wrapper, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.Query("SELECT id, wrapped FROM data_keys ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data keys: %w", err)
+	}
+	defer rows.Close()
+
+	k := &Keyring{aeads: map[int64]cipher.AEAD{}}
+	for rows.Next() {
+		var id int64
+		var wrapped []byte
+		if err := rows.Scan(&id, &wrapped); err != nil {
+			return nil, err
+		}
+		key, err := open(wrapper, wrapped, nil)
+		if err != nil {
+			return nil, ErrWrongMasterKey
+		}
+		if k.aeads[id], err = newAEAD(key); err != nil {
+			return nil, err
+		}
+		k.active = id
+	}
+	return k, rows.Err()
+}
+
+// addDataKey generates a data key, stores it wrapped with master and
+// returns its id.
+func addDataKey(q Querier, master []byte) (int64, error) {
+	wrapper, err := newAEAD(master)
+	if err != nil {
+		return 0, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return 0, err
+	}
+	wrapped, err := seal(wrapper, key, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := q.Exec("INSERT INTO data_keys (wrapped, created_at) VALUES (?, ?)", wrapped, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("failed to store data key: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+// chunkAAD binds an encrypted chunk to its position, so chunks cannot be
+// swapped between blobs or reordered without detection.
+func chunkAAD(hash string, idx int64) []byte {
+	return fmt.Appendf(nil, "%s:%d", hash, idx)
+}
+
+// encrypt seals a chunk with the active data key and returns the key id.
+func (k *Keyring) encrypt(hash string, idx int64, data []byte) ([]byte, int64, error) {
+	sealed, err := seal(k.aeads[k.active], data, chunkAAD(hash, idx))
+	return sealed, k.active, err
+}
+
+// decrypt opens a chunk sealed with data key keyID.
+func (k *Keyring) decrypt(hash string, idx int64, keyID int64, data []byte) ([]byte, error) {
+	if k == nil {
+		return nil, ErrMasterKeyRequired
+	}
+	aead, ok := k.aeads[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown data key %d", keyID)
+	}
+	plain, err := open(aead, data, chunkAAD(hash, idx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt chunk %d of blob %s: %w", idx, hash, err)
+	}
+	return plain, nil
+}
+
+// Rekey re-encrypts every blob chunk and certificate key under a fresh data
+// key wrapped by newMaster and discards the old data keys. oldMaster may be
+// nil for a database that holds no encrypted content yet. The whole operation runs in
+// one transaction, so an interrupted rekey leaves the database unchanged.
+// A server still running on the old data keys could no longer read or write
+// content, so Rekey takes an exclusive Lock and fails with ErrInUse while a
+// server holds the database.
+func Rekey(db *sql.DB, oldMaster, newMaster []byte) error {
+	lock, err := Lock(db, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	old, err := LoadKeyring(db, oldMaster)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	newID, err := addDataKey(tx, newMaster)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM data_keys WHERE id != ?", newID); err != nil {
+		return fmt.Errorf("failed to remove old data keys: %w", err)
+	}
+	keys, err := loadKeyring(tx, newMaster)
+	if err != nil {
+		return err
+	}
+
+	// Walk the chunks in key order one at a time to keep memory use flat
+	lastHash, lastIdx := "", int64(-1)
+	for {
+		var hash string
+		var idx int64
+		var data []byte
+		var keyID sql.NullInt64
+		err := tx.QueryRow(`
+			SELECT hash, chunk_index, data, key_id FROM blob_chunks
+			WHERE (hash, chunk_index) > (?, ?) ORDER BY hash, chunk_index LIMIT 1
+		`, lastHash, lastIdx).Scan(&hash, &idx, &data, &keyID)
+		if err == sql.ErrNoRows {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read blob chunks: %w", err)
+		}
+		lastHash, lastIdx = hash, idx
+
+		if keyID.Valid {
+			if data, err = old.decrypt(hash, idx, keyID.Int64, data); err != nil {
+				return err
+			}
+		}
+		sealed, id, err := keys.encrypt(hash, idx, data)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE blob_chunks SET data = ?, key_id = ? WHERE hash = ? AND chunk_index = ?", sealed, id, hash, idx)
+		if err != nil {
+			return fmt.Errorf("failed to store chunk %d of blob %s: %w", idx, hash, err)
+		}
+	}
+
+	if err := rekeyCertificates(tx, old, keys); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE blobs SET stored_size = (SELECT COALESCE(SUM(length(data)), 0) FROM blob_chunks c WHERE c.hash = blobs.hash)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to update stored blob sizes: %w", err)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// A symbolic link is a row with link_target set, stored as given and
+// resolved by the caller. A hard link is a name whose body_id points at the
+// row holding the content and metadata it shares with other names. Such
+// bodies live outside the tree, below parent_id 0 and named after their id,
+// and are deleted together with their last name.
+
+// bodyParent is the parent_id of rows holding the content of hard links.
+const bodyParent = 0
+
+// ErrNotLinkable is returned by Link for directories and symbolic links.
+var ErrNotLinkable = errors.New("only regular files can be hard linked")
+
+// CreateLinkColumns adds the columns for symbolic and hard links.
+func CreateLinkColumns(db Querier) error {
+	if _, err := addColumnIfMissing(db, "files", "link_target", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "files", "body_id", "INTEGER"); err != nil {
+		return err
+	}
+	schema := `
+	CREATE INDEX IF NOT EXISTS idx_files_body ON files(body_id) WHERE body_id IS NOT NULL;
+
+	CREATE TRIGGER IF NOT EXISTS trg_files_release_body AFTER DELETE ON files
+	WHEN OLD.body_id IS NOT NULL
+	BEGIN
+		DELETE FROM files WHERE id = OLD.body_id AND parent_id = 0
+			AND NOT EXISTS (SELECT 1 FROM files WHERE body_id = OLD.body_id);
+	END;
+	`
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create link schema: %w", err)
+	}
+	return nil
+}
+
+// Link gives the file at row id another name in directory parentID, as part
+// of the transaction tx. The first time a file is linked its row becomes the
+// body, so open files and its history stay attached to it, and a new row
+// takes over its name.
+func Link(tx *sql.Tx, id, parentID int64, name string) error {
+	var isDir bool
+	var bodyID sql.NullInt64
+	var target sql.NullString
+	err := tx.QueryRow("SELECT is_dir, body_id, link_target FROM files WHERE id = ?", id).Scan(&isDir, &bodyID, &target)
+	if err != nil {
+		return fmt.Errorf("failed to look up file %d: %w", id, err)
+	}
+	if isDir || target.Valid {
+		return ErrNotLinkable
+	}
+
+	body := bodyID.Int64
+	if !bodyID.Valid {
+		body = id
+		var oldParent int64
+		var oldName string
+		var deletedAt sql.NullInt64
+		var originalPath sql.NullString
+		err := tx.QueryRow("SELECT parent_id, name, deleted_at, original_path FROM files WHERE id = ?", id).
+			Scan(&oldParent, &oldName, &deletedAt, &originalPath)
+		if err != nil {
+			return fmt.Errorf("failed to look up file %d: %w", id, err)
+		}
+		_, err = tx.Exec(`
+			UPDATE files SET parent_id = ?, name = CAST(id AS TEXT), deleted_at = NULL, original_path = NULL
+			WHERE id = ?
+		`, bodyParent, id)
+		if err != nil {
+			return fmt.Errorf("failed to detach file %d: %w", id, err)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO files (parent_id, name, body_id, deleted_at, original_path)
+			VALUES (?, ?, ?, ?, ?)
+		`, oldParent, oldName, body, deletedAt, originalPath)
+		if err != nil {
+			return fmt.Errorf("failed to rename file %d: %w", id, err)
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO files (parent_id, name, body_id) VALUES (?, ?, ?)", parentID, name, body)
+	if err != nil {
+		return fmt.Errorf("failed to link file %d: %w", id, err)
+	}
+	return nil
+}
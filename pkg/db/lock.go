@@ -0,0 +1,44 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrInUse is returned by Lock when another process holds a conflicting lock
+// on the database, typically a running server.
+var ErrInUse = errors.New("database is in use by another process; stop the server first")
+
+// Lock takes an advisory lock on the database file of db, kept in a "-lock"
+// file beside it, until the returned Closer is closed. Servers take a shared
+// lock, so any number of them and the offline tools that are safe to run
+// alongside them may hold it at once. An exclusive lock is for operations
+// that would break a running server, such as Rekey discarding the data keys
+// it has loaded; Lock fails with ErrInUse rather than wait for one. An
+// in-memory database is never shared and is not locked.
+func Lock(db *sql.DB, exclusive bool) (io.Closer, error) {
+	var seq int
+	var name, file string
+	if err := db.QueryRow("PRAGMA database_list").Scan(&seq, &name, &file); err != nil {
+		return nil, fmt.Errorf("failed to locate database file: %w", err)
+	}
+	if file == "" {
+		return io.NopCloser(nil), nil
+	}
+
+	f, err := os.OpenFile(file+"-lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := lockFile(f, exclusive); err != nil {
+		f.Close()
+		if errors.Is(err, ErrInUse) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to lock database: %w", err)
+	}
+	return f, nil
+}
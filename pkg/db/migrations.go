@@ -0,0 +1,121 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The schema is built by numbered migrations, and the ones applied are
+// recorded in schema_version. Each migration runs in its own transaction
+// together with its schema_version row, so a failing migration leaves the
+// database at the previous version.
+//
+// The first migrations reproduce the schema as it was built before versions
+// were recorded. They are idempotent, so a database created by an older
+// release starts at version 0 and is brought up to date by replaying them.
+// Migrations are only ever appended; released ones must not change.
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer
+// release than this one.
+var ErrSchemaTooNew = errors.New("database schema is newer than this release supports")
+
+type migration struct {
+	name  string
+	apply func(tx Querier) error
+}
+
+var migrations = []migration{
+	{"files", createFilesTables},
+	{"file permissions", addPermissionColumns},
+	{"trash", addTrashColumns},
+	{"chunked content", MigrateInlineContent},
+	{"storage usage", CreateUsageTracking},
+	{"file versions", CreateVersionsTables},
+	{"blob store", CreateBlobTables},
+	{"uploads", CreateUploadsTables},
+	{"data keys", CreateKeysTable},
+	{"users", CreateUsersTable},
+	{"TLS certificates", CreateCertificatesTable},
+	{"directory tree", normalizeTree},
+	{"links", CreateLinkColumns},
+	{"timestamps", convertTimestamps},
+	{"version usage", countVersionUsage},
+	{"version expiry", indexVersionAge},
+	{"resumable uploads", addUploadResume},
+	{"certificate keys", addCertificateKeyID},
+	{"quota override", addQuotaOverride},
+}
+
+// LatestSchemaVersion is the schema version this release migrates to.
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// SchemaVersion returns the schema version of the database, 0 if it predates
+// versioning.
+func SchemaVersion(q Querier) (int, error) {
+	var version int
+	err := q.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// Migrate applies the migrations the database has not seen yet, in order. It
+// fails with ErrSchemaTooNew, without changing anything, if the database is
+// at a version this release does not know.
+func Migrate(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at INTEGER NOT NULL -- unix nanoseconds
+	);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+
+	for {
+		done, err := migrateStep(db)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// migrateStep applies the next pending migration and reports whether the
+// schema was already up to date. The version is read inside the transaction,
+// so concurrent processes never apply the same migration twice.
+func migrateStep(db *sql.DB) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	version, err := SchemaVersion(tx)
+	if err != nil {
+		return false, err
+	}
+	if version > len(migrations) {
+		return false, fmt.Errorf("%w: version %d, expected at most %d", ErrSchemaTooNew, version, len(migrations))
+	}
+	if version == len(migrations) {
+		return true, nil
+	}
+
+	m := migrations[version]
+	if err := m.apply(tx); err != nil {
+		return false, fmt.Errorf("migration %d (%s) failed: %w", version+1, m.name, err)
+	}
+	_, err = tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)",
+		version+1, m.name, time.Now().UnixNano())
+	if err != nil {
+		return false, fmt.Errorf("failed to record schema version %d: %w", version+1, err)
+	}
+	return false, tx.Commit()
+}
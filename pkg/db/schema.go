@@ -8,10 +8,15 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// ChunkSize is the maximum number of bytes stored in a single file_chunks row.
+// File content is split into chunks of this size so that readers and writers
+// only ever need to hold one chunk in memory at a time.
+const ChunkSize = 256 * 1024
+
 // InitDB initializes the database schema and ensures the root directory exists.
 func InitDB(dbPath string) (*sql.DB, error) {
 	// Enable WAL mode and set busy timeout to reduce contention
-	dsn := dbPath + "?_journal_mode=WAL&_busy_timeout=5000"
+	dsn := dbPath + "?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"
 	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
@@ -31,8 +36,18 @@ func InitDB(dbPath string) (*sql.DB, error) {
 	return db, nil
 }
 
-// CreateSchema creates the database schema.
+// CreateSchema brings the database schema up to date with Migrate and makes
+// sure the root directory exists.
 func CreateSchema(db *sql.DB) error {
+	if err := Migrate(db); err != nil {
+		return err
+	}
+	return EnsureRoot(db)
+}
+
+// createFilesTables creates the files table, keyed by path as it was before
+// normalizeTree, and the legacy file_chunks table.
+func createFilesTables(db Querier) error {
 	schema := `
 	CREATE TABLE IF NOT EXISTS files (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -42,34 +57,72 @@ func CreateSchema(db *sql.DB) error {
 		is_dir BOOLEAN NOT NULL DEFAULT 0,
 		size INTEGER NOT NULL DEFAULT 0,
 		mod_time DATETIME DEFAULT CURRENT_TIMESTAMP,
-		content BLOB
+		content BLOB, -- legacy inline content, see MigrateInlineContent
+		uid INTEGER NOT NULL DEFAULT 0,
+		gid INTEGER NOT NULL DEFAULT 0,
+		mode INTEGER NOT NULL DEFAULT 511 -- 0777
 	);
 	
 	CREATE INDEX IF NOT EXISTS idx_parent_path ON files(parent_path);
+
+	CREATE TABLE IF NOT EXISTS file_chunks (
+		file_id INTEGER NOT NULL,
+		chunk_index INTEGER NOT NULL,
+		data BLOB NOT NULL,
+		PRIMARY KEY (file_id, chunk_index)
+	);
+
+	CREATE TRIGGER IF NOT EXISTS trg_files_delete_chunks AFTER DELETE ON files
+	BEGIN
+		DELETE FROM file_chunks WHERE file_id = OLD.id;
+	END;
 	`
 
-	_, err := db.Exec(schema)
-	if err != nil {
+	if _, err := db.Exec(schema); err != nil {
 		return fmt.Errorf("failed to create schema: %w", err)
 	}
+	return nil
+}
 
-	// Ensure root directory exists
-	return EnsureRoot(db)
+// MigrateInlineContent moves file content stored in the legacy files.content
+// column into file_chunks. The split is done entirely inside SQLite so that
+// large legacy rows are never loaded into memory.
+func MigrateInlineContent(db Querier) error {
+	_, err := db.Exec(`
+		WITH RECURSIVE pieces(file_id, chunk_index, content) AS (
+			SELECT id, 0, content FROM files
+			WHERE content IS NOT NULL AND length(content) > 0
+			UNION ALL
+			SELECT file_id, chunk_index + 1, content FROM pieces
+			WHERE (chunk_index + 1) * ? < length(content)
+		)
+		INSERT OR REPLACE INTO file_chunks (file_id, chunk_index, data)
+		SELECT file_id, chunk_index, substr(content, chunk_index * ? + 1, ?) FROM pieces
+	`, ChunkSize, ChunkSize, ChunkSize)
+	if err != nil {
+		return fmt.Errorf("failed to migrate inline content: %w", err)
+	}
+
+	_, err = db.Exec("UPDATE files SET content = NULL WHERE content IS NOT NULL")
+	if err != nil {
+		return fmt.Errorf("failed to clear inline content: %w", err)
+	}
+	return nil
 }
 
 // EnsureRoot ensures the root directory '/' exists in the database.
-func EnsureRoot(db *sql.DB) error {
+func EnsureRoot(db Querier) error {
 	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM files WHERE path = '/'").Scan(&count)
+	err := db.QueryRow("SELECT COUNT(*) FROM files WHERE parent_id IS NULL").Scan(&count)
 	if err != nil {
 		return fmt.Errorf("failed to check for root directory: %w", err)
 	}
 
 	if count == 0 {
 		_, err = db.Exec(`
-			INSERT INTO files (path, parent_path, name, is_dir, size, mod_time)
-			VALUES ('/', '', '/', 1, 0, ?)
-		`, time.Now().Format(time.RFC3339))
+			INSERT INTO files (parent_id, name, is_dir, size, mod_time, create_time)
+			VALUES (NULL, '/', 1, 0, ?1, ?1)
+		`, time.Now().UnixNano())
 		if err != nil {
 			return fmt.Errorf("failed to insert root directory: %w", err)
 		}
@@ -77,3 +130,45 @@ func EnsureRoot(db *sql.DB) error {
 
 	return nil
 }
+
+// addPermissionColumns adds ownership and mode columns to a files table
+// created before permissions existed. Existing rows stay owned by uid 0 and
+// remain writable by everyone, which matches how they behaved before.
+func addPermissionColumns(db Querier) error {
+	if _, err := addColumnIfMissing(db, "files", "uid", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "files", "gid", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	added, err := addColumnIfMissing(db, "files", "mode", "INTEGER NOT NULL DEFAULT 511")
+	if err != nil {
+		return err
+	}
+	if added {
+		if _, err := db.Exec("UPDATE files SET mode = 438 WHERE is_dir = 0"); err != nil { // 0666
+			return fmt.Errorf("failed to set default file modes: %w", err)
+		}
+	}
+	return nil
+}
+
+// addColumnIfMissing adds a column to a table created by an older version of
+// the schema and reports whether it did. CREATE TABLE IF NOT EXISTS leaves
+// existing tables untouched, so new columns have to be added explicitly.
+func addColumnIfMissing(db Querier, table, column, definition string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	if count > 0 {
+		return false, nil
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return false, fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return true, nil
+}
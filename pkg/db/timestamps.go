@@ -0,0 +1,140 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Timestamps of files and revisions are stored as integer Unix nanoseconds,
+// like every other time in the schema. mod_time was once a DATETIME column
+// holding RFC 3339 strings, the driver's own time.Time format or SQLite's
+// CURRENT_TIMESTAMP, depending on what wrote it; convertTimestamps turns
+// those into nanoseconds. create_time is when the entry was created, or
+// whatever a client set it to with MFCT.
+
+// convertTimestamps replaces the mod_time columns of files and file_versions
+// with integer ones and adds files.create_time, which starts out as the
+// modification time for existing entries. Values that cannot be parsed
+// become NULL, which Check reports.
+func convertTimestamps(db Querier) error {
+	for _, table := range []string{"files", "file_versions"} {
+		if err := convertModTime(db, table); err != nil {
+			return err
+		}
+	}
+	if _, err := addColumnIfMissing(db, "files", "create_time", "INTEGER"); err != nil { // unix nanoseconds
+		return err
+	}
+	if _, err := db.Exec("UPDATE files SET create_time = mod_time WHERE body_id IS NULL"); err != nil {
+		return fmt.Errorf("failed to set creation times: %w", err)
+	}
+	return nil
+}
+
+// convertModTime converts the mod_time column of table. The column has to be
+// replaced rather than updated in place: the driver reads integers in a
+// DATETIME column as seconds or milliseconds.
+func convertModTime(db Querier, table string) error {
+	_, err := db.Exec(fmt.Sprintf(`
+		ALTER TABLE %[1]s RENAME COLUMN mod_time TO mod_time_text;
+		ALTER TABLE %[1]s ADD COLUMN mod_time INTEGER; -- unix nanoseconds
+	`, table))
+	if err != nil {
+		return fmt.Errorf("failed to replace %s.mod_time: %w", table, err)
+	}
+
+	for after := int64(0); ; {
+		last, err := convertModTimeBatch(db, table, after)
+		if err != nil {
+			return err
+		}
+		if last == after {
+			break
+		}
+		after = last
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s DROP COLUMN mod_time_text", table)); err != nil {
+		return fmt.Errorf("failed to drop %s.mod_time_text: %w", table, err)
+	}
+	return nil
+}
+
+// convertBatchSize is the number of rows convertModTimeBatch reads at once,
+// which bounds the memory used to convert a large table.
+const convertBatchSize = 1000
+
+// convertModTimeBatch converts up to convertBatchSize rows of table with ids
+// after after, in id order, and returns the last id read, or after when
+// there are no more rows.
+func convertModTimeBatch(db Querier, table string, after int64) (int64, error) {
+	type stamp struct {
+		id  int64
+		raw string
+	}
+	// CAST keeps the driver from parsing the values itself
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT id, CAST(mod_time_text AS TEXT) FROM %s
+		WHERE mod_time_text IS NOT NULL AND id > ? ORDER BY id LIMIT ?
+	`, table), after, convertBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s.mod_time: %w", table, err)
+	}
+	stamps := make([]stamp, 0, convertBatchSize)
+	for rows.Next() {
+		var s stamp
+		if err := rows.Scan(&s.id, &s.raw); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		stamps = append(stamps, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	last := after
+	for _, s := range stamps {
+		last = s.id
+		t, ok := parseTimestamp(s.raw)
+		if !ok {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("UPDATE %s SET mod_time = ? WHERE id = ?", table), t.UnixNano(), s.id); err != nil {
+			return 0, fmt.Errorf("failed to convert %s.mod_time of row %d: %w", table, s.id, err)
+		}
+	}
+	return last, nil
+}
+
+// timestampFormats are the layouts the driver accepts for DATETIME columns,
+// as in sqlite3.SQLiteTimestampFormats, which only exists in cgo builds.
+var timestampFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// parseTimestamp parses a timestamp stored as text, in any of the forms the
+// driver accepts for DATETIME columns. Times without a zone are UTC.
+func parseTimestamp(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, true
+	}
+	s = strings.TrimSuffix(s, "Z")
+	for _, layout := range timestampFormats {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
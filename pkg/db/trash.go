@@ -0,0 +1,44 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// TrashDirName is the directory inside each client root that deleted files
+// and directories are moved to.
+const TrashDirName = ".trash"
+
+// addTrashColumns adds the columns recording when and from where an entry
+// was moved to the trash. Only the top-level entry of a trashed subtree has
+// deleted_at set.
+func addTrashColumns(db Querier) error {
+	if _, err := addColumnIfMissing(db, "files", "deleted_at", "INTEGER"); err != nil { // unix nanoseconds
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "files", "original_path", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_files_deleted_at ON files(deleted_at) WHERE deleted_at IS NOT NULL"); err != nil {
+		return fmt.Errorf("failed to create trash index: %w", err)
+	}
+	return nil
+}
+
+// PurgeTrash permanently deletes entries that were moved to the trash before
+// the given time, together with everything below them. It returns the number
+// of rows removed.
+func PurgeTrash(db *sql.DB, before time.Time) (int64, error) {
+	res, err := db.Exec(`
+		WITH RECURSIVE expired(id) AS (
+			SELECT id FROM files WHERE deleted_at < ?
+			UNION SELECT f.id FROM files f JOIN expired e ON f.parent_id = e.id
+		)
+		DELETE FROM files WHERE id IN (SELECT id FROM expired)
+	`, before.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge trash: %w", err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,291 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Entries are stored by parent_id and name rather than by full path, with
+// the root as the only row without a parent. Moving a directory changes one
+// row no matter how much lies below it, and paths are resolved by walking
+// the tree from the root one component at a time.
+
+// maxCachedPaths bounds the number of directories a PathCache remembers.
+const maxCachedPaths = 10000
+
+// Subtree is a recursive common table expression naming the ids of the entry
+// given as its parameter and of everything below it, for use as a prefix to
+// a query reading "SELECT id FROM subtree".
+const Subtree = `
+	WITH RECURSIVE subtree(id) AS (
+		SELECT ?
+		UNION SELECT f.id FROM files f JOIN subtree s ON f.parent_id = s.id
+	)`
+
+// ErrCycle is returned by Move when the new parent is the entry itself or
+// lies below it, which would detach the entry from the tree.
+var ErrCycle = errors.New("cannot move a directory below itself")
+
+// Move gives the entry id a new parent directory and name. It refuses with
+// ErrCycle to move a directory below itself, checking the parent_id chain of
+// the new parent, so links in the paths that led to the rows cannot get
+// around it.
+func Move(q Querier, id, parentID int64, name string) error {
+	var cyclic bool
+	err := q.QueryRow(`
+		WITH RECURSIVE up(id) AS (
+			SELECT ?1
+			UNION SELECT f.parent_id FROM files f JOIN up ON f.id = up.id WHERE f.parent_id IS NOT NULL
+		)
+		SELECT EXISTS (SELECT 1 FROM up WHERE id = ?2)
+	`, parentID, id).Scan(&cyclic)
+	if err != nil {
+		return fmt.Errorf("failed to check the new parent of %d: %w", id, err)
+	}
+	if cyclic {
+		return ErrCycle
+	}
+	_, err = q.Exec("UPDATE files SET parent_id = ?, name = ? WHERE id = ?", parentID, name, id)
+	return err
+}
+
+// normalizeTree rebuilds the files table around parent_id, replacing the
+// path and parent_path columns. Entries whose parent directory is missing
+// get parent_id 0, which matches no row, so that Check finds them.
+func normalizeTree(db Querier) error {
+	// Dropping the old table drops its triggers; they are dropped first so
+	// that none of them fires, and created again below
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'trigger' AND tbl_name = 'files'")
+	if err != nil {
+		return fmt.Errorf("failed to list triggers: %w", err)
+	}
+	var triggers []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		triggers = append(triggers, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, name := range triggers {
+		if _, err := db.Exec(fmt.Sprintf("DROP TRIGGER %q", name)); err != nil {
+			return fmt.Errorf("failed to drop trigger %s: %w", name, err)
+		}
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE files_tree (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		parent_id INTEGER, -- NULL for the root
+		name TEXT NOT NULL,
+		is_dir BOOLEAN NOT NULL DEFAULT 0,
+		size INTEGER NOT NULL DEFAULT 0,
+		mod_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		uid INTEGER NOT NULL DEFAULT 0,
+		gid INTEGER NOT NULL DEFAULT 0,
+		mode INTEGER NOT NULL DEFAULT 511, -- 0777
+		deleted_at INTEGER, -- unix nanoseconds
+		original_path TEXT,
+		blob_hash TEXT
+	);
+
+	INSERT INTO files_tree (id, parent_id, name, is_dir, size, mod_time, uid, gid, mode, deleted_at, original_path, blob_hash)
+	SELECT f.id,
+		CASE WHEN f.path = '/' THEN NULL ELSE COALESCE(p.id, 0) END,
+		f.name, f.is_dir, f.size, f.mod_time, f.uid, f.gid, f.mode, f.deleted_at, f.original_path, f.blob_hash
+	FROM files f LEFT JOIN files p ON p.path = f.parent_path AND p.is_dir = 1;
+
+	UPDATE sqlite_sequence SET seq = (SELECT seq FROM sqlite_sequence WHERE name = 'files')
+	WHERE name = 'files_tree';
+
+	DROP TABLE files;
+	ALTER TABLE files_tree RENAME TO files;
+
+	CREATE UNIQUE INDEX idx_files_parent_name ON files(parent_id, name);
+	CREATE INDEX IF NOT EXISTS idx_files_deleted_at ON files(deleted_at) WHERE deleted_at IS NOT NULL;
+
+	CREATE TRIGGER trg_files_delete_chunks AFTER DELETE ON files
+	BEGIN
+		DELETE FROM file_chunks WHERE file_id = OLD.id;
+	END;
+
+	CREATE VIEW file_paths (id, path) AS
+	WITH RECURSIVE paths(id, path) AS (
+		SELECT id, '/' FROM files WHERE parent_id IS NULL
+		UNION ALL
+		SELECT f.id, CASE p.path WHEN '/' THEN '/' || f.name ELSE p.path || '/' || f.name END
+		FROM files f JOIN paths p ON f.parent_id = p.id
+	)
+	SELECT id, path FROM paths;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to rebuild files table: %w", err)
+	}
+
+	for _, create := range []func(Querier) error{
+		CreateUsageTracking,
+		CreateVersionsTables,
+		CreateBlobTables,
+		CreateUploadsTables,
+	} {
+		if err := create(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PathCache maps directory paths to their ids so that resolving a path only
+// walks the components below the deepest directory already known. Callers
+// that move or remove directories must Hold the affected paths while doing
+// so. A cache is only correct while it sees every change to the tree, so a
+// database should be served through a single cache.
+type PathCache struct {
+	mu      sync.Mutex
+	ids     map[string]int64
+	gen     uint64 // changes on every Hold and release
+	holding int    // Holds not yet released
+}
+
+// NewPathCache returns an empty PathCache.
+func NewPathCache() *PathCache {
+	return &PathCache{ids: make(map[string]int64)}
+}
+
+// Hold drops the cached entries at and below prefix and keeps lookups from
+// caching anything until release is called. Callers hold it across the
+// transaction that moves or removes the entries, so that lookups racing with
+// the transaction never cache what it changes.
+func (c *PathCache) Hold(prefix string) (release func()) {
+	if c == nil {
+		return func() {}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for p := range c.ids {
+		if p == prefix || prefix == "/" || strings.HasPrefix(p, prefix+"/") {
+			delete(c.ids, p)
+		}
+	}
+	c.gen++
+	c.holding++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.gen++
+			c.holding--
+		})
+	}
+}
+
+func (c *PathCache) get(name string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, ok := c.ids[name]
+	return id, ok
+}
+
+// put caches a directory found by a lookup that started at generation gen.
+func (c *PathCache) put(gen uint64, name string, id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen || c.holding > 0 {
+		return
+	}
+	if len(c.ids) >= maxCachedPaths {
+		clear(c.ids)
+	}
+	c.ids[name] = id
+}
+
+// SymlinkError is returned by Lookup when a directory on the way to the path
+// it resolves is a symbolic link, which the caller has to follow.
+type SymlinkError struct {
+	Path   string // the symbolic link
+	Target string // its target, as stored
+	Rest   string // what remains of the path below the link
+}
+
+func (e *SymlinkError) Error() string {
+	return fmt.Sprintf("%s is a symbolic link to %s", e.Path, e.Target)
+}
+
+// Lookup returns the id of the entry at the cleaned absolute path name, or
+// sql.ErrNoRows if there is none. A symbolic link as the last element is
+// returned as it is; one in the directories leading to it stops the lookup
+// with a *SymlinkError. A nil cache resolves every path from the root. Only
+// lookups made directly on a *sql.DB add to the cache, since what a
+// transaction reads may still be rolled back.
+func (c *PathCache) Lookup(q Querier, name string) (int64, error) {
+	name = path.Clean("/" + name)
+	_, committed := q.(*sql.DB)
+	store := c != nil && committed
+	var gen uint64
+	if c != nil {
+		c.mu.Lock()
+		gen = c.gen
+		c.mu.Unlock()
+	}
+
+	// Start from the deepest cached directory on the way to name
+	dir := name
+	var id int64
+	found := false
+	for c != nil && !found {
+		id, found = c.get(dir)
+		if found || dir == "/" {
+			break
+		}
+		dir = path.Dir(dir)
+	}
+	if !found {
+		dir = "/"
+		err := q.QueryRow("SELECT id FROM files WHERE parent_id IS NULL ORDER BY id LIMIT 1").Scan(&id)
+		if err != nil {
+			return 0, err
+		}
+		if store {
+			c.put(gen, dir, id)
+		}
+	}
+	if dir == name {
+		return id, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(name[len(dir):], "/"), "/")
+	for i, part := range parts {
+		var isDir bool
+		var target sql.NullString
+		err := q.QueryRow("SELECT id, is_dir, link_target FROM files WHERE parent_id = ? AND name = ?", id, part).
+			Scan(&id, &isDir, &target)
+		if err != nil {
+			return 0, err
+		}
+		dir = path.Join(dir, part)
+		if !isDir {
+			if i == len(parts)-1 {
+				break
+			}
+			if target.Valid {
+				return 0, &SymlinkError{Path: dir, Target: target.String, Rest: strings.Join(parts[i+1:], "/")}
+			}
+			return 0, sql.ErrNoRows
+		}
+		if store {
+			c.put(gen, dir, id)
+		}
+	}
+	return id, nil
+}
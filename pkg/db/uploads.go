@@ -0,0 +1,214 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Uploads are written to upload_chunks rather than to the file they replace.
+// The file row keeps serving its previous content until CommitUpload swaps
+// the staged content into place in a single transaction, so a rejected or
+// aborted upload leaves the file as it was.
+
+var (
+	ErrUploadGone    = errors.New("upload target no longer exists")
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+)
+
+// CommitOptions describes how CommitUpload replaces the content of a file.
+type CommitOptions struct {
+	Size          int64     // length of the staged content
+	ModTime       time.Time // new modification time of the file
+	Quota         int64     // total storage limit in bytes, 0 for none
+	MaxVersions   int       // revisions of the replaced content to keep, 0 for none
+	VersionMaxAge time.Duration
+	Encoding      Encoding // used for content not yet in the blob store
+}
+
+// CreateUploadsTables creates the tables staging uploads in progress. Uploads
+// belong to a file row and are removed together with it.
+func CreateUploadsTables(db Querier) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS uploads (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id INTEGER NOT NULL,
+		created_at INTEGER NOT NULL -- unix nanoseconds
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_uploads_file ON uploads(file_id);
+
+	CREATE TABLE IF NOT EXISTS upload_chunks (
+		upload_id INTEGER NOT NULL,
+		chunk_index INTEGER NOT NULL,
+		data BLOB NOT NULL,
+		PRIMARY KEY (upload_id, chunk_index)
+	);
+
+	CREATE TRIGGER IF NOT EXISTS trg_files_delete_uploads AFTER DELETE ON files
+	BEGIN
+		DELETE FROM uploads WHERE file_id = OLD.id;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS trg_uploads_delete_chunks AFTER DELETE ON uploads
+	BEGIN
+		DELETE FROM upload_chunks WHERE upload_id = OLD.id;
+	END;
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create uploads tables: %w", err)
+	}
+	return nil
+}
+
+// addUploadResume records whether an upload keeps all of the stored content
+// of its file, so that CommitStagedFiles can tell which interrupted uploads
+// are worth keeping.
+func addUploadResume(db Querier) error {
+	_, err := addColumnIfMissing(db, "uploads", "resumable", "INTEGER NOT NULL DEFAULT 0")
+	return err
+}
+
+// BeginUpload starts an upload replacing the content of a file, seeded with
+// the first keep bytes of its current content, and returns its id. An upload
+// that keeps all of the content only adds to it, and is marked resumable.
+func BeginUpload(db *sql.DB, keys *Keyring, fileID, keep int64) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var size int64
+	var hash string
+	err = tx.QueryRow("SELECT size, COALESCE(blob_hash, '') FROM files WHERE id = ?", fileID).Scan(&size, &hash)
+	if err == sql.ErrNoRows {
+		return 0, ErrUploadGone
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to look up file %d: %w", fileID, err)
+	}
+	resumable := keep >= size
+	keep = min(keep, size)
+
+	res, err := tx.Exec("INSERT INTO uploads (file_id, created_at, resumable) VALUES (?, ?, ?)", fileID, time.Now().UnixNano(), resumable)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start upload to file %d: %w", fileID, err)
+	}
+	uploadID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	for idx := int64(0); idx*ChunkSize < keep; idx++ {
+		var data []byte
+		if hash != "" {
+			data, err = ReadBlobChunk(tx, keys, hash, idx)
+		} else {
+			data, err = stagedChunk(tx, fileID, size, idx)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if data == nil {
+			continue
+		}
+		_, err = tx.Exec("INSERT INTO upload_chunks (upload_id, chunk_index, data) VALUES (?, ?, ?)", uploadID, idx, data)
+		if err != nil {
+			return 0, fmt.Errorf("failed to copy chunk %d of file %d: %w", idx, fileID, err)
+		}
+	}
+	return uploadID, tx.Commit()
+}
+
+// uploadChunk returns chunk idx of an upload of the given size.
+func uploadChunk(q Querier, uploadID, size, idx int64) ([]byte, error) {
+	var data []byte
+	err := q.QueryRow("SELECT data FROM upload_chunks WHERE upload_id = ? AND chunk_index = ?", uploadID, idx).Scan(&data)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to read chunk %d of upload %d: %w", idx, uploadID, err)
+	}
+	return padChunk(data, size, idx), nil
+}
+
+// CommitUpload replaces the content of the upload's file with the staged
+// content in a single transaction, keeping the previous content as a
+// revision. It returns the new blob hash, the SHA-256 of the content, or ""
+// for an empty file; the other digests are recorded with the blob. It fails
+// with ErrQuotaExceeded, leaving the upload in place, if the commit would add
+// to total storage and take it past the quota, and with ErrUploadGone if the
+// file was deleted in the meantime.
+func CommitUpload(db *sql.DB, uploadID int64, opts CommitOptions) (string, error) {
+	read := func(q Querier, idx int64) ([]byte, error) {
+		return uploadChunk(q, uploadID, opts.Size, idx)
+	}
+	digests, err := digestContent(db, opts.Size, read)
+	if err != nil {
+		return "", err
+	}
+	hash := digests.SHA256
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var fileID, used int64
+	err = tx.QueryRow(`
+		SELECT f.id, (SELECT used_bytes FROM storage_usage WHERE id = 1)
+		FROM uploads u JOIN files f ON f.id = u.file_id
+		WHERE u.id = ?
+	`, uploadID).Scan(&fileID, &used)
+	if err == sql.ErrNoRows {
+		return "", ErrUploadGone
+	} else if err != nil {
+		return "", fmt.Errorf("failed to look up upload %d: %w", uploadID, err)
+	}
+
+	if opts.MaxVersions > 0 {
+		if err := SaveVersion(tx, fileID, opts.MaxVersions, opts.VersionMaxAge); err != nil {
+			return "", err
+		}
+	}
+	if hash != "" {
+		if err := storeBlob(tx, digests, opts.Size, read, opts.Encoding); err != nil {
+			return "", err
+		}
+	}
+	_, err = tx.Exec("UPDATE files SET size = ?, mod_time = ?, blob_hash = NULLIF(?, '') WHERE id = ?",
+		opts.Size, opts.ModTime.UnixNano(), hash, fileID)
+	if err != nil {
+		return "", fmt.Errorf("failed to update file %d: %w", fileID, err)
+	}
+	// Legacy staged content was replaced along with the rest
+	if _, err := tx.Exec("DELETE FROM file_chunks WHERE file_id = ?", fileID); err != nil {
+		return "", fmt.Errorf("failed to clear staged content of file %d: %w", fileID, err)
+	}
+	if _, err := tx.Exec("DELETE FROM uploads WHERE id = ?", uploadID); err != nil {
+		return "", fmt.Errorf("failed to finish upload %d: %w", uploadID, err)
+	}
+
+	// Usage now includes the new content, the revision kept of the old one
+	// and none of the revisions pruned. The write lock held since Begin
+	// keeps concurrent commits from passing the check on the same usage.
+	if opts.Quota > 0 {
+		after, err := UsedBytes(tx)
+		if err != nil {
+			return "", err
+		}
+		if after > opts.Quota && after > used {
+			return "", ErrQuotaExceeded
+		}
+	}
+	return hash, tx.Commit()
+}
+
+// DiscardUpload drops an upload and its staged content.
+func DiscardUpload(db *sql.DB, uploadID int64) error {
+	if _, err := db.Exec("DELETE FROM uploads WHERE id = ?", uploadID); err != nil {
+		return fmt.Errorf("failed to discard upload %d: %w", uploadID, err)
+	}
+	return nil
+}
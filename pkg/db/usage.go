@@ -0,0 +1,115 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Querier is satisfied by both *sql.DB and *sql.Tx.
+type Querier interface {
+	QueryRow(query string, args ...any) *sql.Row
+	Query(query string, args ...any) (*sql.Rows, error)
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// CreateUsageTracking creates the storage_usage table together with the
+// triggers that keep it in sync with the files table. The counter is seeded
+// from the existing rows the first time it is created.
+func CreateUsageTracking(db Querier) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS storage_usage (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		used_bytes INTEGER NOT NULL DEFAULT 0
+	);
+
+	INSERT OR IGNORE INTO storage_usage (id, used_bytes)
+	SELECT 1, COALESCE(SUM(size), 0) FROM files;
+
+	CREATE TRIGGER IF NOT EXISTS trg_usage_insert AFTER INSERT ON files
+	BEGIN
+		UPDATE storage_usage SET used_bytes = used_bytes + NEW.size WHERE id = 1;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS trg_usage_update AFTER UPDATE OF size ON files
+	BEGIN
+		UPDATE storage_usage SET used_bytes = used_bytes + NEW.size - OLD.size WHERE id = 1;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS trg_usage_delete AFTER DELETE ON files
+	BEGIN
+		UPDATE storage_usage SET used_bytes = used_bytes - OLD.size WHERE id = 1;
+	END;
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create storage usage tracking: %w", err)
+	}
+	return nil
+}
+
+// UsedBytes returns the total size of all stored files and their previous
+// revisions as tracked in storage_usage.
+func UsedBytes(q Querier) (int64, error) {
+	var used int64
+	err := q.QueryRow("SELECT used_bytes FROM storage_usage WHERE id = 1").Scan(&used)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read storage usage: %w", err)
+	}
+	return used, nil
+}
+
+// addQuotaOverride adds the storage quota set through the admin API, which
+// replaces --storage-quota until it is cleared.
+func addQuotaOverride(db Querier) error {
+	_, err := addColumnIfMissing(db, "storage_usage", "quota_override", "INTEGER") // NULL when not overridden
+	return err
+}
+
+// QuotaOverride returns the stored storage quota override, and false if the
+// configured quota applies.
+func QuotaOverride(q Querier) (int64, bool, error) {
+	var quota sql.NullInt64
+	err := q.QueryRow("SELECT quota_override FROM storage_usage WHERE id = 1").Scan(&quota)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read quota override: %w", err)
+	}
+	return quota.Int64, quota.Valid, nil
+}
+
+// SetQuotaOverride stores a storage quota that replaces the configured one,
+// also after a restart, until ClearQuotaOverride.
+func SetQuotaOverride(q Querier, quota int64) error {
+	if _, err := q.Exec("UPDATE storage_usage SET quota_override = ? WHERE id = 1", quota); err != nil {
+		return fmt.Errorf("failed to store quota override: %w", err)
+	}
+	return nil
+}
+
+// ClearQuotaOverride drops the stored storage quota override.
+func ClearQuotaOverride(q Querier) error {
+	if _, err := q.Exec("UPDATE storage_usage SET quota_override = NULL WHERE id = 1"); err != nil {
+		return fmt.Errorf("failed to clear quota override: %w", err)
+	}
+	return nil
+}
+
+// StorageStats summarizes how much space file content takes at each level.
+type StorageStats struct {
+	LogicalBytes int64 // total size of all files and revisions, as counted against the quota
+	UniqueBytes  int64 // size of the distinct content after deduplication
+	StoredBytes  int64 // bytes actually stored for that content after compression
+}
+
+// GetStorageStats returns the current storage statistics.
+func GetStorageStats(q Querier) (StorageStats, error) {
+	var s StorageStats
+	err := q.QueryRow(`
+		SELECT (SELECT used_bytes FROM storage_usage WHERE id = 1),
+		       COALESCE(SUM(size), 0), COALESCE(SUM(stored_size), 0)
+		FROM blobs
+	`).Scan(&s.LogicalBytes, &s.UniqueBytes, &s.StoredBytes)
+	if err != nil {
+		return s, fmt.Errorf("failed to read storage statistics: %w", err)
+	}
+	return s, nil
+}
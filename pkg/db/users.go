@@ -0,0 +1,199 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrInvalidCredentials is returned when a username/password pair does not match.
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrUserDisabled is returned when the account exists but has been disabled.
+	ErrUserDisabled = errors.New("user is disabled")
+	// ErrUserNotFound is returned when managing an account that does not exist.
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// DefaultGID is the shared group of accounts created before each account got
+// a private group.
+const DefaultGID = 100
+
+// NobodyID is the uid and gid anonymous sessions act as, following the usual
+// "nobody" convention.
+const NobodyID = 65534
+
+// dummyHash is compared against when the username is unknown so that failed
+// logins take the same time whether or not the account exists.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("sealed-ftpd"), bcrypt.DefaultCost)
+	return hash
+})
+
+// User is an account allowed to log in to the FTP server.
+type User struct {
+	ID        int64 // Also the uid owning the user's files
+	GID       int64
+	Username  string
+	HomeDir   string // Database path the user is confined to; empty for the default
+	Disabled  bool
+	CreatedAt time.Time
+	LastLogin sql.NullTime
+}
+
+// CreateUsersTable creates the users table.
+func CreateUsersTable(db Querier) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT UNIQUE NOT NULL,
+		password_hash TEXT NOT NULL,
+		disabled BOOLEAN NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_login DATETIME
+	);
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create users table: %w", err)
+	}
+	if _, err := addColumnIfMissing(db, "users", "home_dir", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	_, err := addColumnIfMissing(db, "users", "gid", fmt.Sprintf("INTEGER NOT NULL DEFAULT %d", DefaultGID))
+	return err
+}
+
+// CreateUser adds a new account with a bcrypt hash of the given password.
+// The account gets a private group numbered like its uid, so the group bits of
+// its files grant nobody else access until SetUserGID puts accounts in a
+// shared group. Ids that would land in DefaultGID or NobodyID are skipped.
+// Run it in a transaction to create the account atomically.
+func CreateUser(db Querier, username, password string) error {
+	if username == "" {
+		return errors.New("username must not be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	// Take the next id AUTOINCREMENT would, which is also the uid and
+	// the private gid
+	var id int64
+	err = db.QueryRow("SELECT COALESCE(MAX(seq), 0) + 1 FROM sqlite_sequence WHERE name = 'users'").Scan(&id)
+	if err != nil {
+		return fmt.Errorf("failed to allocate uid: %w", err)
+	}
+	for id == DefaultGID || id == NobodyID {
+		id++
+	}
+
+	_, err = db.Exec("INSERT INTO users (id, username, password_hash, gid, created_at) VALUES (?, ?, ?, ?, ?)",
+		id, username, string(hash), id, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to create user %s: %w", username, err)
+	}
+	return nil
+}
+
+// SetUserPassword replaces the password of an existing account.
+func SetUserPassword(db Querier, username, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	return updateUser(db, "UPDATE users SET password_hash = ? WHERE username = ?", string(hash), username)
+}
+
+// SetUserHome sets the directory an account is confined to. An empty home
+// selects the server's default of <home-root>/<username>.
+func SetUserHome(db Querier, username, home string) error {
+	return updateUser(db, "UPDATE users SET home_dir = ? WHERE username = ?", home, username)
+}
+
+// SetUserGID sets the group an account belongs to.
+func SetUserGID(db Querier, username string, gid int64) error {
+	return updateUser(db, "UPDATE users SET gid = ? WHERE username = ?", gid, username)
+}
+
+// SetUserDisabled enables or disables an account.
+func SetUserDisabled(db Querier, username string, disabled bool) error {
+	return updateUser(db, "UPDATE users SET disabled = ? WHERE username = ?", disabled, username)
+}
+
+// DeleteUser removes an account.
+func DeleteUser(db Querier, username string) error {
+	return updateUser(db, "DELETE FROM users WHERE username = ?", username)
+}
+
+func updateUser(db Querier, query string, args ...any) error {
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// ListUsers returns all accounts ordered by username.
+func ListUsers(db Querier) ([]User, error) {
+	rows, err := db.Query("SELECT id, gid, username, home_dir, disabled, created_at, last_login FROM users ORDER BY username")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.GID, &u.Username, &u.HomeDir, &u.Disabled, &u.CreatedAt, &u.LastLogin); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// AuthenticateUser verifies a username/password pair against the users table
+// and records the login time on success.
+func AuthenticateUser(db *sql.DB, username, password string) (*User, error) {
+	var u User
+	var hash string
+	err := db.QueryRow(`
+		SELECT id, gid, username, home_dir, password_hash, disabled, created_at, last_login
+		FROM users
+		WHERE username = ?
+	`, username).Scan(&u.ID, &u.GID, &u.Username, &u.HomeDir, &hash, &u.Disabled, &u.CreatedAt, &u.LastLogin)
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return nil, ErrInvalidCredentials
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to look up user: %w", err)
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if u.Disabled {
+		return nil, ErrUserDisabled
+	}
+
+	now := time.Now().UTC()
+	if _, err := db.Exec("UPDATE users SET last_login = ? WHERE id = ?", now, u.ID); err != nil {
+		return nil, fmt.Errorf("failed to record login: %w", err)
+	}
+	u.LastLogin = sql.NullTime{Time: now, Valid: true}
+
+	return &u, nil
+}
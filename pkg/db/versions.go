@@ -0,0 +1,195 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Version is a previous revision of a file, kept when its content is replaced.
+type Version struct {
+	ID        int64
+	FileID    int64
+	BlobHash  string // content blob, or "" when the content is in version_chunks
+	Size      int64
+	ModTime   time.Time // mod_time of the file when the revision was current
+	CreatedAt time.Time // when the revision was superseded
+}
+
+// CreateVersionsTables creates the tables holding previous file revisions.
+// Versions belong to a file row and are removed together with it.
+func CreateVersionsTables(db Querier) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS file_versions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		mod_time DATETIME,
+		created_at INTEGER NOT NULL -- unix nanoseconds
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_file_versions_file ON file_versions(file_id, created_at);
+
+	CREATE TABLE IF NOT EXISTS version_chunks (
+		version_id INTEGER NOT NULL,
+		chunk_index INTEGER NOT NULL,
+		data BLOB NOT NULL,
+		PRIMARY KEY (version_id, chunk_index)
+	);
+
+	CREATE TRIGGER IF NOT EXISTS trg_files_delete_versions AFTER DELETE ON files
+	BEGIN
+		DELETE FROM file_versions WHERE file_id = OLD.id;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS trg_versions_delete_chunks AFTER DELETE ON file_versions
+	BEGIN
+		DELETE FROM version_chunks WHERE version_id = OLD.id;
+	END;
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create versions tables: %w", err)
+	}
+	return nil
+}
+
+// indexVersionAge indexes revisions by the time they were superseded, for
+// ExpireVersions.
+func indexVersionAge(db Querier) error {
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_file_versions_created ON file_versions(created_at)"); err != nil {
+		return fmt.Errorf("failed to index versions by age: %w", err)
+	}
+	return nil
+}
+
+// countVersionUsage makes storage_usage count the content of previous
+// revisions as well as that of files, so that revisions take up the storage
+// quota like any other content.
+func countVersionUsage(db Querier) error {
+	schema := `
+	UPDATE storage_usage SET used_bytes = used_bytes + (SELECT COALESCE(SUM(size), 0) FROM file_versions)
+	WHERE id = 1;
+
+	CREATE TRIGGER IF NOT EXISTS trg_usage_version_insert AFTER INSERT ON file_versions
+	BEGIN
+		UPDATE storage_usage SET used_bytes = used_bytes + NEW.size WHERE id = 1;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS trg_usage_version_delete AFTER DELETE ON file_versions
+	BEGIN
+		UPDATE storage_usage SET used_bytes = used_bytes - OLD.size WHERE id = 1;
+	END;
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to count versions in storage usage: %w", err)
+	}
+	return nil
+}
+
+// SaveVersion copies the current content of a file into a new version as
+// part of tx and then prunes the file's history to at most maxVersions
+// entries no older than maxAge (0 disables the age limit). Empty files are
+// not recorded.
+func SaveVersion(tx *sql.Tx, fileID int64, maxVersions int, maxAge time.Duration) error {
+	now := time.Now()
+	res, err := tx.Exec(`
+		INSERT INTO file_versions (file_id, size, mod_time, created_at, blob_hash)
+		SELECT id, size, mod_time, ?, blob_hash FROM files WHERE id = ? AND is_dir = 0 AND size > 0
+	`, now.UnixNano(), fileID)
+	if err != nil {
+		return fmt.Errorf("failed to save version of file %d: %w", fileID, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	versionID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	// Committed content is shared with the blob; only staged content is copied
+	_, err = tx.Exec(`
+		INSERT INTO version_chunks (version_id, chunk_index, data)
+		SELECT ?, chunk_index, data FROM file_chunks WHERE file_id = ?
+	`, versionID, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to copy content of file %d: %w", fileID, err)
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM file_versions WHERE file_id = ? AND id NOT IN (
+			SELECT id FROM file_versions WHERE file_id = ? ORDER BY created_at DESC LIMIT ?
+		)
+	`, fileID, fileID, maxVersions)
+	if err != nil {
+		return fmt.Errorf("failed to prune versions of file %d: %w", fileID, err)
+	}
+	if maxAge > 0 {
+		_, err = tx.Exec("DELETE FROM file_versions WHERE file_id = ? AND created_at < ?",
+			fileID, now.Add(-maxAge).UnixNano())
+		if err != nil {
+			return fmt.Errorf("failed to expire versions of file %d: %w", fileID, err)
+		}
+	}
+	return nil
+}
+
+// PrunedBytes returns the size of the revisions of a file that SaveVersion
+// with the same limits would prune if the file's content were replaced now,
+// which is the storage such a replacement frees. An empty file is not
+// recorded and prunes nothing.
+func PrunedBytes(q Querier, fileID int64, maxVersions int, maxAge time.Duration) (int64, error) {
+	var cutoff int64
+	if maxAge > 0 {
+		cutoff = time.Now().Add(-maxAge).UnixNano()
+	}
+	// The new revision is the newest, so maxVersions-1 older ones remain
+	var pruned int64
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(size), 0) FROM file_versions
+		WHERE file_id = ?1 AND EXISTS (SELECT 1 FROM files WHERE id = ?1 AND is_dir = 0 AND size > 0)
+		AND (created_at < ?3 OR id NOT IN (
+			SELECT id FROM file_versions WHERE file_id = ?1 ORDER BY created_at DESC LIMIT ?2
+		))
+	`, fileID, maxVersions-1, cutoff).Scan(&pruned)
+	if err != nil {
+		return 0, fmt.Errorf("failed to size pruned versions of file %d: %w", fileID, err)
+	}
+	return pruned, nil
+}
+
+// ExpireVersions permanently deletes the revisions superseded before the
+// given time and returns how many there were.
+func ExpireVersions(db *sql.DB, before time.Time) (int64, error) {
+	res, err := db.Exec("DELETE FROM file_versions WHERE created_at < ?", before.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire versions: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// ListVersions returns the stored versions of a file, newest first.
+func ListVersions(db *sql.DB, fileID int64) ([]Version, error) {
+	rows, err := db.Query(`
+		SELECT id, file_id, COALESCE(blob_hash, ''), size, COALESCE(mod_time, 0), created_at
+		FROM file_versions WHERE file_id = ? ORDER BY created_at DESC
+	`, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []Version
+	for rows.Next() {
+		var v Version
+		var modTime, created int64
+		if err := rows.Scan(&v.ID, &v.FileID, &v.BlobHash, &v.Size, &modTime, &created); err != nil {
+			return nil, fmt.Errorf("failed to scan version: %w", err)
+		}
+		v.ModTime = time.Unix(0, modTime)
+		v.CreatedAt = time.Unix(0, created).UTC()
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
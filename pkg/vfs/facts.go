@@ -0,0 +1,141 @@
+package vfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// factTimeFormat is the RFC 3659 time-val format, with the fraction kept to
+// the millisecond.
+const factTimeFormat = "20060102150405.999"
+
+// emptySHA256 is the digest of empty content, which is stored without a blob.
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+// Facts are the RFC 3659 facts of an entry, returned by FileInfo.Sys for
+// machine-readable listings. They describe what the session listing the
+// entry may do with it.
+type Facts struct {
+	Type      string    // "file", "dir" or "OS.unix=symlink"
+	Size      int64     // content size, or the target length of a symbolic link
+	Modify    time.Time // last modification, in UTC
+	Create    time.Time // creation, in UTC; zero when unknown
+	Perm      string    // RFC 3659 perm letters for the session
+	UID       int64     // owner; not part of the fact list
+	GID       int64     // group; not part of the fact list
+	Unique    string    // row id of the content, shared by hard links; "" in the versions tree
+	MediaType string    // guessed from the extension, "" when unknown
+	SHA256    string    // hex digest of the content, "" when not recorded
+}
+
+// String formats the facts as an MLSx fact list, ending with the ';' that
+// precedes the space and the entry name.
+func (f Facts) String() string {
+	var b strings.Builder
+	b.WriteString("type=" + f.Type + ";")
+	b.WriteString("size=" + strconv.FormatInt(f.Size, 10) + ";")
+	b.WriteString("modify=" + f.Modify.UTC().Format(factTimeFormat) + ";")
+	if !f.Create.IsZero() {
+		b.WriteString("create=" + f.Create.UTC().Format(factTimeFormat) + ";")
+	}
+	b.WriteString("perm=" + f.Perm + ";")
+	if f.Unique != "" {
+		b.WriteString("unique=" + f.Unique + ";")
+	}
+	if f.MediaType != "" {
+		b.WriteString("media-type=" + f.MediaType + ";")
+	}
+	if f.SHA256 != "" {
+		b.WriteString("X.sha256=" + f.SHA256 + ";")
+	}
+	return b.String()
+}
+
+// MLSxFacts implements ftpserver.FileInfoExtensionMLSx, so that MLSD and MLST
+// entries carry the full fact list.
+func (f Facts) MLSxFacts() string { return f.String() }
+
+// facts returns the facts of the entry.
+func (fi *FileInfo) facts() Facts {
+	f := Facts{
+		Type:   "file",
+		Size:   fi.Size(),
+		Modify: fi.modTime.UTC(),
+		Create: fi.createTime.UTC(),
+		Perm:   fi.perm,
+		UID:    fi.uid,
+		GID:    fi.gid,
+	}
+	if fi.id != 0 {
+		f.Unique = strconv.FormatInt(fi.id, 10)
+	}
+	switch {
+	case fi.isDir:
+		f.Type = "dir"
+	case fi.target != "":
+		f.Type = "OS.unix=symlink"
+	default:
+		f.MediaType = mediaType(fi.name)
+		f.SHA256 = fi.sha256
+		if fi.sha256 == "" && fi.size == 0 {
+			f.SHA256 = emptySHA256
+		}
+	}
+	return f
+}
+
+// mediaType guesses the media type of a file from its extension, without
+// parameters such as the charset.
+func mediaType(name string) string {
+	t, _, err := mime.ParseMediaType(mime.TypeByExtension(path.Ext(name)))
+	if err != nil {
+		return ""
+	}
+	return t
+}
+
+// permFact returns the RFC 3659 perm letters of the entry at the resolved
+// path for the session. inWritable tells whether the session may change the
+// directory holding the entry, which deleting and renaming it need.
+func (fs *SQLiteFs) permFact(name string, isDir bool, uid, gid int64, mode uint32, inWritable bool) string {
+	var perm string
+	// Nothing is written into the trash, but its entries can be deleted or
+	// renamed out of it
+	trashed := fs.inTrash(name)
+	allowed := func(want uint32) bool {
+		return (!trashed || want&permWrite == 0) && fs.user.allowed(uid, gid, mode, want)
+	}
+	if isDir {
+		if allowed(permExec) {
+			perm += "e"
+		}
+		if allowed(permRead) {
+			perm += "l"
+		}
+		if allowed(permWrite | permExec) {
+			perm += "cmp"
+		}
+	} else {
+		if allowed(permRead) {
+			perm += "r"
+		}
+		if allowed(permWrite) {
+			perm += "wa"
+		}
+	}
+	if inWritable {
+		perm += "df"
+	}
+	return perm
+}
+
+// writableDir tells whether the session may delete and rename entries in
+// the directory at the resolved path.
+func (fs *SQLiteFs) writableDir(name string) bool {
+	return fs.checkAccess(name, permWrite|permExec) == nil
+}
@@ -0,0 +1,83 @@
+package vfs
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/colinrgodsey/sealed-ftpd/pkg/db"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+)
+
+// ComputeHash implements ftpserver.ClientDriverExtensionHasher for the HASH,
+// XCRC, XMD5, XSHA* family of commands. Digests of whole files are answered
+// from the ones recorded when their content was stored; other ranges and
+// algorithms are computed by reading the file.
+func (fs *SQLiteFs) ComputeHash(name string, algo ftpserver.HASHAlgo, start, end int64) (string, error) {
+	file, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	f := file.(*SqliteFile)
+	if f.isDir {
+		return "", os.ErrInvalid
+	}
+
+	if start == 0 && end == f.size && f.blobHash != "" {
+		digests, err := db.BlobDigests(fs.db, f.blobHash)
+		if err != nil {
+			return "", err
+		}
+		if sum := storedDigest(digests, algo); sum != "" {
+			return sum, nil
+		}
+	}
+
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, io.NewSectionReader(f, start, end-start)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// storedDigest returns the digest for algo among those recorded for a blob,
+// or "" if it is not recorded.
+func storedDigest(d db.Digests, algo ftpserver.HASHAlgo) string {
+	switch algo {
+	case ftpserver.HASHAlgoSHA256:
+		return d.SHA256
+	case ftpserver.HASHAlgoMD5:
+		return d.MD5
+	case ftpserver.HASHAlgoCRC32:
+		return d.CRC32
+	}
+	return ""
+}
+
+func newHash(algo ftpserver.HASHAlgo) (hash.Hash, error) {
+	switch algo {
+	case ftpserver.HASHAlgoCRC32:
+		return crc32.NewIEEE(), nil
+	case ftpserver.HASHAlgoMD5:
+		return md5.New(), nil
+	case ftpserver.HASHAlgoSHA1:
+		return sha1.New(), nil
+	case ftpserver.HASHAlgoSHA256:
+		return sha256.New(), nil
+	case ftpserver.HASHAlgoSHA512:
+		return sha512.New(), nil
+	}
+	return nil, errors.New("unsupported hash algorithm")
+}
@@ -0,0 +1,241 @@
+package vfs
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/colinrgodsey/sealed-ftpd/pkg/db"
+)
+
+// maxLinkHops is the number of symbolic links followed while resolving a
+// single path before giving up, as with ELOOP.
+const maxLinkHops = 40
+
+var errTooManyLinks = errors.New("too many levels of symbolic links")
+
+// Symbolic link targets are stored as given. Absolute targets are client
+// paths, resolved below the root of the session following the link, and
+// relative ones are resolved against the directory holding the link. Either
+// way a link can never lead outside the session root.
+
+// entry is a name found in the tree.
+type entry struct {
+	path   string // resolved path of the name, after following links
+	id     int64  // row holding the name
+	body   int64  // row holding the content and metadata; id unless hard linked
+	target string // symbolic link target, "" for other entries
+}
+
+// walk finds the entry at the resolved path, reading through q. Symbolic
+// links in the directories leading to it are followed, and so is the last
+// element if follow is set. A missing entry returns os.ErrNotExist along
+// with the path it would have, and one deleted by another user
+// os.ErrPermission.
+func (fs *SQLiteFs) walk(q db.Querier, name string, follow bool) (entry, error) {
+	for hops := 0; ; hops++ {
+		if hops > maxLinkHops {
+			return entry{}, errTooManyLinks
+		}
+		if fs.inOthersTrash(name) {
+			return entry{}, os.ErrPermission
+		}
+		id, err := fs.driver.paths.Lookup(q, name)
+		var linkErr *db.SymlinkError
+		if errors.As(err, &linkErr) {
+			name = path.Join(fs.linkTarget(linkErr.Path, linkErr.Target), linkErr.Rest)
+			continue
+		} else if err == sql.ErrNoRows {
+			return entry{path: name}, os.ErrNotExist
+		} else if err != nil {
+			return entry{}, err
+		}
+
+		e := entry{path: name, id: id, body: id}
+		var body sql.NullInt64
+		var target sql.NullString
+		err = q.QueryRow("SELECT body_id, link_target FROM files WHERE id = ?", id).Scan(&body, &target)
+		if err == sql.ErrNoRows {
+			return entry{path: name}, os.ErrNotExist
+		} else if err != nil {
+			return entry{}, err
+		}
+		if body.Valid {
+			e.body = body.Int64
+		}
+		if target.Valid && follow {
+			name = fs.linkTarget(name, target.String)
+			continue
+		}
+		e.target = target.String
+		return e, nil
+	}
+}
+
+// lookup returns the row holding the name at the resolved path, without
+// following a symbolic link in its last element, or os.ErrNotExist.
+func (fs *SQLiteFs) lookup(q db.Querier, name string) (int64, error) {
+	e, err := fs.walk(q, name, false)
+	return e.id, err
+}
+
+// linkTarget resolves the target of the symbolic link at the resolved path
+// link.
+func (fs *SQLiteFs) linkTarget(link, target string) string {
+	if path.IsAbs(target) {
+		return fs.resolve(target)
+	}
+	dir := strings.TrimPrefix(path.Dir(link), fs.root)
+	return fs.resolve(path.Join("/", dir, target))
+}
+
+// newName checks that a new entry may be created at the resolved path and
+// returns the id of its parent directory, with the parent's links followed.
+func (fs *SQLiteFs) newName(q db.Querier, name string) (int64, error) {
+	if name == fs.root {
+		return 0, os.ErrExist
+	}
+	if fs.inTrash(name) {
+		return 0, os.ErrPermission
+	}
+	parent, err := fs.walk(q, filepath.Dir(name), true)
+	if err != nil {
+		return 0, err
+	}
+	var isDir bool
+	if err := q.QueryRow("SELECT is_dir FROM files WHERE id = ?", parent.id).Scan(&isDir); err != nil {
+		return 0, err
+	}
+	if !isDir {
+		return 0, os.ErrNotExist
+	}
+	if err := fs.checkAccessIn(q, parent.path, permWrite|permExec); err != nil {
+		return 0, err
+	}
+	var exists int
+	err = q.QueryRow("SELECT COUNT(*) FROM files WHERE parent_id = ? AND name = ?", parent.id, filepath.Base(name)).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if exists > 0 {
+		return 0, os.ErrExist
+	}
+	return parent.id, nil
+}
+
+// Symlink implements ftpserver.ClientDriverExtensionSymlink for SITE SYMLINK,
+// creating a symbolic link at newname pointing to oldname.
+func (fs *SQLiteFs) Symlink(oldname, newname string) (err error) {
+	defer observe("symlink", time.Now(), &err)
+	if _, ok := versionsPath(newname); ok {
+		return os.ErrPermission
+	}
+	if oldname == "" {
+		return os.ErrInvalid
+	}
+	newname = fs.resolve(newname)
+
+	tx, err := fs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	parentID, err := fs.newName(tx, newname)
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	_, err = tx.Exec(`
+		INSERT INTO files (parent_id, name, is_dir, size, mod_time, create_time, uid, gid, mode, link_target)
+		VALUES (?1, ?2, 0, 0, ?3, ?3, ?4, ?5, 511, ?6) -- 0777
+	`, parentID, filepath.Base(newname), time.Now().UnixNano(), fs.user.uid, fs.user.gid, oldname)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SymlinkIfPossible implements afero.Linker.
+func (fs *SQLiteFs) SymlinkIfPossible(oldname, newname string) error {
+	return fs.Symlink(oldname, newname)
+}
+
+// ReadlinkIfPossible implements afero.LinkReader.
+func (fs *SQLiteFs) ReadlinkIfPossible(name string) (_ string, err error) {
+	defer observe("readlink", time.Now(), &err)
+	if _, ok := versionsPath(name); ok {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrInvalid}
+	}
+	e, err := fs.walk(fs.db, fs.resolve(name), false)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	if e.target == "" {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrInvalid}
+	}
+	return e.target, nil
+}
+
+// LstatIfPossible implements afero.Lstater. Unlike Stat it describes a
+// symbolic link itself rather than what it points to.
+func (fs *SQLiteFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	if _, ok := versionsPath(name); ok {
+		fi, err := fs.Stat(name)
+		return fi, true, err
+	}
+	fi, err := fs.stat(fs.resolve(name), false)
+	return fi, true, err
+}
+
+// Link creates newname as a hard link to the file oldname: both names share
+// one stored body, so writing through either changes both, and the content
+// is kept until the last name is deleted.
+func (fs *SQLiteFs) Link(oldname, newname string) (err error) {
+	defer observe("link", time.Now(), &err)
+	_, oldVersioned := versionsPath(oldname)
+	_, newVersioned := versionsPath(newname)
+	if oldVersioned || newVersioned {
+		return os.ErrPermission
+	}
+	oldname = fs.resolve(oldname)
+	newname = fs.resolve(newname)
+
+	tx, err := fs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	old, err := fs.walk(tx, oldname, false)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	if err := fs.checkAccessIn(tx, oldname, permRead); err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	parentID, err := fs.newName(tx, newname)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	if err := db.Link(tx, old.id, parentID, filepath.Base(newname)); err != nil {
+		if errors.Is(err, db.ErrNotLinkable) {
+			return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrInvalid}
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// Link creates newname as a link to oldname across the whole tree, for
+// administrative tools: a symbolic link if symbolic is set, otherwise a hard
+// link.
+func (d *MainDriver) Link(oldname, newname string, symbolic bool) error {
+	if symbolic {
+		return d.rootFs().Symlink(oldname, newname)
+	}
+	return d.rootFs().Link(oldname, newname)
+}
@@ -0,0 +1,102 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are registered with the default Prometheus registry, which the
+// server exposes on its metrics listener.
+var (
+	connectionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sealed_ftpd_connections_total",
+		Help: "Client connections accepted.",
+	})
+	connectionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sealed_ftpd_connections_active",
+		Help: "Clients currently connected.",
+	})
+	loginsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sealed_ftpd_logins_total",
+		Help: "Login attempts by result (success or failure).",
+	}, []string{"result"})
+	transfersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sealed_ftpd_transfers_total",
+		Help: "Completed file transfers by direction (upload or download) and result (ok or failed).",
+	}, []string{"direction", "result"})
+	transferBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sealed_ftpd_transfer_bytes_total",
+		Help: "File content bytes transferred by direction.",
+	}, []string{"direction"})
+	transferSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sealed_ftpd_transfer_duration_seconds",
+		Help:    "Time from opening to closing a transferred file, by direction.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10), // 10ms to about 45m
+	}, []string{"direction"})
+	opSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sealed_ftpd_fs_operation_duration_seconds",
+		Help:    "Time taken by filesystem operations and logins, by operation.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10), // 100µs to about 26s
+	}, []string{"op"})
+	errorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sealed_ftpd_errors_total",
+		Help: "Failed filesystem operations by operation and kind (not_found, exists, permission, invalid, storage or internal).",
+	}, []string{"op", "kind"})
+)
+
+var (
+	bytesUploaded   = transferBytes.WithLabelValues("upload")
+	bytesDownloaded = transferBytes.WithLabelValues("download")
+)
+
+// observe records the time since start as the duration of op and counts
+// *err, if set, as a failure of op. It is meant to be deferred with a named
+// error result:
+//
+//	defer observe("mkdir", time.Now(), &err)
+func observe(op string, start time.Time, err *error) {
+	opSeconds.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if *err != nil && *err != io.EOF {
+		errorsTotal.WithLabelValues(op, errorKind(*err)).Inc()
+	}
+}
+
+// errorKind classifies an error for the errors metric, separating what
+// clients asked for wrongly from failures of the server.
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return "not_found"
+	case errors.Is(err, os.ErrExist):
+		return "exists"
+	case errors.Is(err, os.ErrPermission):
+		return "permission"
+	case errors.Is(err, os.ErrInvalid):
+		return "invalid"
+	case errors.Is(err, ftpserver.ErrStorageExceeded):
+		return "storage"
+	default:
+		return "internal"
+	}
+}
+
+// recordTransfer counts the transfer made through f, if any, once it is
+// closed with err.
+func (f *SqliteFile) recordTransfer(err error) {
+	if f.transfer == "" {
+		return
+	}
+	result := "ok"
+	if err != nil || f.failure != nil {
+		result = "failed"
+	}
+	transfersTotal.WithLabelValues(f.transfer, result).Inc()
+	transferSeconds.WithLabelValues(f.transfer).Observe(time.Since(f.opened).Seconds())
+	f.transfer = ""
+}
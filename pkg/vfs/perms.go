@@ -0,0 +1,152 @@
+package vfs
+
+import (
+	"database/sql"
+	"os"
+	"time"
+
+	"github.com/colinrgodsey/sealed-ftpd/pkg/db"
+)
+
+// Identity used for anonymous sessions, following the usual "nobody" convention.
+const (
+	AnonymousUID = db.NobodyID
+	AnonymousGID = db.NobodyID
+)
+
+// Unix style permission bits, as stored in files.mode.
+const (
+	permRead  = 4
+	permWrite = 2
+	permExec  = 1
+)
+
+// identity is the user a session acts as for permission checks.
+type identity struct {
+	uid    int64
+	gid    int64
+	system bool // server-internal access, bypasses all checks
+}
+
+var systemIdentity = identity{system: true}
+
+// allowed applies the owner/group/other permission bits of mode for this identity.
+func (id identity) allowed(uid, gid int64, mode uint32, want uint32) bool {
+	if id.system {
+		return true
+	}
+	var bits uint32
+	switch {
+	case id.uid == uid:
+		bits = mode >> 6
+	case id.gid == gid:
+		bits = mode >> 3
+	default:
+		bits = mode
+	}
+	return bits&7&want == want
+}
+
+// checkAccess verifies that the session may access the resolved path with
+// the requested permission bits.
+func (fs *SQLiteFs) checkAccess(name string, want uint32) error {
+	return fs.checkAccessIn(fs.db, name, want)
+}
+
+// checkAccessIn is checkAccess reading through q, typically a transaction.
+func (fs *SQLiteFs) checkAccessIn(q db.Querier, name string, want uint32) error {
+	if fs.user.system {
+		return nil
+	}
+	e, err := fs.walk(q, name, true)
+	if err != nil {
+		return err
+	}
+	var uid, gid int64
+	var mode uint32
+	err = q.QueryRow("SELECT uid, gid, mode FROM files WHERE id = ?", e.body).Scan(&uid, &gid, &mode)
+	if err == sql.ErrNoRows {
+		return os.ErrNotExist
+	} else if err != nil {
+		return err
+	}
+	if !fs.user.allowed(uid, gid, mode, want) {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// checkOwner verifies that the session owns the resolved path and returns
+// the id of the row holding its metadata, following links.
+func (fs *SQLiteFs) checkOwner(name string) (int64, error) {
+	e, err := fs.walk(fs.db, name, true)
+	if err != nil {
+		return 0, err
+	}
+	id := e.body
+	if fs.user.system {
+		return id, nil
+	}
+	var uid int64
+	err = fs.db.QueryRow("SELECT uid FROM files WHERE id = ?", id).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return 0, os.ErrNotExist
+	} else if err != nil {
+		return 0, err
+	}
+	if uid != fs.user.uid {
+		return 0, os.ErrPermission
+	}
+	return id, nil
+}
+
+// newMode returns the stored mode for a new file or directory created with perm.
+func (fs *SQLiteFs) newMode(perm os.FileMode, isDir bool) uint32 {
+	mode := uint32(perm.Perm())
+	if !isDir {
+		mode &= 0666
+	}
+	return mode &^ fs.driver.umask
+}
+
+// Chmod changes the permission bits of a file. Only the owner may do so.
+func (fs *SQLiteFs) Chmod(name string, mode os.FileMode) (err error) {
+	defer observe("chmod", time.Now(), &err)
+	if _, ok := versionsPath(name); ok {
+		return os.ErrPermission
+	}
+	name = fs.resolve(name)
+	id, err := fs.checkOwner(name)
+	if err != nil {
+		return err
+	}
+	_, err = fs.db.Exec("UPDATE files SET mode = ? WHERE id = ?", uint32(mode.Perm()), id)
+	return err
+}
+
+// Chown changes the owner and group of a file; -1 leaves a value unchanged.
+// Sessions may only hand a file they own to their own uid and gid; arbitrary
+// ownership changes are reserved for the server itself.
+func (fs *SQLiteFs) Chown(name string, uid, gid int) (err error) {
+	defer observe("chown", time.Now(), &err)
+	if _, ok := versionsPath(name); ok {
+		return os.ErrPermission
+	}
+	name = fs.resolve(name)
+	id, err := fs.checkOwner(name)
+	if err != nil {
+		return err
+	}
+	if !fs.user.system {
+		if (uid != -1 && int64(uid) != fs.user.uid) || (gid != -1 && int64(gid) != fs.user.gid) {
+			return os.ErrPermission
+		}
+	}
+	_, err = fs.db.Exec(`
+		UPDATE files
+		SET uid = CASE WHEN ? < 0 THEN uid ELSE ? END,
+		    gid = CASE WHEN ? < 0 THEN gid ELSE ? END
+		WHERE id = ?
+	`, uid, uid, gid, gid, id)
+	return err
+}
@@ -0,0 +1,104 @@
+package vfs
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+)
+
+// ErrSessionNotFound is returned by Disconnect for an unknown session id.
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session describes a connected client, for administration.
+type Session struct {
+	ID          uint32
+	RemoteAddr  string
+	User        string // "" until the client has logged in
+	TLS         bool   // the control connection is encrypted
+	ConnectedAt time.Time
+	LastCommand string
+}
+
+// session is the driver's record of a connected client.
+type session struct {
+	cc          ftpserver.ClientContext
+	user        string
+	connectedAt time.Time
+}
+
+// addSession records a client that has just connected.
+func (d *MainDriver) addSession(cc ftpserver.ClientContext) {
+	d.sessionsMu.Lock()
+	defer d.sessionsMu.Unlock()
+	d.sessions[cc.ID()] = &session{cc: cc, connectedAt: time.Now()}
+}
+
+// removeSession forgets a client that has disconnected.
+func (d *MainDriver) removeSession(cc ftpserver.ClientContext) {
+	d.sessionsMu.Lock()
+	defer d.sessionsMu.Unlock()
+	delete(d.sessions, cc.ID())
+}
+
+// setSessionUser records the user a client has logged in as.
+func (d *MainDriver) setSessionUser(cc ftpserver.ClientContext, user string) {
+	if cc == nil {
+		return
+	}
+	d.sessionsMu.Lock()
+	defer d.sessionsMu.Unlock()
+	if s, ok := d.sessions[cc.ID()]; ok {
+		s.user = user
+	}
+}
+
+// Sessions returns the connected clients ordered by id.
+func (d *MainDriver) Sessions() []Session {
+	d.sessionsMu.Lock()
+	defer d.sessionsMu.Unlock()
+	sessions := make([]Session, 0, len(d.sessions))
+	for id, s := range d.sessions {
+		sessions = append(sessions, Session{
+			ID:          id,
+			RemoteAddr:  s.cc.RemoteAddr().String(),
+			User:        s.user,
+			TLS:         s.cc.HasTLSForControl(),
+			ConnectedAt: s.connectedAt,
+			LastCommand: s.cc.GetLastCommand(),
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
+
+// Disconnect closes the connection of the session with the given id.
+// Transfers in progress are aborted like on any other lost connection.
+func (d *MainDriver) Disconnect(id uint32) error {
+	d.sessionsMu.Lock()
+	s, ok := d.sessions[id]
+	d.sessionsMu.Unlock()
+	if !ok {
+		return ErrSessionNotFound
+	}
+	return s.cc.Close()
+}
+
+// DisconnectUser closes the connections of every session logged in as
+// username, as after the account is deleted or disabled, and returns how
+// many there were.
+func (d *MainDriver) DisconnectUser(username string) int {
+	d.sessionsMu.Lock()
+	var matched []ftpserver.ClientContext
+	for _, s := range d.sessions {
+		if s.user == username {
+			matched = append(matched, s.cc)
+		}
+	}
+	d.sessionsMu.Unlock()
+	for _, cc := range matched {
+		cc.Close()
+	}
+	return len(matched)
+}
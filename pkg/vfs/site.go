@@ -0,0 +1,105 @@
+package vfs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+)
+
+// Site implements ftpserver.ClientDriverExtensionSite. It handles SITE RMDIR
+// itself: "SITE RMDIR -r <dir>" removes a directory with all its contents,
+// while a plain "SITE RMDIR <dir>" only removes empty directories, like RMD.
+// SITE SYMLINK is handled here so that relative targets are kept, see
+// siteSymlink. SITE MFCT and SITE MFMT set timestamps, see siteSetTime. Other
+// subcommands fall through to the library.
+func (fs *SQLiteFs) Site(param string) *ftpserver.AnswerCommand {
+	cmd, args, _ := strings.Cut(param, " ")
+	switch strings.ToUpper(cmd) {
+	case "RMDIR":
+		return fs.siteRmdir(args)
+	case "SYMLINK":
+		return fs.siteSymlink(args)
+	case "MFCT":
+		return fs.siteSetTime("Create", args, fs.SetCreateTime)
+	case "MFMT":
+		return fs.siteSetTime("Modify", args, func(name string, t time.Time) error {
+			return fs.Chtimes(name, t, t)
+		})
+	}
+	return nil
+}
+
+func (fs *SQLiteFs) siteRmdir(args string) *ftpserver.AnswerCommand {
+	recursive := false
+	if rest, ok := strings.CutPrefix(args, "-r "); ok {
+		recursive, args = true, rest
+	}
+	args = strings.TrimSpace(args)
+	if args == "" {
+		return &ftpserver.AnswerCommand{Code: ftpserver.StatusSyntaxErrorParameters, Message: "Missing path"}
+	}
+	p := fs.clientPath(args)
+
+	var err error
+	if recursive {
+		err = fs.RemoveAll(p)
+	} else {
+		err = fs.Remove(p)
+	}
+	if err != nil {
+		return &ftpserver.AnswerCommand{Code: ftpserver.StatusActionNotTaken, Message: fmt.Sprintf("Couldn't remove dir %s: %v", p, err)}
+	}
+	return &ftpserver.AnswerCommand{Code: ftpserver.StatusFileOK, Message: "Removed dir " + p}
+}
+
+// siteSymlink handles "SITE SYMLINK <target> <name>". The library would make
+// the target absolute against the working directory before storing it; here
+// it is stored as given, so a relative target stays relative to the link.
+func (fs *SQLiteFs) siteSymlink(args string) *ftpserver.AnswerCommand {
+	parts := strings.Fields(args)
+	if len(parts) != 2 {
+		return &ftpserver.AnswerCommand{Code: ftpserver.StatusSyntaxErrorParameters, Message: "Expected a target and a name"}
+	}
+	name := fs.clientPath(parts[1])
+	if err := fs.Symlink(parts[0], name); err != nil {
+		return &ftpserver.AnswerCommand{Code: ftpserver.StatusActionNotTaken, Message: fmt.Sprintf("Couldn't symlink: %v", err)}
+	}
+	return &ftpserver.AnswerCommand{Code: ftpserver.StatusOK, Message: fmt.Sprintf("Created %s -> %s", name, parts[0])}
+}
+
+// siteSetTime handles "SITE MFCT <time> <path>" and "SITE MFMT <time> <path>",
+// which take the arguments of the MFCT and MFMT commands, for clients that
+// send them as SITE subcommands. fact names the timestamp in the reply.
+func (fs *SQLiteFs) siteSetTime(fact, args string, set func(string, time.Time) error) *ftpserver.AnswerCommand {
+	value, name, ok := strings.Cut(strings.TrimSpace(args), " ")
+	if !ok || strings.TrimSpace(name) == "" {
+		return &ftpserver.AnswerCommand{Code: ftpserver.StatusSyntaxErrorParameters, Message: "Expected a time and a path"}
+	}
+	t, err := parseFactTime(value)
+	if err != nil {
+		return &ftpserver.AnswerCommand{Code: ftpserver.StatusSyntaxErrorParameters, Message: fmt.Sprintf("Couldn't parse time %s", value)}
+	}
+	p := fs.clientPath(strings.TrimSpace(name))
+	if err := set(p, t); err != nil {
+		return &ftpserver.AnswerCommand{Code: ftpserver.StatusActionNotTaken, Message: fmt.Sprintf("Couldn't set time of %s: %v", p, err)}
+	}
+	return &ftpserver.AnswerCommand{Code: ftpserver.StatusFileStatus, Message: fmt.Sprintf("%s=%s; %s", fact, value, p)}
+}
+
+// parseFactTime parses a time in the RFC 3659 form YYYYMMDDHHMMSS[.sss], in
+// UTC, with up to nine fractional digits kept.
+func parseFactTime(s string) (time.Time, error) {
+	return time.Parse("20060102150405.999999999", s)
+}
+
+// clientPath makes a path given in a command argument absolute, relative to
+// the client's working directory.
+func (fs *SQLiteFs) clientPath(p string) string {
+	if path.IsAbs(p) || fs.cc == nil {
+		return normalizePath(p)
+	}
+	return normalizePath(path.Join(fs.cc.Path(), p))
+}
@@ -0,0 +1,168 @@
+package vfs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/colinrgodsey/sealed-ftpd/pkg/db"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+)
+
+const (
+	selfSignedCertName     = "self-signed"
+	selfSignedCertValidity = 5 * 365 * 24 * time.Hour
+)
+
+var errTLSRequired = errors.New("TLS is required")
+
+// GetTLSConfig returns the TLS configuration, or nil when no certificate has
+// been configured. The certificate is loaded (or generated) once and reused.
+func (d *MainDriver) GetTLSConfig() (*tls.Config, error) {
+	d.tlsOnce.Do(func() {
+		d.tlsConfig, d.tlsErr = d.loadTLSConfig()
+	})
+	return d.tlsConfig, d.tlsErr
+}
+
+func (d *MainDriver) loadTLSConfig() (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case d.tlsCertFile != "":
+		cert, err = tls.LoadX509KeyPair(d.tlsCertFile, d.tlsKeyFile)
+	case d.tlsSelfSigned:
+		cert, err = loadOrCreateSelfSigned(d.db, d.encoding.Keys, d.listenAddr)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// PreAuthUser implements ftpserver.MainDriverExtensionUserVerifier. It
+// enforces a TLS control channel when only the control channel is required
+// to be encrypted; requiring both is left to ftpserverlib itself.
+func (d *MainDriver) PreAuthUser(cc ftpserver.ClientContext, user string) error {
+	if d.tlsRequireControl && !cc.HasTLSForControl() {
+		return errTLSRequired
+	}
+	return nil
+}
+
+// tlsRequirement maps the configured TLS settings onto ftpserverlib's modes.
+func (d *MainDriver) tlsRequirement() ftpserver.TLSRequirement {
+	switch {
+	case d.tlsImplicit:
+		return ftpserver.ImplicitEncryption
+	case d.tlsRequireControl && d.tlsRequireData:
+		return ftpserver.MandatoryEncryption
+	default:
+		return ftpserver.ClearOrEncrypted
+	}
+}
+
+// dataCommands are the commands that send content over the data channel.
+var dataCommands = map[string]bool{
+	"RETR": true, "STOR": true, "APPE": true, "STOU": true,
+	"LIST": true, "NLST": true, "MLSD": true,
+}
+
+// checkTransferTLS refuses data transfers over a cleartext channel when
+// only the data channel is required to be encrypted. Files opened for
+// commands answered on the control channel, such as HASH, are let through.
+func (fs *SQLiteFs) checkTransferTLS() error {
+	if fs.cc != nil && fs.driver.tlsRequireData && dataCommands[fs.cc.GetLastCommand()] && !fs.cc.HasTLSForTransfers() {
+		return errTLSRequired
+	}
+	return nil
+}
+
+// loadOrCreateSelfSigned returns the self-signed certificate stored in the
+// database, generating and storing a new one if none exists or it expired.
+// Its private key is encrypted with keys when a master key is set.
+func loadOrCreateSelfSigned(sqlDB *sql.DB, keys *db.Keyring, listenAddr string) (tls.Certificate, error) {
+	certPEM, keyPEM, err := db.LoadCertificate(sqlDB, keys, selfSignedCertName)
+	if err == nil {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err == nil && time.Now().Before(cert.Leaf.NotAfter) {
+			return cert, nil
+		}
+		vfsLogger.Info("Stored self-signed certificate is invalid or expired, generating a new one")
+	} else if err != sql.ErrNoRows {
+		return tls.Certificate{}, err
+	}
+
+	certPEM, keyPEM, err = generateSelfSigned(listenAddr)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := db.SaveCertificate(sqlDB, keys, selfSignedCertName, certPEM, keyPEM); err != nil {
+		return tls.Certificate{}, err
+	}
+	vfsLogger.Info("Generated self-signed TLS certificate")
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func generateSelfSigned(listenAddr string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "sealed-ftpd"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, _, err := net.SplitHostPort(listenAddr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			if !ip.IsUnspecified() && !ip.IsLoopback() {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			}
+		} else if host != "localhost" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
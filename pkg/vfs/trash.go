@@ -0,0 +1,185 @@
+package vfs
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/colinrgodsey/sealed-ftpd/pkg/db"
+)
+
+// purgeInterval is the longest time between two runs of the purger.
+const purgeInterval = time.Hour
+
+// Deleted files and directories are moved into a .trash directory at the root
+// of the session that deleted them, into a subdirectory named after the uid
+// of the deleting user and private to them, so users sharing a root never see
+// or restore each other's deletions. Entries are named <id>-<name> so that
+// entries with the same name never collide. They can be restored by renaming
+// them out of the trash and are removed for good by the purger once the
+// retention expires.
+
+func (fs *SQLiteFs) trashEnabled() bool {
+	return fs.driver.trashRetention > 0
+}
+
+// trashDir returns the resolved path of the session's trash directory.
+func (fs *SQLiteFs) trashDir() string {
+	return path.Join(fs.root, db.TrashDirName)
+}
+
+// userTrashDir returns the resolved path of the session user's part of the
+// trash.
+func (fs *SQLiteFs) userTrashDir() string {
+	return path.Join(fs.trashDir(), strconv.FormatInt(fs.user.uid, 10))
+}
+
+// inTrash reports whether the resolved path lies inside the trash directory.
+func (fs *SQLiteFs) inTrash(name string) bool {
+	return fs.trashEnabled() && strings.HasPrefix(name, fs.trashDir()+"/")
+}
+
+// inOthersTrash reports whether the resolved path lies below the part of the
+// trash of another user, which the session may not reach at all.
+func (fs *SQLiteFs) inOthersTrash(name string) bool {
+	if !fs.inTrash(name) || fs.user.system || strings.HasPrefix(name, fs.userTrashDir()+"/") {
+		return false
+	}
+	return path.Dir(name) != fs.trashDir()
+}
+
+// isTrashDir reports whether the resolved path is the trash directory or one
+// of the per-user directories in it, which are never removed or renamed.
+func (fs *SQLiteFs) isTrashDir(name string) bool {
+	return fs.trashEnabled() && (name == fs.trashDir() || path.Dir(name) == fs.trashDir())
+}
+
+// ensureTrashDir creates the trash directory, readable by everyone and owned
+// by the server, and the session user's private directory in it if they do
+// not exist yet, and returns the id of the latter.
+func (fs *SQLiteFs) ensureTrashDir(q db.Querier) (int64, error) {
+	root, err := fs.walk(q, fs.root, true)
+	if err != nil {
+		return 0, err
+	}
+	trashID, err := fs.ensureDir(q, root.id, db.TrashDirName, identity{}, 0755)
+	if err != nil {
+		return 0, err
+	}
+	// A trash created before it was split by user belongs to whoever
+	// deleted something first, which would lock everyone else out
+	if _, err := q.Exec("UPDATE files SET uid = 0, gid = 0, mode = 493 WHERE id = ?", trashID); err != nil { // 0755
+		return 0, fmt.Errorf("failed to update trash directory: %w", err)
+	}
+	return fs.ensureDir(q, trashID, strconv.FormatInt(fs.user.uid, 10), fs.user, 0700)
+}
+
+// ensureDir creates the directory name in parentID owned by owner, unless
+// it exists, and returns its id.
+func (fs *SQLiteFs) ensureDir(q db.Querier, parentID int64, name string, owner identity, mode uint32) (int64, error) {
+	_, err := q.Exec(`
+		INSERT OR IGNORE INTO files (parent_id, name, is_dir, size, mod_time, create_time, uid, gid, mode)
+		VALUES (?1, ?2, 1, 0, ?3, ?3, ?4, ?5, ?6)
+	`, parentID, name, time.Now().UnixNano(), owner.uid, owner.gid, mode)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create trash directory: %w", err)
+	}
+
+	var id int64
+	var isDir bool
+	err = q.QueryRow("SELECT id, is_dir FROM files WHERE parent_id = ? AND name = ?", parentID, name).Scan(&id, &isDir)
+	if err != nil {
+		return 0, err
+	}
+	if !isDir {
+		return 0, fmt.Errorf("trash directory %s exists and is not a directory", name)
+	}
+	return id, nil
+}
+
+// moveToTrash moves the resolved path, and everything below it, into the
+// trash as part of the transaction tx.
+func (fs *SQLiteFs) moveToTrash(tx *sql.Tx, name string) error {
+	dirID, err := fs.ensureTrashDir(tx)
+	if err != nil {
+		return err
+	}
+	id, err := fs.lookup(tx, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE files SET parent_id = ?, name = ?, deleted_at = ?, original_path = ?
+		WHERE id = ?
+	`, dirID, fmt.Sprintf("%d-%s", id, path.Base(name)), time.Now().UnixNano(), name, id)
+	if err != nil {
+		return fmt.Errorf("failed to move %s to trash: %w", name, err)
+	}
+	return nil
+}
+
+// PurgeTrash permanently deletes trash entries older than the retention period.
+func (d *MainDriver) PurgeTrash() error {
+	n, err := db.PurgeTrash(d.db, time.Now().Add(-d.trashRetention))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		// Purged directories may still be cached
+		d.paths.Hold("/")()
+		vfsLogger.Info("MainDriver.PurgeTrash: purged expired trash entries", "rows", n)
+	}
+	return nil
+}
+
+// PurgeVersions permanently deletes previous revisions older than the
+// maximum age.
+func (d *MainDriver) PurgeVersions() error {
+	n, err := db.ExpireVersions(d.db, time.Now().Add(-d.versionMaxAge))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		vfsLogger.Info("MainDriver.PurgeVersions: purged expired revisions", "rows", n)
+	}
+	return nil
+}
+
+// RunPurger purges expired trash entries and previous revisions periodically
+// until stop is closed. A nil stop channel runs it for the lifetime of the
+// process. Revisions are otherwise only expired when their file gets a new
+// one, so without this a file that stops changing keeps its old revisions.
+func (d *MainDriver) RunPurger(stop <-chan struct{}) {
+	if d.trashRetention <= 0 && d.versionMaxAge <= 0 {
+		return
+	}
+	interval := purgeInterval
+	for _, limit := range []time.Duration{d.trashRetention, d.versionMaxAge} {
+		if limit > 0 {
+			interval = min(interval, limit)
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if d.trashRetention > 0 {
+			if err := d.PurgeTrash(); err != nil {
+				vfsLogger.Error("MainDriver.RunPurger: trash purge failed", "error", err)
+			}
+		}
+		if d.versionMaxAge > 0 {
+			if err := d.PurgeVersions(); err != nil {
+				vfsLogger.Error("MainDriver.RunPurger: revision purge failed", "error", err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
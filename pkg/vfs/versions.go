@@ -0,0 +1,193 @@
+package vfs
+
+import (
+	"database/sql"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/colinrgodsey/sealed-ftpd/pkg/db"
+)
+
+// Previous revisions of files are exposed read-only under versionsDir, which
+// mirrors the client's tree: /.versions/<path> lists the revisions of the file
+// at <path>, each named after the time it was replaced, and
+// /.versions/<path>/<timestamp> can be downloaded like a regular file.
+const (
+	versionsDir       = "/.versions"
+	versionTimeFormat = "20060102T150405.000000000Z"
+)
+
+// versionsPath reports whether the client path name lies in the versions tree
+// and returns the client path it mirrors.
+func versionsPath(name string) (string, bool) {
+	name = normalizePath(name)
+	if name == versionsDir {
+		return "/", true
+	}
+	if rest, ok := strings.CutPrefix(name, versionsDir+"/"); ok {
+		return "/" + rest, true
+	}
+	return "", false
+}
+
+// readOnlyMode strips the write bits from mode. Directories of the versions
+// tree are searchable wherever they are readable.
+func readOnlyMode(mode uint32, isDir bool) uint32 {
+	mode &= 0444
+	if isDir {
+		mode |= mode >> 2
+	}
+	return mode
+}
+
+// liveFile is the part of a files row needed to serve its history.
+type liveFile struct {
+	id      int64
+	isDir   bool
+	uid     int64
+	gid     int64
+	mode    uint32
+	modTime int64
+}
+
+func (fs *SQLiteFs) lookupLive(resolved string) (*liveFile, error) {
+	e, err := fs.walk(fs.db, resolved, true)
+	if err != nil {
+		return nil, err
+	}
+	lf := liveFile{id: e.body}
+	err = fs.db.QueryRow("SELECT is_dir, uid, gid, mode, COALESCE(mod_time, 0) FROM files WHERE id = ?", lf.id).
+		Scan(&lf.isDir, &lf.uid, &lf.gid, &lf.mode, &lf.modTime)
+	if err == sql.ErrNoRows {
+		return nil, os.ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	return &lf, nil
+}
+
+// openVersion opens an entry of the versions tree. Directories and files
+// with history open as read-only directories, revisions as read-only files.
+func (fs *SQLiteFs) openVersion(name string) (*SqliteFile, error) {
+	target, _ := versionsPath(name)
+	name = normalizePath(name)
+
+	live, err := fs.lookupLive(fs.resolve(target))
+	if err == nil {
+		if !fs.user.allowed(live.uid, live.gid, live.mode, permRead) {
+			return nil, os.ErrPermission
+		}
+		info := &FileInfo{
+			name:    path.Base(name),
+			isDir:   true,
+			modTime: unixTime(live.modTime),
+			path:    name,
+			uid:     live.uid,
+			gid:     live.gid,
+			mode:    readOnlyMode(live.mode, true),
+		}
+		info.perm = fs.permFact(name, true, info.uid, info.gid, info.mode, false)
+		return &SqliteFile{path: name, fs: fs, id: live.id, isDir: true, modTime: info.modTime,
+			chunkIndex: -1, mirror: fs.resolve(target), info: info}, nil
+	} else if err != os.ErrNotExist {
+		return nil, err
+	}
+
+	// Not a live path, so it must name a revision of its parent
+	created, err := time.Parse(versionTimeFormat, path.Base(target))
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	live, err = fs.lookupLive(fs.resolve(path.Dir(target)))
+	if err != nil {
+		return nil, err
+	}
+	if live.isDir {
+		return nil, os.ErrNotExist
+	}
+	if !fs.user.allowed(live.uid, live.gid, live.mode, permRead) {
+		return nil, os.ErrPermission
+	}
+
+	var versionID, size, modTime int64
+	var blobHash string
+	err = fs.db.QueryRow("SELECT id, size, COALESCE(mod_time, 0), COALESCE(blob_hash, '') FROM file_versions WHERE file_id = ? AND created_at = ?",
+		live.id, created.UnixNano()).Scan(&versionID, &size, &modTime, &blobHash)
+	if err == sql.ErrNoRows {
+		return nil, os.ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+
+	f := newSqliteFile(fs, live.id, name, size, os.O_RDONLY, unixTime(modTime))
+	f.versionID = versionID
+	f.blobHash = blobHash
+	f.info = &FileInfo{
+		name:    path.Base(name),
+		size:    size,
+		modTime: f.modTime,
+		path:    name,
+		uid:     live.uid,
+		gid:     live.gid,
+		mode:    readOnlyMode(live.mode, false),
+		sha256:  blobHash,
+	}
+	f.info.perm = fs.permFact(name, false, f.info.uid, f.info.gid, f.info.mode, false)
+	return f, nil
+}
+
+// readVersionsDir lists a directory of the versions tree: the subdirectories
+// and files with history of a live directory, or the revisions of a file.
+func (f *SqliteFile) readVersionsDir() ([]os.FileInfo, error) {
+	live, err := f.fs.lookupLive(f.mirror)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []os.FileInfo
+	if !live.isDir {
+		versions, err := db.ListVersions(f.fs.db, live.id)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range versions {
+			fi := &FileInfo{
+				name:    v.CreatedAt.Format(versionTimeFormat),
+				size:    v.Size,
+				modTime: v.ModTime,
+				uid:     live.uid,
+				gid:     live.gid,
+				mode:    readOnlyMode(live.mode, false),
+				sha256:  v.BlobHash,
+			}
+			fi.perm = f.fs.permFact(f.path, false, fi.uid, fi.gid, fi.mode, false)
+			infos = append(infos, fi)
+		}
+		return infos, nil
+	}
+
+	rows, err := f.fs.db.Query(`
+		SELECT n.name, b.uid, b.gid, b.mode, COALESCE(b.mod_time, 0)
+		FROM files n JOIN files b ON b.id = COALESCE(n.body_id, n.id)
+		WHERE n.parent_id = ? AND (b.is_dir = 1 OR EXISTS (SELECT 1 FROM file_versions v WHERE v.file_id = b.id))
+		ORDER BY n.name
+	`, live.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		fi := FileInfo{isDir: true}
+		var modTime int64
+		if err := rows.Scan(&fi.name, &fi.uid, &fi.gid, &fi.mode, &modTime); err != nil {
+			return nil, err
+		}
+		fi.mode = readOnlyMode(fi.mode, true)
+		fi.modTime = unixTime(modTime)
+		fi.perm = f.fs.permFact(f.path, true, fi.uid, fi.gid, fi.mode, false)
+		infos = append(infos, &fi)
+	}
+	return infos, rows.Err()
+}
@@ -8,10 +8,16 @@ import (
 	"io"
 	"log/slog" // Added for logging
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/colinrgodsey/sealed-ftpd/pkg/config"
+	"github.com/colinrgodsey/sealed-ftpd/pkg/db"
+
 	ftpserver "github.com/fclairamb/ftpserverlib"
 	"github.com/spf13/afero"
 )
@@ -20,10 +26,6 @@ var vfsLogger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
 	Level: slog.LevelDebug,
 }))
 
-const (
-	MaxFileSize = 10 * 1024 * 1024 // 10MB
-)
-
 // MainDriver implements ftpserver.MainDriver
 type MainDriver struct {
 	db                *sql.DB
@@ -31,17 +33,61 @@ type MainDriver struct {
 	passiveEnd        int
 	listenAddr        string
 	connectionTimeout time.Duration
+	maxFileSize       int64
+	storageQuota      atomic.Int64 // changed at runtime through SetStorageQuota
+	allowAnonymous    bool
+	homeRoot          string
+	anonymousRoot     string
+	tlsImplicit       bool
+	tlsCertFile       string
+	tlsKeyFile        string
+	tlsSelfSigned     bool
+	tlsRequireControl bool
+	tlsRequireData    bool
+	umask             uint32
+	maxVersions       int
+	versionMaxAge     time.Duration
+	trashRetention    time.Duration
+	encoding          db.Encoding
+	paths             *db.PathCache
+
+	tlsOnce   sync.Once
+	tlsConfig *tls.Config
+	tlsErr    error
+
+	sessionsMu sync.Mutex
+	sessions   map[uint32]*session
 }
 
-// NewMainDriver creates a new MainDriver
-func NewMainDriver(db *sql.DB, passiveStart, passiveEnd int, listenAddr string, connectionTimeout time.Duration) *MainDriver {
-	return &MainDriver{
-		db:                db,
-		passiveStart:      passiveStart,
-		passiveEnd:        passiveEnd,
-		listenAddr:        listenAddr,
-		connectionTimeout: connectionTimeout,
+// NewMainDriver creates a new MainDriver. keys encrypts stored content and
+// may be nil to store it unencrypted.
+func NewMainDriver(sqliteDB *sql.DB, cfg *config.Config, keys *db.Keyring) *MainDriver {
+	d := &MainDriver{
+		db:                sqliteDB,
+		passiveStart:      cfg.PassivePortStart,
+		passiveEnd:        cfg.PassivePortEnd,
+		listenAddr:        cfg.ListenAddr,
+		connectionTimeout: cfg.ConnectionTimeout,
+		maxFileSize:       cfg.MaxFileSize,
+		allowAnonymous:    cfg.AllowAnonymous,
+		homeRoot:          cfg.HomeRoot,
+		anonymousRoot:     cfg.AnonymousRoot,
+		tlsImplicit:       cfg.TLSMode == "implicit",
+		tlsCertFile:       cfg.TLSCertFile,
+		tlsKeyFile:        cfg.TLSKeyFile,
+		tlsSelfSigned:     cfg.TLSSelfSigned,
+		tlsRequireControl: cfg.TLSRequireControl,
+		tlsRequireData:    cfg.TLSRequireData,
+		umask:             cfg.Umask,
+		maxVersions:       cfg.MaxVersions,
+		versionMaxAge:     cfg.VersionMaxAge,
+		trashRetention:    cfg.TrashRetention,
+		encoding:          db.Encoding{Codec: cfg.Codec(), Keys: keys},
+		paths:             db.NewPathCache(),
+		sessions:          make(map[uint32]*session),
 	}
+	d.storageQuota.Store(cfg.StorageQuota)
+	return d
 }
 
 // GetSettings returns the server settings
@@ -50,74 +96,221 @@ func (d *MainDriver) GetSettings() (*ftpserver.Settings, error) {
 		ListenAddr:               d.listenAddr,
 		ConnectionTimeout:        int(d.connectionTimeout.Seconds()),
 		PassiveTransferPortRange: ftpserver.PortRange{Start: d.passiveStart, End: d.passiveEnd},
+		TLSRequired:              d.tlsRequirement(),
+		EnableHASH:               true,
 	}, nil
 }
 
 // ClientConnected is called when a client connects
 func (d *MainDriver) ClientConnected(cc ftpserver.ClientContext) (string, error) {
+	connectionsTotal.Inc()
+	connectionsActive.Inc()
+	d.addSession(cc)
 	return "Welcome to SQLite FTP Mimic", nil
 }
 
 // ClientDisconnected is called when a client disconnects
 func (d *MainDriver) ClientDisconnected(cc ftpserver.ClientContext) {
+	connectionsActive.Dec()
+	d.removeSession(cc)
 }
 
 // AuthUser authenticates the user and returns a ClientDriver (filesystem)
-func (d *MainDriver) AuthUser(cc ftpserver.ClientContext, user, pass string) (ftpserver.ClientDriver, error) {
-	// No authentication required as per requirements
-	return &SQLiteFs{db: d.db}, nil
+// bound to the user's home directory.
+func (d *MainDriver) AuthUser(cc ftpserver.ClientContext, user, pass string) (_ ftpserver.ClientDriver, err error) {
+	defer func() {
+		if err != nil {
+			loginsTotal.WithLabelValues("failure").Inc()
+		} else {
+			loginsTotal.WithLabelValues("success").Inc()
+		}
+	}()
+
+	var home string
+	var owner identity
+	if isAnonymous(user) {
+		if !d.allowAnonymous {
+			vfsLogger.Info("MainDriver.AuthUser: anonymous login rejected", "user", user)
+			return nil, db.ErrInvalidCredentials
+		}
+		home = d.anonymousRoot
+		owner = identity{uid: AnonymousUID, gid: AnonymousGID}
+	} else {
+		start := time.Now()
+		u, err := db.AuthenticateUser(d.db, user, pass)
+		opSeconds.WithLabelValues("auth").Observe(time.Since(start).Seconds())
+		if err != nil {
+			vfsLogger.Info("MainDriver.AuthUser: login failed", "user", user, "error", err)
+			if errors.Is(err, db.ErrUserDisabled) {
+				// Don't reveal to the client that the account exists
+				return nil, db.ErrInvalidCredentials
+			}
+			return nil, err
+		}
+		home = u.HomeDir
+		if home == "" {
+			home = path.Join(d.homeRoot, u.Username)
+		}
+		owner = identity{uid: u.ID, gid: u.GID}
+	}
+
+	home = normalizePath(home)
+	if err := d.ensureHome(home, owner); err != nil {
+		return nil, err
+	}
+	d.setSessionUser(cc, user)
+	return &SQLiteFs{db: d.db, driver: d, root: home, cc: cc, user: owner}, nil
+}
+
+// ensureHome creates a home directory on first login and hands it to its owner.
+// Directories that already exist, such as shared homes, are left as they are,
+// and a home that cannot be looked up fails the login rather than being made
+// over.
+func (d *MainDriver) ensureHome(home string, owner identity) error {
+	root := d.rootFs()
+	if _, err := root.Stat(home); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to look up home directory %s: %w", home, err)
+	}
+	if err := root.MkdirAll(home, 0755); err != nil {
+		return fmt.Errorf("failed to create home directory %s: %w", home, err)
+	}
+	if home == "/" {
+		return nil
+	}
+	return root.Chown(home, int(owner.uid), int(owner.gid))
+}
+
+// rootFs returns a filesystem view of the whole database, for use by the
+// server itself rather than by clients.
+func (d *MainDriver) rootFs() *SQLiteFs {
+	return &SQLiteFs{db: d.db, driver: d, root: "/", user: systemIdentity}
+}
+
+// StorageQuota returns the limit on the total size of all files, 0 for none.
+func (d *MainDriver) StorageQuota() int64 {
+	return d.storageQuota.Load()
+}
+
+// SetStorageQuota changes the limit on the total size of all files. Uploads
+// in progress are checked against the new limit from their next write on; 0
+// removes the limit. It is not stored; see db.SetQuotaOverride.
+func (d *MainDriver) SetStorageQuota(quota int64) {
+	d.storageQuota.Store(quota)
+}
+
+// Stat describes the entry at name in the whole tree, for administrative
+// tools. A symbolic link is described rather than followed.
+func (d *MainDriver) Stat(name string) (os.FileInfo, error) {
+	fi, _, err := d.rootFs().LstatIfPossible(name)
+	return fi, err
 }
 
-// GetTLSConfig returns the TLS configuration
-func (d *MainDriver) GetTLSConfig() (*tls.Config, error) {
-	return nil, nil
+// Readlink returns the target of the symbolic link at name in the whole tree.
+func (d *MainDriver) Readlink(name string) (string, error) {
+	return d.rootFs().ReadlinkIfPossible(name)
+}
+
+// ReadDir lists the directory at name in the whole tree for administrative
+// tools: up to count entries following the name after, in name order, or all
+// of them if count <= 0.
+func (d *MainDriver) ReadDir(name, after string, count int) ([]os.FileInfo, error) {
+	file, err := d.rootFs().Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	f := file.(*SqliteFile)
+	f.dirCursor = after
+	infos, err := f.Readdir(count)
+	if err == io.EOF {
+		return nil, nil
+	}
+	return infos, err
 }
 
-// SQLiteFs implements ftpserver.ClientDriver (which embeds afero.Fs)
+// isAnonymous reports whether user is one of the conventional anonymous FTP logins.
+func isAnonymous(user string) bool {
+	return strings.EqualFold(user, "anonymous") || strings.EqualFold(user, "ftp")
+}
+
+// SQLiteFs implements ftpserver.ClientDriver (which embeds afero.Fs).
+// Every client path is resolved below root, so a session bound to a home
+// directory can never reach rows outside of it.
 type SQLiteFs struct {
-	db *sql.DB
+	db     *sql.DB
+	driver *MainDriver
+	root   string
+	cc     ftpserver.ClientContext // nil for server-internal views
+	user   identity
+}
+
+// resolve maps a client path onto the database path below the session root.
+// normalizePath cleans away any ".." before the join, so the result always
+// stays inside root.
+func (fs *SQLiteFs) resolve(name string) string {
+	name = normalizePath(name)
+	if fs.root == "" || fs.root == "/" {
+		return name
+	}
+	if name == "/" {
+		return fs.root
+	}
+	return fs.root + name
 }
 
 func (fs *SQLiteFs) Create(name string) (afero.File, error) {
 	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 }
 
-func (fs *SQLiteFs) Mkdir(name string, perm os.FileMode) error {
-	name = normalizePath(name)
-	if name == "/" {
+func (fs *SQLiteFs) Mkdir(name string, perm os.FileMode) (err error) {
+	defer observe("mkdir", time.Now(), &err)
+	if _, ok := versionsPath(name); ok {
+		return os.ErrPermission
+	}
+	name = fs.resolve(name)
+	if name == fs.root {
 		return os.ErrInvalid
 	}
+	if fs.inTrash(name) {
+		return os.ErrPermission
+	}
 
 	parentPath := filepath.Dir(name)
 	baseName := filepath.Base(name)
 
 	// Check parent
+	parent, err := fs.walk(fs.db, parentPath, true)
+	if err != nil {
+		return err
+	}
 	var parentIsDir bool
-	err := fs.db.QueryRow("SELECT is_dir FROM files WHERE path = ?", parentPath).Scan(&parentIsDir)
-	if err == sql.ErrNoRows {
-		return os.ErrNotExist
-	} else if err != nil {
+	if err := fs.db.QueryRow("SELECT is_dir FROM files WHERE id = ?", parent.id).Scan(&parentIsDir); err != nil {
 		return err
 	}
 	if !parentIsDir {
 		return os.ErrExist // Parent is a file
 	}
 
-	// Check existence
-	var count int
-	err = fs.db.QueryRow("SELECT COUNT(*) FROM files WHERE path = ?", name).Scan(&count)
+	if err := fs.checkAccess(parent.path, permWrite|permExec); err != nil {
+		return err
+	}
+
+	// The unique (parent_id, name) index makes the existence check atomic
+	res, err := fs.db.Exec(`
+		INSERT OR IGNORE INTO files (parent_id, name, is_dir, size, mod_time, create_time, uid, gid, mode)
+		VALUES (?1, ?2, 1, 0, ?3, ?3, ?4, ?5, ?6)
+	`, parent.id, baseName, time.Now().UnixNano(), fs.user.uid, fs.user.gid, fs.newMode(perm, true))
 	if err != nil {
 		return err
 	}
-	if count > 0 {
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
 		return os.ErrExist
 	}
-
-	_, err = fs.db.Exec(`
-		INSERT INTO files (path, parent_path, name, is_dir, size, mod_time)
-		VALUES (?, ?, ?, 1, 0, ?)
-	`, name, parentPath, baseName, time.Now().Format(time.RFC3339))
-	return err
+	return nil
 }
 
 func (fs *SQLiteFs) MkdirAll(path string, perm os.FileMode) error {
@@ -144,106 +337,163 @@ func (fs *SQLiteFs) Open(name string) (afero.File, error) {
 	return fs.OpenFile(name, os.O_RDONLY, 0)
 }
 
-func (fs *SQLiteFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
-	name = normalizePath(name)
+func (fs *SQLiteFs) OpenFile(name string, flag int, perm os.FileMode) (_ afero.File, err error) {
+	defer observe("open", time.Now(), &err)
+	if err := fs.checkTransferTLS(); err != nil {
+		return nil, err
+	}
+	if _, ok := versionsPath(name); ok {
+		if flag&os.O_CREATE != 0 || accessFor(flag, false)&permWrite != 0 {
+			return nil, os.ErrPermission
+		}
+		return fs.openVersion(name)
+	}
+	name = fs.resolve(name)
+	if fs.inTrash(name) && (flag&os.O_CREATE != 0 || accessFor(flag, false)&permWrite != 0) {
+		return nil, os.ErrPermission
+	}
 
 	var fileInfo FileInfo
-	var modTimeStr string
-	var content []byte
-
-	row := fs.db.QueryRow(`
-		SELECT name, size, is_dir, mod_time, path, content
-		FROM files
-		WHERE path = ?
-	`, name)
-
-	err := row.Scan(&fileInfo.name, &fileInfo.size, &fileInfo.isDir, &modTimeStr, &fileInfo.path, &content)
+	var modTime int64
+	var blobHash string
+
+	// Symbolic links are followed, and hard links lead to their shared body
+	e, err := fs.walk(fs.db, name, true)
+	id := e.body
+	if err == nil {
+		err = fs.db.QueryRow(`
+			SELECT size, is_dir, COALESCE(mod_time, 0), uid, gid, mode, COALESCE(blob_hash, '')
+			FROM files
+			WHERE id = ?
+		`, id).Scan(&fileInfo.size, &fileInfo.isDir, &modTime,
+			&fileInfo.uid, &fileInfo.gid, &fileInfo.mode, &blobHash)
+		if err == sql.ErrNoRows {
+			err = os.ErrNotExist
+		}
+	}
 
 	// Handle creation
-	if err == sql.ErrNoRows {
+	if err == os.ErrNotExist {
 		if flag&os.O_CREATE != 0 {
+			// A dangling symbolic link creates its target
+			if fs.inTrash(e.path) {
+				return nil, os.ErrPermission
+			}
+			name = e.path
 			parentPath := filepath.Dir(name)
 			baseName := filepath.Base(name)
 
 			// Check parent exists
+			parent, err := fs.walk(fs.db, parentPath, true)
+			if err != nil {
+				return nil, os.ErrNotExist
+			}
 			var parentIsDir bool
-			err := fs.db.QueryRow("SELECT is_dir FROM files WHERE path = ?", parentPath).Scan(&parentIsDir)
+			err = fs.db.QueryRow("SELECT is_dir FROM files WHERE id = ?", parent.id).Scan(&parentIsDir)
 			if err != nil {
 				return nil, os.ErrNotExist
 			}
 			if !parentIsDir {
 				return nil, os.ErrNotExist
 			}
+			if err := fs.checkAccess(parent.path, permWrite|permExec); err != nil {
+				return nil, err
+			}
 
 			// Insert empty file placeholder
 			now := time.Now()
-			_, err = fs.db.Exec(`
-				INSERT INTO files (path, parent_path, name, is_dir, size, mod_time, content)
-				VALUES (?, ?, ?, 0, 0, ?, NULL)
-			`, name, parentPath, baseName, now.Format(time.RFC3339))
+			res, err := fs.db.Exec(`
+				INSERT INTO files (parent_id, name, is_dir, size, mod_time, create_time, uid, gid, mode)
+				VALUES (?1, ?2, 0, 0, ?3, ?3, ?4, ?5, ?6)
+			`, parent.id, baseName, now.UnixNano(), fs.user.uid, fs.user.gid, fs.newMode(perm, false))
+			if err != nil {
+				return nil, err
+			}
+			id, err = res.LastInsertId()
 			if err != nil {
 				return nil, err
 			}
 
-			return &SqliteFile{
-				path:    name,
-				fs:      fs,
-				content: []byte{},
-				flag:    flag,
-				modTime: now,
-			}, nil
+			f := newSqliteFile(fs, id, name, 0, flag, now)
+			f.created = true
+			return f, nil
 		}
 		return nil, os.ErrNotExist
 	} else if err != nil {
 		return nil, err
 	}
 
+	if !fs.user.allowed(fileInfo.uid, fileInfo.gid, fileInfo.mode, accessFor(flag, fileInfo.isDir)) {
+		return nil, os.ErrPermission
+	}
+
 	if fileInfo.isDir {
-		t, _ := time.Parse(time.RFC3339, modTimeStr)
 		return &SqliteFile{
 			path:    name,
 			fs:      fs,
+			id:      id,
 			isDir:   true,
-			modTime: t,
+			modTime: unixTime(modTime),
 		}, nil
 	}
 
 	// Existing file
-	t, err := time.Parse(time.RFC3339, modTimeStr)
-	if err != nil {
-		t, _ = time.Parse("2006-01-02 15:04:05", modTimeStr)
-	}
-
-	f := &SqliteFile{
-		path:    name,
-		fs:      fs,
-		flag:    flag,
-		modTime: t,
-	}
+	f := newSqliteFile(fs, id, name, fileInfo.size, flag, unixTime(modTime))
+	f.blobHash = blobHash
 
 	// Handle flags
-	if flag&os.O_TRUNC != 0 {
-		f.content = []byte{}
-	} else {
-		f.content = content
+	if flag&os.O_TRUNC != 0 && f.writable() {
+		if err := f.Truncate(0); err != nil {
+			return nil, err
+		}
 	}
 
 	if flag&os.O_APPEND != 0 {
-		f.pos = int64(len(f.content))
+		f.pos = f.size
 	}
 
 	return f, nil
 }
 
-func (fs *SQLiteFs) Remove(name string) error {
-	name = normalizePath(name)
-	if name == "/" {
+// accessFor returns the permission bits needed to open a file with flag.
+// Opening a directory means listing it, which needs read access.
+func accessFor(flag int, isDir bool) uint32 {
+	if isDir {
+		return permRead
+	}
+	var want uint32
+	accMode := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	if accMode != os.O_WRONLY {
+		want |= permRead
+	}
+	if accMode != os.O_RDONLY || flag&(os.O_APPEND|os.O_TRUNC) != 0 {
+		want |= permWrite
+	}
+	return want
+}
+
+func (fs *SQLiteFs) Remove(name string) (err error) {
+	defer observe("remove", time.Now(), &err)
+	if _, ok := versionsPath(name); ok {
+		return os.ErrPermission
+	}
+	name = fs.resolve(name)
+	if name == fs.root {
 		return os.ErrInvalid
 	}
+	if fs.isTrashDir(name) {
+		return os.ErrPermission
+	}
 
-	// Check if directory is empty
+	// Check if directory is empty. A link is removed itself, never what
+	// it points to
+	e, err := fs.walk(fs.db, name, false)
+	if err != nil {
+		return err
+	}
+	id := e.id
 	var isDir bool
-	err := fs.db.QueryRow("SELECT is_dir FROM files WHERE path = ?", name).Scan(&isDir)
+	err = fs.db.QueryRow("SELECT is_dir FROM files WHERE id = ?", id).Scan(&isDir)
 	if err == sql.ErrNoRows {
 		return os.ErrNotExist
 	} else if err != nil {
@@ -252,7 +502,7 @@ func (fs *SQLiteFs) Remove(name string) error {
 
 	if isDir {
 		var count int
-		err := fs.db.QueryRow("SELECT COUNT(*) FROM files WHERE parent_path = ?", name).Scan(&count)
+		err := fs.db.QueryRow("SELECT COUNT(*) FROM files WHERE parent_id = ?", id).Scan(&count)
 		if err != nil {
 			return err
 		}
@@ -262,34 +512,133 @@ func (fs *SQLiteFs) Remove(name string) error {
 		}
 	}
 
-	_, err = fs.db.Exec("DELETE FROM files WHERE path = ?", name)
+	if err := fs.checkAccess(filepath.Dir(name), permWrite|permExec); err != nil {
+		return err
+	}
+	if isDir {
+		// The cache holds paths with links resolved
+		release := fs.driver.paths.Hold(e.path)
+		defer release()
+	}
+
+	// Entries already in the trash are deleted for good
+	if fs.trashEnabled() && !fs.inTrash(name) {
+		tx, err := fs.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := fs.moveToTrash(tx, name); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	_, err = fs.db.Exec("DELETE FROM files WHERE id = ?", id)
 	return err
 }
 
-func (fs *SQLiteFs) RemoveAll(path string) error {
-	return fs.Remove(path)
-}
+// RemoveAll removes a file or directory together with everything below it.
+// Like os.RemoveAll it succeeds if the path does not exist. With the trash
+// enabled the whole subtree is moved to the trash as one entry.
+func (fs *SQLiteFs) RemoveAll(name string) (err error) {
+	defer observe("remove_all", time.Now(), &err)
+	if _, ok := versionsPath(name); ok {
+		return os.ErrPermission
+	}
+	name = fs.resolve(name)
+	if name == fs.root {
+		return os.ErrInvalid
+	}
+	if fs.isTrashDir(name) {
+		return os.ErrPermission
+	}
 
-func (fs *SQLiteFs) Rename(oldname, newname string) error {
-	oldname = normalizePath(oldname)
-	newname = normalizePath(newname)
+	tx, err := fs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	if oldname == "/" || newname == "/" {
-		return os.ErrInvalid
+	e, err := fs.walk(tx, name, false)
+	if err == os.ErrNotExist {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	id := e.id
+	var isDir bool
+	if err := tx.QueryRow("SELECT is_dir FROM files WHERE id = ?", id).Scan(&isDir); err != nil {
+		return err
+	}
+	if err := fs.checkAccessIn(tx, filepath.Dir(name), permWrite|permExec); err != nil {
+		return err
 	}
 
-	// Check old exists
-	var oldIsDir bool
-	err := fs.db.QueryRow("SELECT is_dir FROM files WHERE path = ?", oldname).Scan(&oldIsDir)
-	if err == sql.ErrNoRows {
-		return os.ErrNotExist
+	// Emptying a directory needs write access to it, all the way down
+	if isDir && !fs.user.system {
+		rows, err := tx.Query(db.Subtree+" SELECT uid, gid, mode FROM files WHERE is_dir = 1 AND id IN (SELECT id FROM subtree)", id)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var uid, gid int64
+			var mode uint32
+			if err := rows.Scan(&uid, &gid, &mode); err != nil {
+				rows.Close()
+				return err
+			}
+			if !fs.user.allowed(uid, gid, mode, permWrite|permExec) {
+				rows.Close()
+				return os.ErrPermission
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
 	}
 
-	// Check new does not exist
-	var count int
-	fs.db.QueryRow("SELECT COUNT(*) FROM files WHERE path = ?", newname).Scan(&count)
-	if count > 0 {
-		return os.ErrExist
+	if isDir {
+		release := fs.driver.paths.Hold(e.path)
+		defer release()
+	}
+	if fs.trashEnabled() && !fs.inTrash(name) {
+		err = fs.moveToTrash(tx, name)
+	} else {
+		_, err = tx.Exec(db.Subtree+" DELETE FROM files WHERE id IN (SELECT id FROM subtree)", id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove %s: %w", name, err)
+	}
+	return tx.Commit()
+}
+
+// Rename moves oldname to newname, with its whole subtree for directories,
+// by updating the parent and name of a single row. An existing file at
+// newname is replaced by a file, going to the trash when it is enabled;
+// directories are never replaced, and a directory cannot be moved below
+// itself.
+func (fs *SQLiteFs) Rename(oldname, newname string) (err error) {
+	defer observe("rename", time.Now(), &err)
+	_, oldVersioned := versionsPath(oldname)
+	_, newVersioned := versionsPath(newname)
+	if oldVersioned || newVersioned {
+		return os.ErrPermission
+	}
+	oldname = fs.resolve(oldname)
+	newname = fs.resolve(newname)
+
+	if oldname == fs.root || newname == fs.root {
+		return os.ErrInvalid
+	}
+	// A directory cannot become its own descendant
+	if strings.HasPrefix(newname, oldname+"/") {
+		return os.ErrInvalid
+	}
+	// Entries can be renamed out of the trash to restore them, but only
+	// deletion puts them in. Those of other users are out of reach, see walk
+	if fs.isTrashDir(oldname) || fs.isTrashDir(newname) || fs.inTrash(newname) {
+		return os.ErrPermission
 	}
 
 	tx, err := fs.db.Begin()
@@ -298,44 +647,115 @@ func (fs *SQLiteFs) Rename(oldname, newname string) error {
 	}
 	defer tx.Rollback()
 
-	newParent := filepath.Dir(newname)
-	newNameBase := filepath.Base(newname)
+	// The source is resolved, so that checks below see where it really is
+	src, err := fs.walk(tx, oldname, false)
+	if err != nil {
+		return err
+	}
+	id := src.id
+	var oldIsDir bool
+	if err := tx.QueryRow("SELECT is_dir FROM files WHERE id = ?", id).Scan(&oldIsDir); err != nil {
+		return err
+	}
+	if newname == oldname {
+		return nil
+	}
 
-	_, err = tx.Exec("UPDATE files SET path = ?, parent_path = ?, name = ? WHERE path = ?", newname, newParent, newNameBase, oldname)
+	newParent := filepath.Dir(newname)
+	parent, err := fs.walk(tx, newParent, true)
 	if err != nil {
 		return err
 	}
+	parentID := parent.id
+	var parentIsDir bool
+	if err := tx.QueryRow("SELECT is_dir FROM files WHERE id = ?", parentID).Scan(&parentIsDir); err != nil {
+		return err
+	}
+	if !parentIsDir {
+		return os.ErrNotExist
+	}
+	// Links may lead the new parent back below the directory being moved
+	if oldIsDir && strings.HasPrefix(parent.path+"/", src.path+"/") {
+		return os.ErrInvalid
+	}
 
-	// Update children if dir
-	if oldIsDir {
-		_, err = tx.Exec("UPDATE files SET parent_path = ? WHERE parent_path = ?", newname, oldname)
-		if err != nil {
+	var targetID int64
+	var targetIsDir bool
+	err = tx.QueryRow("SELECT id, is_dir FROM files WHERE parent_id = ? AND name = ?", parentID, filepath.Base(newname)).
+		Scan(&targetID, &targetIsDir)
+	targetExists := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if targetExists && (targetIsDir || oldIsDir) {
+		return os.ErrExist
+	}
+
+	for _, dir := range []string{filepath.Dir(oldname), parent.path} {
+		if err := fs.checkAccessIn(tx, dir, permWrite|permExec); err != nil {
 			return err
 		}
-		// Shallow path update for children
-		_, err = tx.Exec("UPDATE files SET path = ? || SUBSTR(path, LENGTH(?)+1) WHERE path LIKE ? || '/%'", newname, oldname, oldname)
+	}
+
+	if targetExists {
+		if fs.trashEnabled() {
+			err = fs.moveToTrash(tx, newname)
+		} else {
+			_, err = tx.Exec("DELETE FROM files WHERE id = ?", targetID)
+		}
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to replace %s: %w", newname, err)
 		}
 	}
 
+	if oldIsDir {
+		release := fs.driver.paths.Hold(src.path)
+		defer release()
+	}
+	if err := db.Move(tx, id, parentID, filepath.Base(newname)); errors.Is(err, db.ErrCycle) {
+		return os.ErrInvalid
+	} else if err != nil {
+		return err
+	}
+	// A moved entry is no longer where it was deleted from
+	if _, err := tx.Exec("UPDATE files SET deleted_at = NULL, original_path = NULL WHERE id = ?", id); err != nil {
+		return err
+	}
+
 	return tx.Commit()
 }
 
 func (fs *SQLiteFs) Stat(name string) (os.FileInfo, error) {
-	name = normalizePath(name)
-
-	var fileInfo FileInfo
-	var modTimeStr string
-
-	row := fs.db.QueryRow(`
-		SELECT name, size, is_dir, mod_time, path
-		FROM files
-		WHERE path = ?
-	`, name)
+	if _, ok := versionsPath(name); ok {
+		f, err := fs.openVersion(name)
+		if err != nil {
+			return nil, err
+		}
+		return f.info, nil
+	}
+	return fs.stat(fs.resolve(name), true)
+}
 
-	err := row.Scan(&fileInfo.name, &fileInfo.size, &fileInfo.isDir, &modTimeStr, &fileInfo.path)
-	if err == sql.ErrNoRows {
+// stat looks up a file by its resolved path in the database, following a
+// symbolic link in its last element if follow is set.
+func (fs *SQLiteFs) stat(name string, follow bool) (_ os.FileInfo, err error) {
+	defer observe("stat", time.Now(), &err)
+
+	fileInfo := FileInfo{name: path.Base(name), path: name}
+	var modTime, createTime int64
+
+	e, err := fs.walk(fs.db, name, follow)
+	if err == nil {
+		err = fs.db.QueryRow(`
+			SELECT size, is_dir, COALESCE(mod_time, 0), COALESCE(create_time, 0), uid, gid, mode, COALESCE(blob_hash, '')
+			FROM files
+			WHERE id = ?
+		`, e.body).Scan(&fileInfo.size, &fileInfo.isDir, &modTime, &createTime,
+			&fileInfo.uid, &fileInfo.gid, &fileInfo.mode, &fileInfo.sha256)
+		fileInfo.target = e.target
+		fileInfo.id = e.body
+	}
+	if err == sql.ErrNoRows || err == os.ErrNotExist {
 		vfsLogger.Debug("SQLiteFs.Stat: file not found", "path", name)
 		return nil, os.ErrNotExist
 	} else if err != nil {
@@ -343,13 +763,10 @@ func (fs *SQLiteFs) Stat(name string) (os.FileInfo, error) {
 		return nil, err
 	}
 
-	vfsLogger.Debug("SQLiteFs.Stat: raw modTimeStr", "path", name, "modTimeStr", modTimeStr)
-	fileInfo.modTime, _ = time.Parse(time.RFC3339, modTimeStr)
-	if fileInfo.modTime.IsZero() {
-		vfsLogger.Debug("SQLiteFs.Stat: RFC3339 parse failed, trying YYYY-MM-DD HH:MM:SS", "path", name, "modTimeStr", modTimeStr)
-		fileInfo.modTime, _ = time.Parse("2006-01-02 15:04:05", modTimeStr)
-	}
-	vfsLogger.Debug("SQLiteFs.Stat: parsed modTime", "path", name, "modTime", fileInfo.modTime)
+	fileInfo.modTime = unixTime(modTime)
+	fileInfo.createTime = unixTime(createTime)
+	inWritable := name != fs.root && fs.writableDir(path.Dir(name))
+	fileInfo.perm = fs.permFact(name, fileInfo.isDir, fileInfo.uid, fileInfo.gid, fileInfo.mode, inWritable)
 
 	return &fileInfo, nil
 }
@@ -358,73 +775,360 @@ func (fs *SQLiteFs) Name() string {
 	return "sqlite-vfs"
 }
 
-func (fs *SQLiteFs) Chmod(name string, mode os.FileMode) error {
-	return nil // No-op
+// Chtimes sets the modification time, as for MFMT. Only the modification
+// time is stored; atime is ignored.
+func (fs *SQLiteFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return fs.setTime(name, "mod_time", mtime)
 }
 
-func (fs *SQLiteFs) Chown(name string, uid, gid int) error {
-	return nil // No-op
+// SetCreateTime implements ftpserver.ClientDriverExtensionCreateTime, setting
+// the creation time for MFCT.
+func (fs *SQLiteFs) SetCreateTime(name string, ctime time.Time) error {
+	return fs.setTime(name, "create_time", ctime)
 }
 
-func (fs *SQLiteFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
-	name = normalizePath(name)
-	_, err := fs.db.Exec("UPDATE files SET mod_time = ? WHERE path = ?", mtime, name)
+// setTime stores t in the timestamp column of the entry, which its owner or
+// anyone allowed to write to it may change.
+func (fs *SQLiteFs) setTime(name, column string, t time.Time) (err error) {
+	defer observe("set_time", time.Now(), &err)
+	if _, ok := versionsPath(name); ok {
+		return os.ErrPermission
+	}
+	name = fs.resolve(name)
+	id, err := fs.checkOwner(name)
+	if err != nil {
+		if err := fs.checkAccess(name, permWrite); err != nil {
+			return err
+		}
+		e, err := fs.walk(fs.db, name, true)
+		if err != nil {
+			return err
+		}
+		id = e.body
+	}
+	_, err = fs.db.Exec(fmt.Sprintf("UPDATE files SET %s = ? WHERE id = ?", column), t.UnixNano(), id)
 	return err
 }
 
-// SqliteFile implements afero.File
+// SqliteFile implements afero.File. File content is read and written one
+// chunk at a time, so at most db.ChunkSize bytes of a file are held in memory
+// regardless of its total size. Writes go to a staged upload that replaces
+// the stored content only when the file is closed successfully.
 type SqliteFile struct {
-	path    string
-	fs      *SQLiteFs
-	content []byte
-	pos     int64
-	flag    int
-	isDir   bool
-	modTime time.Time
+	path       string
+	fs         *SQLiteFs
+	id         int64
+	size       int64
+	storedSize int64 // size currently recorded in the files row
+	pos        int64
+	flag       int
+	isDir      bool
+	modTime    time.Time
+	deleted    bool  // set when the backing row was removed while the file was open
+	created    bool  // the row was created by this handle
+	failure    error // set once the upload failed; it is discarded instead of committed
+	opened     time.Time
+	transfer   string // "upload" or "download" once content moves through the handle, for metrics
+
+	chunk      []byte // cached content of chunk chunkIndex
+	chunkIndex int64  // -1 when no chunk is cached
+	chunkDirty bool   // chunk holds writes not yet flushed to upload_chunks
+	upload     int64  // staged upload receiving writes, 0 until the first modification
+	resumable  bool   // the upload keeps all stored content, so a partial transfer is worth keeping
+	blobHash   string // blob holding the stored content, "" for empty or legacy files
+
+	// Directory listing position
+	dirCursor string // name of the last entry returned by Readdir
+	dirOffset int    // entries of a versions directory returned by Readdir
+
+	// Entries of the read-only versions tree
+	versionID int64     // revision whose content is read, 0 for live files
+	mirror    string    // resolved path whose history a versions directory lists
+	info      *FileInfo // fixed Stat result
+}
+
+func newSqliteFile(fs *SQLiteFs, id int64, path string, size int64, flag int, modTime time.Time) *SqliteFile {
+	f := &SqliteFile{
+		path:       path,
+		fs:         fs,
+		id:         id,
+		size:       size,
+		storedSize: size,
+		flag:       flag,
+		modTime:    modTime,
+		chunkIndex: -1,
+		opened:     time.Now(),
+	}
+	if f.writable() {
+		f.transfer = "upload"
+	}
+	return f
+}
+
+func (f *SqliteFile) writable() bool {
+	return f.flag&os.O_WRONLY != 0 || f.flag&os.O_RDWR != 0 || f.flag&os.O_APPEND != 0 || f.flag&os.O_CREATE != 0
+}
+
+// loadChunk makes chunk idx the cached chunk, flushing any pending writes to
+// the previously cached one. Missing chunks (holes) load as empty.
+func (f *SqliteFile) loadChunk(idx int64) (err error) {
+	if f.chunkIndex == idx {
+		return nil
+	}
+	if err := f.flushChunk(); err != nil {
+		return err
+	}
+	defer observe("read_chunk", time.Now(), &err)
+
+	var data []byte
+	switch {
+	case f.upload != 0:
+		err = f.fs.db.QueryRow("SELECT data FROM upload_chunks WHERE upload_id = ? AND chunk_index = ?", f.upload, idx).Scan(&data)
+	case f.blobHash != "":
+		data, err = db.ReadBlobChunk(f.fs.db, f.fs.driver.encoding.Keys, f.blobHash, idx)
+	case f.versionID != 0:
+		err = f.fs.db.QueryRow("SELECT data FROM version_chunks WHERE version_id = ? AND chunk_index = ?", f.versionID, idx).Scan(&data)
+	default:
+		err = f.fs.db.QueryRow("SELECT data FROM file_chunks WHERE file_id = ? AND chunk_index = ?", f.id, idx).Scan(&data)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to load chunk %d of %s: %w", idx, f.path, err)
+	}
+
+	// Never expose stored bytes past the logical end of the file
+	limit := f.size - idx*db.ChunkSize
+	if limit < 0 {
+		limit = 0
+	}
+	if int64(len(data)) > limit {
+		data = data[:limit]
+	}
+
+	f.chunk = data
+	f.chunkIndex = idx
+	f.chunkDirty = false
+	return nil
+}
+
+// flushChunk writes the cached chunk to the upload if it was modified.
+func (f *SqliteFile) flushChunk() (err error) {
+	if !f.chunkDirty {
+		return nil
+	}
+	defer observe("write_chunk", time.Now(), &err)
+	_, err = f.fs.db.Exec(`
+		INSERT OR REPLACE INTO upload_chunks (upload_id, chunk_index, data)
+		VALUES (?, ?, ?)
+	`, f.upload, f.chunkIndex, f.chunk)
+	if err != nil {
+		return fmt.Errorf("failed to store chunk %d of %s: %w", f.chunkIndex, f.path, err)
+	}
+	f.chunkDirty = false
+	return nil
 }
 
 func (f *SqliteFile) Close() error {
-	if f.isDir {
+	err := f.close()
+	f.recordTransfer(err)
+	return err
+}
+
+// close commits the content written through f, if any.
+func (f *SqliteFile) close() (err error) {
+	if f.isDir || f.deleted || f.upload == 0 {
+		return nil
+	}
+	defer observe("commit_upload", time.Now(), &err)
+	// A broken transfer that only added to the stored content is kept, so
+	// the client can resume it with REST instead of starting over
+	if f.failure != nil && (!f.resumable || errors.Is(f.failure, ftpserver.ErrStorageExceeded)) {
+		vfsLogger.Debug("SqliteFile.Close: discarding failed upload", "path", f.path, "error", f.failure)
+		f.abort()
+		return nil
+	}
+	vfsLogger.Debug("SqliteFile.Close called (writing)", "path", f.path, "size", f.size)
+	if err := f.flushChunk(); err != nil {
+		vfsLogger.Error("Failed to flush file chunk on close", "path", f.path, "error", err)
+		f.abort()
+		return err
+	}
+	f.chunk = nil
+	f.chunkIndex = -1
+
+	d := f.fs.driver
+	hash, err := db.CommitUpload(f.fs.db, f.upload, db.CommitOptions{
+		Size:          f.size,
+		ModTime:       time.Now(),
+		Quota:         d.storageQuota.Load(),
+		MaxVersions:   d.maxVersions,
+		VersionMaxAge: d.versionMaxAge,
+		Encoding:      d.encoding,
+	})
+	switch {
+	case errors.Is(err, db.ErrUploadGone):
+		// The row was removed while we were writing, taking the upload with it
+		vfsLogger.Debug("SqliteFile.Close: file was deleted during upload", "path", f.path)
+		f.deleted = true
+		f.upload = 0
+		return nil
+	case errors.Is(err, db.ErrQuotaExceeded):
+		return f.reject("storage quota exceeded on close")
+	case err != nil:
+		vfsLogger.Error("Failed to commit file content on close", "path", f.path, "error", err)
+		f.abort()
+		return fmt.Errorf("failed to update file %s: %w", f.path, err)
+	}
+
+	f.upload = 0
+	f.storedSize = f.size
+	f.blobHash = hash
+	vfsLogger.Debug("SqliteFile.Close success", "path", f.path, "size", f.size)
+	return nil
+}
+
+// TransferError implements ftpserver.FileTransferError. An upload whose
+// transfer failed is discarded on Close rather than replacing the file,
+// unless it is resumable, in which case the data received so far is stored.
+func (f *SqliteFile) TransferError(err error) {
+	if f.failure == nil {
+		f.failure = err
+	}
+}
+
+// beginUpload starts staging the content before the first modification,
+// seeded with the first keep bytes of the stored content.
+func (f *SqliteFile) beginUpload(keep int64) (err error) {
+	if f.upload != 0 {
 		return nil
 	}
-	if f.flag&os.O_WRONLY != 0 || f.flag&os.O_RDWR != 0 || f.flag&os.O_APPEND != 0 || f.flag&os.O_CREATE != 0 {
-		vfsLogger.Debug("SqliteFile.Close called (writing)", "path", f.path, "len_content_before_update", len(f.content))
-		res, err := f.fs.db.Exec("UPDATE files SET content = ?, size = ?, mod_time = ? WHERE path = ?", f.content, len(f.content), time.Now(), f.path)
+	defer observe("begin_upload", time.Now(), &err)
+	id, err := db.BeginUpload(f.fs.db, f.fs.driver.encoding.Keys, f.id, keep)
+	if errors.Is(err, db.ErrUploadGone) {
+		f.deleted = true
+		return os.ErrNotExist
+	} else if err != nil {
+		return err
+	}
+	f.upload = id
+	f.resumable = keep >= f.storedSize
+	f.chunk = nil
+	f.chunkIndex = -1
+	return nil
+}
+
+// abort discards the upload, leaving the stored content as it was. A row
+// created by this handle is removed again.
+func (f *SqliteFile) abort() {
+	if f.upload != 0 {
+		if err := db.DiscardUpload(f.fs.db, f.upload); err != nil {
+			vfsLogger.Error("Failed to discard upload", "path", f.path, "error", err)
+		}
+		f.upload = 0
+	}
+	if f.created {
+		_, err := f.fs.db.Exec("DELETE FROM files WHERE id = ? AND size = 0 AND blob_hash IS NULL", f.id)
 		if err != nil {
-			vfsLogger.Error("Failed to update file content on close", "path", f.path, "error", err)
-			return fmt.Errorf("failed to update file %s: %w", f.path, err)
+			vfsLogger.Error("Failed to remove rejected file", "path", f.path, "error", err)
 		}
-		rows, _ := res.RowsAffected()
-		if rows == 0 {
-			vfsLogger.Debug("SqliteFile.Close: no rows updated (file likely deleted or missing)", "path", f.path)
-		} else {
-			vfsLogger.Debug("SqliteFile.Close success", "path", f.path, "size", len(f.content))
+		f.deleted = true
+	}
+	f.size = f.storedSize
+	f.chunk = nil
+	f.chunkIndex = -1
+	f.chunkDirty = false
+}
+
+// reject discards an upload that broke a storage limit and returns
+// ftpserver.ErrStorageExceeded so the client receives a 552 reply. The file
+// keeps its previous content.
+func (f *SqliteFile) reject(reason string) error {
+	vfsLogger.Warn("SqliteFile: storage limit exceeded, discarding upload", "path", f.path, "reason", reason, "size", f.size)
+	f.failure = ftpserver.ErrStorageExceeded
+	f.abort()
+	return ftpserver.ErrStorageExceeded
+}
+
+// quotaExceeded reports whether growing the file to newSize would take total
+// storage past the configured quota. With versioning on, the content being
+// replaced stays stored as a revision, so only the revisions pruned to make
+// room for it are subtracted. CommitUpload checks the real usage again.
+func (f *SqliteFile) quotaExceeded(newSize int64) (_ bool, err error) {
+	quota := f.fs.driver.storageQuota.Load()
+	if quota <= 0 || newSize <= f.size {
+		return false, nil
+	}
+	defer observe("quota_check", time.Now(), &err)
+	used, err := db.UsedBytes(f.fs.db)
+	if err != nil {
+		return false, err
+	}
+	d := f.fs.driver
+	replaced := f.storedSize
+	if d.maxVersions > 0 {
+		replaced, err = db.PrunedBytes(f.fs.db, f.id, d.maxVersions, d.versionMaxAge)
+		if err != nil {
+			return false, err
 		}
-		return nil
 	}
-	return nil
+	return used+newSize-replaced > quota, nil
+}
+
+// readAt copies file content starting at off into p, crossing at most one
+// chunk boundary per call. Holes left by sparse writes read as zeros.
+func (f *SqliteFile) readAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	idx := off / db.ChunkSize
+	if err := f.loadChunk(idx); err != nil {
+		return 0, err
+	}
+
+	chunkOff := off - idx*db.ChunkSize
+	want := int64(len(p))
+	if rem := db.ChunkSize - chunkOff; want > rem {
+		want = rem
+	}
+	if rem := f.size - off; want > rem {
+		want = rem
+	}
+
+	var n int64
+	if chunkOff < int64(len(f.chunk)) {
+		n = int64(copy(p[:want], f.chunk[chunkOff:]))
+	}
+	clear(p[n:want])
+	return int(want), nil
 }
 
 func (f *SqliteFile) Read(p []byte) (n int, err error) {
 	if f.isDir {
 		return 0, os.ErrInvalid
 	}
-	if f.pos >= int64(len(f.content)) {
-		return 0, io.EOF
+	if f.transfer == "" {
+		f.transfer = "download"
+	}
+	if len(p) == 0 {
+		return 0, nil
 	}
-	n = copy(p, f.content[f.pos:])
+	n, err = f.readAt(p, f.pos)
 	f.pos += int64(n)
-	return n, nil
+	bytesDownloaded.Add(float64(n))
+	return n, err
 }
 
 func (f *SqliteFile) ReadAt(p []byte, off int64) (n int, err error) {
 	if f.isDir {
 		return 0, os.ErrInvalid
 	}
-	if off >= int64(len(f.content)) {
-		return 0, io.EOF
+	for n < len(p) {
+		var m int
+		m, err = f.readAt(p[n:], off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
 	}
-	n = copy(p, f.content[off:])
 	return n, nil
 }
 
@@ -436,7 +1140,7 @@ func (f *SqliteFile) Seek(offset int64, whence int) (int64, error) {
 	case io.SeekCurrent:
 		abs = f.pos + offset
 	case io.SeekEnd:
-		abs = int64(len(f.content)) + offset
+		abs = f.size + offset
 	default:
 		return 0, errors.New("invalid whence")
 	}
@@ -448,47 +1152,144 @@ func (f *SqliteFile) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (f *SqliteFile) Write(p []byte) (n int, err error) {
+	n, err = f.writeAt(p, f.pos)
+	f.pos += int64(n)
+	bytesUploaded.Add(float64(n))
+	return n, err
+}
+
+// WriteAt writes p at offset off without moving the file position.
+func (f *SqliteFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if f.flag&os.O_APPEND != 0 {
+		return 0, errors.New("WriteAt on a file opened with O_APPEND")
+	}
+	return f.writeAt(p, off)
+}
+
+// writeAt writes p at offset off, growing the file as needed.
+func (f *SqliteFile) writeAt(p []byte, off int64) (n int, err error) {
 	if f.isDir {
 		return 0, os.ErrInvalid
 	}
 
-	if int64(len(f.content))+int64(len(p)) > MaxFileSize {
-		vfsLogger.Warn("SqliteFile.Write: write would exceed MaxFileSize, deleting file", "path", f.path, "current_len", len(f.content), "write_len", len(p), "max_size", MaxFileSize)
-		_, deleteErr := f.fs.db.Exec("DELETE FROM files WHERE path = ?", f.path)
-		if deleteErr != nil {
-			vfsLogger.Error("Failed to delete oversized file on write", "path", f.path, "error", deleteErr)
-		}
-		return 0, ftpserver.ErrStorageExceeded
+	if f.deleted {
+		return 0, os.ErrNotExist
+	}
+	if f.versionID != 0 {
+		return 0, os.ErrPermission
+	}
+	if f.failure != nil {
+		return 0, f.failure
+	}
+	if err := f.beginUpload(f.size); err != nil {
+		return 0, err
 	}
 
-	if f.pos >= int64(len(f.content)) {
-		f.content = append(f.content, p...)
-		n = len(p)
-		f.pos += int64(n)
-	} else {
-		n = copy(f.content[f.pos:], p)
-		if n < len(p) { // If p is larger than remaining space, append the rest
-			f.content = append(f.content, p[n:]...)
-		}
-		f.pos += int64(len(p))
+	end := off + int64(len(p))
+	if maxSize := f.fs.driver.maxFileSize; maxSize > 0 && end > maxSize {
+		vfsLogger.Warn("SqliteFile.Write: write would exceed max file size", "path", f.path, "current_len", f.size, "write_len", len(p), "max_size", maxSize)
+		return 0, f.reject("max file size exceeded")
+	}
+	if exceeded, err := f.quotaExceeded(end); err != nil {
+		return 0, err
+	} else if exceeded {
+		return 0, f.reject("storage quota exceeded")
 	}
-	return len(p), nil
-}
 
-func (f *SqliteFile) WriteAt(p []byte, off int64) (n int, err error) {
-	return 0, errors.New("WriteAt not supported")
+	for n < len(p) {
+		pos := off + int64(n)
+		idx := pos / db.ChunkSize
+		if err := f.loadChunk(idx); err != nil {
+			return n, err
+		}
+
+		chunkOff := pos - idx*db.ChunkSize
+		if gap := chunkOff - int64(len(f.chunk)); gap > 0 {
+			f.chunk = append(f.chunk, make([]byte, gap)...)
+		}
+		end := chunkOff + int64(len(p)-n)
+		if end > db.ChunkSize {
+			end = db.ChunkSize
+		}
+		if end > int64(len(f.chunk)) {
+			f.chunk = append(f.chunk, make([]byte, end-int64(len(f.chunk)))...)
+		}
+		m := copy(f.chunk[chunkOff:end], p[n:])
+		f.chunkDirty = true
+
+		n += m
+		if pos+int64(m) > f.size {
+			f.size = pos + int64(m)
+		}
+	}
+	return n, nil
 }
 
 func (f *SqliteFile) Name() string {
 	return filepath.Base(f.path)
 }
 
-func (f *SqliteFile) Readdir(count int) ([]os.FileInfo, error) {
+// readdirPageSize is the number of entries Readdir reads per query.
+const readdirPageSize = 1000
+
+// Readdir reads the next count entries of the directory in name order, or
+// all remaining ones if count <= 0, following os.File: with count > 0 it
+// returns io.EOF once nothing is left. Entries are read in pages keyed on the
+// last name returned, each with its own query, so a huge directory is never
+// held open in one read and entries added or removed between pages are
+// listed or skipped without disturbing the rest.
+func (f *SqliteFile) Readdir(count int) (_ []os.FileInfo, err error) {
+	defer observe("readdir", time.Now(), &err)
 	if !f.isDir {
 		return nil, os.ErrInvalid
 	}
+	var infos []os.FileInfo
+	if f.mirror != "" {
+		all, err := f.readVersionsDir()
+		if err != nil {
+			return nil, err
+		}
+		infos = all[min(f.dirOffset, len(all)):]
+		if count > 0 && len(infos) > count {
+			infos = infos[:count]
+		}
+		f.dirOffset += len(infos)
+	} else {
+		inWritable := f.fs.writableDir(f.path)
+		for {
+			limit := readdirPageSize
+			if count > 0 {
+				limit = min(limit, count-len(infos))
+			}
+			page, err := f.readdirPage(limit, inWritable)
+			if err != nil {
+				return nil, err
+			}
+			infos = append(infos, page...)
+			if len(page) < limit || (count > 0 && len(infos) >= count) {
+				break
+			}
+		}
+	}
+	if count > 0 && len(infos) == 0 {
+		return nil, io.EOF
+	}
+	return infos, nil
+}
 
-	rows, err := f.fs.db.Query("SELECT name, size, is_dir, mod_time, path FROM files WHERE parent_path = ? ORDER BY name", f.path)
+// readdirPage reads up to limit entries following the last one returned.
+func (f *SqliteFile) readdirPage(limit int, inWritable bool) ([]os.FileInfo, error) {
+	rows, err := f.fs.db.Query(`
+		SELECT n.name, b.id, b.size, b.is_dir, COALESCE(b.mod_time, 0), COALESCE(b.create_time, 0), b.uid, b.gid, b.mode,
+			COALESCE(n.link_target, ''), COALESCE(b.blob_hash, '')
+		FROM files n JOIN files b ON b.id = COALESCE(n.body_id, n.id)
+		WHERE n.parent_id = ? AND n.name > ?
+		ORDER BY n.name
+		LIMIT ?
+	`, f.id, f.dirCursor, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -497,22 +1298,19 @@ func (f *SqliteFile) Readdir(count int) ([]os.FileInfo, error) {
 	var infos []os.FileInfo
 	for rows.Next() {
 		var fi FileInfo
-		var modTimeStr string
-		err := rows.Scan(&fi.name, &fi.size, &fi.isDir, &modTimeStr, &fi.path)
+		var modTime, createTime int64
+		err := rows.Scan(&fi.name, &fi.id, &fi.size, &fi.isDir, &modTime, &createTime, &fi.uid, &fi.gid, &fi.mode, &fi.target, &fi.sha256)
 		if err != nil {
 			return nil, err
 		}
-		fi.modTime, _ = time.Parse(time.RFC3339, modTimeStr)
-		if fi.modTime.IsZero() {
-			fi.modTime, _ = time.Parse("2006-01-02 15:04:05", modTimeStr)
-		}
+		fi.path = path.Join(f.path, fi.name)
+		fi.modTime = unixTime(modTime)
+		fi.createTime = unixTime(createTime)
+		fi.perm = f.fs.permFact(fi.path, fi.isDir, fi.uid, fi.gid, fi.mode, inWritable)
 		infos = append(infos, &fi)
-
-		if count > 0 && len(infos) >= count {
-			break
-		}
+		f.dirCursor = fi.name
 	}
-	return infos, nil
+	return infos, rows.Err()
 }
 
 func (f *SqliteFile) Readdirnames(n int) ([]string, error) {
@@ -528,7 +1326,10 @@ func (f *SqliteFile) Readdirnames(n int) ([]string, error) {
 }
 
 func (f *SqliteFile) Stat() (os.FileInfo, error) {
-	return f.fs.Stat(f.path)
+	if f.info != nil {
+		return f.info, nil
+	}
+	return f.fs.stat(f.path, true)
 }
 
 func (f *SqliteFile) Sync() error {
@@ -539,12 +1340,67 @@ func (f *SqliteFile) Truncate(size int64) error {
 	if size < 0 {
 		return os.ErrInvalid
 	}
-	if size > int64(len(f.content)) {
-		diff := size - int64(len(f.content))
-		f.content = append(f.content, make([]byte, diff)...)
-	} else {
-		f.content = f.content[:size]
+	if f.isDir {
+		return os.ErrInvalid
+	}
+	if f.versionID != 0 {
+		return os.ErrPermission
+	}
+	if f.deleted {
+		return os.ErrNotExist
+	}
+	if f.failure != nil {
+		return f.failure
+	}
+	if size > f.size {
+		if maxSize := f.fs.driver.maxFileSize; maxSize > 0 && size > maxSize {
+			return ftpserver.ErrStorageExceeded
+		}
+		if exceeded, err := f.quotaExceeded(size); err != nil {
+			return err
+		} else if exceeded {
+			return ftpserver.ErrStorageExceeded
+		}
+	}
+	if err := f.beginUpload(min(size, f.size)); err != nil {
+		return err
+	}
+	if size >= f.size {
+		// Growing only moves the logical end; the gap reads back as zeros
+		f.size = size
+		return nil
 	}
+
+	// Shrinking drops stored data immediately so a later extension of the
+	// file can never resurface the old bytes.
+	if err := f.flushChunk(); err != nil {
+		return err
+	}
+	f.chunk = nil
+	f.chunkIndex = -1
+
+	tx, err := f.fs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	firstDropped := (size + db.ChunkSize - 1) / db.ChunkSize // first chunk entirely past the new end
+	if _, err := tx.Exec("DELETE FROM upload_chunks WHERE upload_id = ? AND chunk_index >= ?", f.upload, firstDropped); err != nil {
+		return err
+	}
+	if rem := size % db.ChunkSize; rem != 0 {
+		_, err := tx.Exec("UPDATE upload_chunks SET data = substr(data, 1, ?) WHERE upload_id = ? AND chunk_index = ? AND length(data) > ?",
+			rem, f.upload, size/db.ChunkSize, rem)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	f.size = size
 	return nil
 }
 
@@ -559,19 +1415,45 @@ type FileInfo struct {
 	isDir   bool
 	modTime time.Time
 	path    string
+	uid     int64
+	gid     int64
+	mode    uint32 // permission bits
+	target  string // symbolic link target, "" for other entries
+	id      int64  // row holding the content, 0 in the versions tree
+	sha256  string // blob holding the content, "" for empty or legacy files
+	perm    string // RFC 3659 perm fact for the session
+
+	createTime time.Time // zero when unknown
 }
 
 func (fi *FileInfo) Name() string { return fi.name }
-func (fi *FileInfo) Size() int64  { return fi.size }
+func (fi *FileInfo) Size() int64 {
+	if fi.target != "" {
+		return int64(len(fi.target))
+	}
+	return fi.size
+}
 func (fi *FileInfo) Mode() os.FileMode {
 	if fi.isDir {
-		return os.ModeDir | 0755
+		return os.ModeDir | os.FileMode(fi.mode&0777)
+	}
+	if fi.target != "" {
+		return os.ModeSymlink | os.FileMode(fi.mode&0777)
 	}
-	return 0644
+	return os.FileMode(fi.mode & 0777)
 }
 func (fi *FileInfo) ModTime() time.Time { return fi.modTime }
 func (fi *FileInfo) IsDir() bool        { return fi.isDir }
-func (fi *FileInfo) Sys() interface{}   { return nil }
+func (fi *FileInfo) Sys() interface{}   { return fi.facts() }
+
+// unixTime converts a timestamp column holding Unix nanoseconds, read as 0
+// when it is NULL, to a time.Time that is zero in that case.
+func unixTime(nsec int64) time.Time {
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
 
 func normalizePath(p string) string {
 	if !strings.HasPrefix(p, "/") {
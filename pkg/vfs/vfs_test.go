@@ -2,16 +2,29 @@ package vfs
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/colinrgodsey/sealed-ftpd/pkg/config"
 	"github.com/colinrgodsey/sealed-ftpd/pkg/db"
 
 	ftpserver "github.com/fclairamb/ftpserverlib"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/afero"
 )
 
 func setupTestDB(t *testing.T) (*sql.DB, *MainDriver, func()) {
@@ -25,7 +38,13 @@ func setupTestDB(t *testing.T) (*sql.DB, *MainDriver, func()) {
 		t.Fatalf("Failed to create schema: %v", err)
 	}
 
-	driver := NewMainDriver(dbConn, 30000, 30009, "127.0.0.1:0", 5*time.Second)
+	cfg := config.Default()
+	cfg.PassivePortStart = 30000
+	cfg.PassivePortEnd = 30009
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.ConnectionTimeout = 5 * time.Second
+	cfg.AllowAnonymous = true
+	driver := NewMainDriver(dbConn, cfg, nil)
 
 	return dbConn, driver, func() {
 		dbConn.Close()
@@ -33,23 +52,313 @@ func setupTestDB(t *testing.T) (*sql.DB, *MainDriver, func()) {
 }
 
 func TestAuth(t *testing.T) {
-	_, driver, cleanup := setupTestDB(t)
+	dbConn, driver, cleanup := setupTestDB(t)
 	defer cleanup()
 
 	// AuthUser returns a ClientDriver which implements afero.Fs
-	fs, err := driver.AuthUser(nil, "user", "pass")
+	fs, err := driver.AuthUser(nil, "anonymous", "pass")
 	if err != nil {
 		t.Fatalf("AuthUser failed: %v", err)
 	}
 	if fs == nil {
 		t.Fatal("Returned filesystem is nil")
 	}
+
+	if err := db.CreateUser(dbConn, "alice", "secret"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if _, err := driver.AuthUser(nil, "alice", "secret"); err != nil {
+		t.Errorf("AuthUser with valid credentials failed: %v", err)
+	}
+	if _, err := driver.AuthUser(nil, "alice", "wrong"); err == nil {
+		t.Error("AuthUser accepted a wrong password")
+	}
+	if _, err := driver.AuthUser(nil, "bob", "secret"); err == nil {
+		t.Error("AuthUser accepted an unknown user")
+	}
+
+	if err := db.SetUserDisabled(dbConn, "alice", true); err != nil {
+		t.Fatalf("SetUserDisabled failed: %v", err)
+	}
+	if _, err := driver.AuthUser(nil, "alice", "secret"); err == nil {
+		t.Error("AuthUser accepted a disabled user")
+	}
+
+	// Anonymous access is opt-in
+	driver.allowAnonymous = false
+	if _, err := driver.AuthUser(nil, "anonymous", "pass"); err == nil {
+		t.Error("AuthUser accepted anonymous login while disabled")
+	}
+}
+
+func TestHomeDirectories(t *testing.T) {
+	_, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	dbConn := driver.db
+
+	if err := db.CreateUser(dbConn, "alice", "secret"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if err := db.CreateUser(dbConn, "bob", "secret"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if err := db.SetUserHome(dbConn, "bob", "/srv/bob"); err != nil {
+		t.Fatalf("SetUserHome failed: %v", err)
+	}
+
+	alice, err := driver.AuthUser(nil, "alice", "secret")
+	if err != nil {
+		t.Fatalf("AuthUser failed: %v", err)
+	}
+	// Home is created on first login and is the client's root
+	fi, err := alice.Stat("/")
+	if err != nil || !fi.IsDir() {
+		t.Fatalf("Expected home to be a directory, got %v, %v", fi, err)
+	}
+	f, err := alice.Create("/notes.txt")
+	if err != nil {
+		t.Fatalf("Create in home failed: %v", err)
+	}
+	f.Write([]byte("alice"))
+	f.Close()
+
+	var count int
+	dbConn.QueryRow("SELECT COUNT(*) FROM file_paths WHERE path = '/home/alice/notes.txt'").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected file to be stored under /home/alice")
+	}
+
+	bob, err := driver.AuthUser(nil, "bob", "secret")
+	if err != nil {
+		t.Fatalf("AuthUser failed: %v", err)
+	}
+	if _, err := bob.Stat("/notes.txt"); !os.IsNotExist(err) {
+		t.Errorf("bob should not see alice's files, got %v", err)
+	}
+	// Parent references cannot climb out of the home directory
+	for _, p := range []string{"/../home/alice/notes.txt", "../../home/alice/notes.txt", "/../../.."} {
+		if fi, err := bob.Stat(p); err == nil && !fi.IsDir() {
+			t.Errorf("Stat(%q) escaped the home directory", p)
+		}
+	}
+	if err := bob.Rename("/../../home/alice/notes.txt", "/stolen.txt"); err == nil {
+		t.Errorf("Rename escaped the home directory")
+	}
+	if err := bob.Remove("/"); err == nil {
+		t.Errorf("Removing the home directory should fail")
+	}
+
+	// The unrestricted anonymous root sees both homes
+	anon, _ := driver.AuthUser(nil, "anonymous", "")
+	if _, err := anon.Stat("/home/alice/notes.txt"); err != nil {
+		t.Errorf("Expected anonymous root to see /home/alice/notes.txt: %v", err)
+	}
+	if _, err := anon.Stat("/srv/bob"); err != nil {
+		t.Errorf("Expected custom home /srv/bob to exist: %v", err)
+	}
+
+	// A home that cannot be looked up fails the login instead of being
+	// created over
+	if err := driver.Link("/loop", "/loop", true); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if err := db.SetUserHome(dbConn, "bob", "/loop/bob"); err != nil {
+		t.Fatalf("SetUserHome failed: %v", err)
+	}
+	_, err = driver.AuthUser(nil, "bob", "secret")
+	if !errors.Is(err, errTooManyLinks) || !strings.Contains(err.Error(), "failed to look up home directory") {
+		t.Errorf("Expected login with an unresolvable home to fail its lookup, got %v", err)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	_, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	dbConn := driver.db
+
+	if err := db.CreateUser(dbConn, "alice", "secret"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if err := db.SetUserHome(dbConn, "alice", "/"); err != nil {
+		t.Fatalf("SetUserHome failed: %v", err)
+	}
+	alice, err := driver.AuthUser(nil, "alice", "secret")
+	if err != nil {
+		t.Fatalf("AuthUser failed: %v", err)
+	}
+
+	// A read-only drop area and a write-only inbox, both owned by alice
+	if err := alice.Mkdir("/pub", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	f, err := alice.Create("/pub/readme.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	f.Write([]byte("hello"))
+	f.Close()
+	if err := alice.Mkdir("/inbox", 0777); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := alice.Chmod("/inbox", 0733); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+
+	fi, err := alice.Stat("/pub/readme.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if fi.Mode().Perm() != 0644 {
+		t.Errorf("Expected umask to give 0644, got %o", fi.Mode().Perm())
+	}
+	if fi, _ := alice.Stat("/inbox"); fi.Mode().Perm() != 0733 {
+		t.Errorf("Expected chmod to store 0733, got %o", fi.Mode().Perm())
+	}
+
+	anon, _ := driver.AuthUser(nil, "anonymous", "")
+	if f, err := anon.Open("/pub/readme.txt"); err != nil {
+		t.Errorf("Expected anonymous to read /pub: %v", err)
+	} else {
+		f.Close()
+	}
+	if _, err := anon.OpenFile("/pub/readme.txt", os.O_WRONLY|os.O_TRUNC, 0666); !os.IsPermission(err) {
+		t.Errorf("Expected overwrite in /pub to be denied, got %v", err)
+	}
+	if _, err := anon.Create("/pub/new.txt"); !os.IsPermission(err) {
+		t.Errorf("Expected upload to /pub to be denied, got %v", err)
+	}
+	if err := anon.Remove("/pub/readme.txt"); !os.IsPermission(err) {
+		t.Errorf("Expected delete in /pub to be denied, got %v", err)
+	}
+	if err := anon.Rename("/pub/readme.txt", "/inbox/readme.txt"); !os.IsPermission(err) {
+		t.Errorf("Expected rename out of /pub to be denied, got %v", err)
+	}
+
+	f, err = anon.Create("/inbox/upload.txt")
+	if err != nil {
+		t.Fatalf("Expected upload to /inbox to succeed: %v", err)
+	}
+	f.Write([]byte("data"))
+	f.Close()
+	if _, err := anon.Open("/inbox"); !os.IsPermission(err) {
+		t.Errorf("Expected listing /inbox to be denied, got %v", err)
+	}
+	if err := anon.Chmod("/pub", 0777); !os.IsPermission(err) {
+		t.Errorf("Expected chmod by non-owner to be denied, got %v", err)
+	}
+	if err := anon.Chown("/inbox/upload.txt", 0, -1); !os.IsPermission(err) {
+		t.Errorf("Expected giving a file away to be denied, got %v", err)
+	}
+
+	// Accounts have private groups, so group bits only grant access once
+	// they share one
+	if err := db.CreateUser(dbConn, "bob", "secret"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if err := db.SetUserHome(dbConn, "bob", "/"); err != nil {
+		t.Fatalf("SetUserHome failed: %v", err)
+	}
+	bob, err := driver.AuthUser(nil, "bob", "secret")
+	if err != nil {
+		t.Fatalf("AuthUser failed: %v", err)
+	}
+	if err := alice.Chmod("/pub/readme.txt", 0640); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if _, err := bob.Open("/pub/readme.txt"); !os.IsPermission(err) {
+		t.Errorf("Expected group read by another account to be denied, got %v", err)
+	}
+	users, _ := db.ListUsers(dbConn)
+	if users[0].GID != users[0].ID || users[1].GID != users[1].ID {
+		t.Errorf("Expected private groups numbered like the uids, got %+v", users)
+	}
+	if err := db.SetUserGID(dbConn, "bob", users[0].GID); err != nil {
+		t.Fatalf("SetUserGID failed: %v", err)
+	}
+	if bob, err = driver.AuthUser(nil, "bob", "secret"); err != nil {
+		t.Fatalf("AuthUser failed: %v", err)
+	}
+	if f, err := bob.Open("/pub/readme.txt"); err != nil {
+		t.Errorf("Expected group read in a shared group: %v", err)
+	} else {
+		f.Close()
+	}
+
+	// Private groups never coincide with the group of older accounts or
+	// that of anonymous sessions
+	if err := db.SetUserGID(dbConn, "bob", db.DefaultGID); err != nil {
+		t.Fatalf("SetUserGID failed: %v", err)
+	}
+	if bob, err = driver.AuthUser(nil, "bob", "secret"); err != nil {
+		t.Fatalf("AuthUser failed: %v", err)
+	}
+	for taken, member := range map[int64]ftpserver.ClientDriver{db.DefaultGID: bob, AnonymousGID: anon} {
+		dbConn.Exec("UPDATE sqlite_sequence SET seq = ? WHERE name = 'users'", taken-1)
+		name := fmt.Sprintf("user%d", taken)
+		if err := db.CreateUser(dbConn, name, "secret"); err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+		if err := db.SetUserHome(dbConn, name, "/"); err != nil {
+			t.Fatalf("SetUserHome failed: %v", err)
+		}
+		user, err := driver.AuthUser(nil, name, "secret")
+		if err != nil {
+			t.Fatalf("AuthUser failed: %v", err)
+		}
+		if id := user.(*SQLiteFs).user; id.uid != taken+1 || id.gid != taken+1 {
+			t.Errorf("Expected %s to skip %d, got %d:%d", name, taken, id.uid, id.gid)
+		}
+		path := "/" + name + ".txt"
+		f, err := user.Create(path)
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		f.Close()
+		if err := user.Chmod(path, 0640); err != nil {
+			t.Fatalf("Chmod failed: %v", err)
+		}
+		if _, err := member.Open(path); !os.IsPermission(err) {
+			t.Errorf("Expected group %d to be denied the private file of %s, got %v", taken, name, err)
+		}
+	}
+
+	// Uploads belong to the uploader
+	var uid int64
+	dbConn.QueryRow("SELECT f.uid FROM files f JOIN file_paths p ON p.id = f.id WHERE p.path = '/inbox/upload.txt'").Scan(&uid)
+	if uid != AnonymousUID {
+		t.Errorf("Expected upload to be owned by %d, got %d", AnonymousUID, uid)
+	}
+}
+
+func TestSelfSignedCertificatePersisted(t *testing.T) {
+	dbConn, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	driver.tlsSelfSigned = true
+
+	tlsConfig, err := driver.GetTLSConfig()
+	if err != nil {
+		t.Fatalf("GetTLSConfig failed: %v", err)
+	}
+	if tlsConfig == nil || len(tlsConfig.Certificates) != 1 {
+		t.Fatalf("Expected a generated certificate")
+	}
+
+	// A new driver on the same database reuses the stored certificate
+	other := NewMainDriver(dbConn, config.Default(), nil)
+	other.tlsSelfSigned = true
+	otherConfig, err := other.GetTLSConfig()
+	if err != nil {
+		t.Fatalf("GetTLSConfig failed: %v", err)
+	}
+	if !bytes.Equal(tlsConfig.Certificates[0].Certificate[0], otherConfig.Certificates[0].Certificate[0]) {
+		t.Errorf("Expected the stored self-signed certificate to be reused")
+	}
 }
 
 func TestMkdir(t *testing.T) {
 	_, driver, cleanup := setupTestDB(t)
 	defer cleanup()
-	fs, _ := driver.AuthUser(nil, "", "")
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
 
 	// Create directory
 	err := fs.Mkdir("/testdir", 0755)
@@ -83,7 +392,7 @@ func TestMkdir(t *testing.T) {
 func TestFileOps(t *testing.T) {
 	_, driver, cleanup := setupTestDB(t)
 	defer cleanup()
-	fs, _ := driver.AuthUser(nil, "", "")
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
 
 	// Create file
 	f, err := fs.Create("/test.txt")
@@ -117,10 +426,373 @@ func TestFileOps(t *testing.T) {
 	f.Close()
 }
 
+func TestVersions(t *testing.T) {
+	_, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	driver.maxVersions = 2
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+
+	fs.Mkdir("/docs", 0755)
+	for _, content := range []string{"one", "two", "three", "four"} {
+		f, err := fs.Create("/docs/a.txt")
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		f.Write([]byte(content))
+		f.Close()
+	}
+
+	dir, err := fs.Open("/.versions")
+	if err != nil {
+		t.Fatalf("Open versions root failed: %v", err)
+	}
+	names, _ := dir.Readdirnames(-1)
+	if len(names) != 1 || names[0] != "docs" {
+		t.Errorf("Expected versions root to list docs, got %v", names)
+	}
+
+	dir, err = fs.Open("/.versions/docs/a.txt")
+	if err != nil {
+		t.Fatalf("Open versions dir failed: %v", err)
+	}
+	infos, err := dir.Readdir(-1)
+	if err != nil {
+		t.Fatalf("Readdir failed: %v", err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("Expected history to be pruned to 2 versions, got %d", len(infos))
+	}
+
+	// Newest first: the content replaced by the last upload
+	for i, want := range []string{"three", "two"} {
+		p := "/.versions/docs/a.txt/" + infos[i].Name()
+		fi, err := fs.Stat(p)
+		if err != nil || fi.IsDir() || fi.Size() != int64(len(want)) {
+			t.Errorf("Stat(%q) = %v, %v", p, fi, err)
+		}
+		f, err := fs.Open(p)
+		if err != nil {
+			t.Fatalf("Open version failed: %v", err)
+		}
+		data, _ := io.ReadAll(f)
+		f.Close()
+		if string(data) != want {
+			t.Errorf("Expected version %d to read %q, got %q", i, want, data)
+		}
+	}
+
+	// The versions tree is read-only
+	p := "/.versions/docs/a.txt/" + infos[0].Name()
+	if _, err := fs.OpenFile(p, os.O_WRONLY|os.O_TRUNC, 0666); !os.IsPermission(err) {
+		t.Errorf("Expected writing a version to be denied, got %v", err)
+	}
+	if err := fs.Remove(p); !os.IsPermission(err) {
+		t.Errorf("Expected removing a version to be denied, got %v", err)
+	}
+	if _, err := fs.Open("/.versions/docs/a.txt/20000101T000000.000000000Z"); !os.IsNotExist(err) {
+		t.Errorf("Expected unknown version to not exist, got %v", err)
+	}
+
+	// The purger expires revisions past the maximum age of files that no
+	// longer change
+	driver.versionMaxAge = time.Hour
+	if err := driver.PurgeVersions(); err != nil {
+		t.Fatalf("PurgeVersions failed: %v", err)
+	}
+	var kept int
+	driver.db.QueryRow("SELECT COUNT(*) FROM file_versions").Scan(&kept)
+	if kept != 2 {
+		t.Errorf("Expected 2 recent revisions to be kept, got %d", kept)
+	}
+	driver.versionMaxAge = time.Nanosecond
+	if err := driver.PurgeVersions(); err != nil {
+		t.Fatalf("PurgeVersions failed: %v", err)
+	}
+	driver.db.QueryRow("SELECT COUNT(*) FROM file_versions").Scan(&kept)
+	if kept != 0 {
+		t.Errorf("Expected expired revisions to be purged, got %d", kept)
+	}
+	if used, _ := db.UsedBytes(driver.db); used != int64(len("four")) {
+		t.Errorf("Expected only the current content to count after the purge, got %d bytes", used)
+	}
+
+	// History goes away with the file once it leaves the trash
+	if err := fs.Remove("/docs/a.txt"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := db.PurgeTrash(driver.db, time.Now()); err != nil {
+		t.Fatalf("PurgeTrash failed: %v", err)
+	}
+	var count int
+	driver.db.QueryRow("SELECT COUNT(*) FROM version_chunks").Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected version chunks to be removed with the file, got %d", count)
+	}
+}
+
+func TestChunkedReadWrite(t *testing.T) {
+	dbConn, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+
+	// Spans three chunks, the last one partial
+	content := make([]byte, 2*db.ChunkSize+1234)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	f, err := fs.Create("/chunked.bin")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	// Write in odd-sized pieces so writes straddle chunk boundaries
+	for off := 0; off < len(content); off += 100000 {
+		end := min(off+100000, len(content))
+		if _, err := f.Write(content[off:end]); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	var chunks int
+	err = dbConn.QueryRow("SELECT COUNT(*) FROM blob_chunks c JOIN files f ON f.blob_hash = c.hash JOIN file_paths p ON p.id = f.id WHERE p.path = '/chunked.bin'").Scan(&chunks)
+	if err != nil {
+		t.Fatalf("Failed to count chunks: %v", err)
+	}
+	if chunks != 3 {
+		t.Errorf("Expected 3 chunks, got %d", chunks)
+	}
+
+	f, err = fs.Open("/chunked.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Content mismatch after chunked round trip")
+	}
+
+	// ReadAt across a chunk boundary
+	buf := make([]byte, 100)
+	if _, err := f.ReadAt(buf, db.ChunkSize-50); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(buf, content[db.ChunkSize-50:db.ChunkSize+50]) {
+		t.Errorf("ReadAt content mismatch")
+	}
+
+	// Seek relative to the end
+	if _, err := f.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	tail, _ := io.ReadAll(f)
+	if !bytes.Equal(tail, content[len(content)-10:]) {
+		t.Errorf("Tail content mismatch")
+	}
+	f.Close()
+
+	// Shrinking drops trailing chunks and growing back exposes zeros only
+	f, _ = fs.OpenFile("/chunked.bin", os.O_RDWR, 0)
+	if err := f.Truncate(10); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if _, err := f.Seek(db.ChunkSize, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	f.Write([]byte("x"))
+	f.Close()
+
+	f, _ = fs.Open("/chunked.bin")
+	got, _ = io.ReadAll(f)
+	f.Close()
+	if len(got) != db.ChunkSize+1 {
+		t.Fatalf("Expected size %d, got %d", db.ChunkSize+1, len(got))
+	}
+	if !bytes.Equal(got[:10], content[:10]) {
+		t.Errorf("Prefix lost after truncate")
+	}
+	if !bytes.Equal(got[10:db.ChunkSize], make([]byte, db.ChunkSize-10)) {
+		t.Errorf("Expected zeros after truncate point")
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	dbConn, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	driver.maxVersions = 0
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+
+	content := bytes.Repeat([]byte("artifact"), db.ChunkSize/4) // two chunks
+	for _, name := range []string{"/a.bin", "/b.bin"} {
+		f, _ := fs.Create(name)
+		f.Write(content)
+		if err := f.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+
+	var blobs, chunks, refcount int
+	dbConn.QueryRow("SELECT COUNT(*), COALESCE(SUM(refcount), 0) FROM blobs").Scan(&blobs, &refcount)
+	dbConn.QueryRow("SELECT COUNT(*) FROM blob_chunks").Scan(&chunks)
+	if blobs != 1 || refcount != 2 || chunks != 2 {
+		t.Errorf("Expected 1 shared blob with 2 chunks and 2 references, got %d blobs, %d chunks, %d refs", blobs, chunks, refcount)
+	}
+	dbConn.QueryRow("SELECT COUNT(*) FROM file_chunks").Scan(&chunks)
+	if chunks != 0 {
+		t.Errorf("Expected no staged chunks after close, got %d", chunks)
+	}
+
+	// Modifying one copy leaves the other intact
+	f, _ := fs.OpenFile("/a.bin", os.O_WRONLY, 0)
+	f.Write([]byte("changed"))
+	f.Close()
+	f, _ = fs.Open("/b.bin")
+	got, _ := io.ReadAll(f)
+	f.Close()
+	if !bytes.Equal(got, content) {
+		t.Errorf("Shared content changed through another file")
+	}
+	dbConn.QueryRow("SELECT COUNT(*), COALESCE(SUM(refcount), 0) FROM blobs").Scan(&blobs, &refcount)
+	if blobs != 2 || refcount != 2 {
+		t.Errorf("Expected 2 blobs with one reference each, got %d blobs, %d refs", blobs, refcount)
+	}
+
+	// Renaming keeps the reference, deleting releases it
+	if err := fs.Rename("/b.bin", "/c.bin"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	driver.trashRetention = 0
+	for _, name := range []string{"/a.bin", "/c.bin"} {
+		if err := fs.Remove(name); err != nil {
+			t.Fatalf("Remove failed: %v", err)
+		}
+	}
+	dbConn.QueryRow("SELECT COUNT(*) FROM blobs").Scan(&blobs)
+	dbConn.QueryRow("SELECT COUNT(*) FROM blob_chunks").Scan(&chunks)
+	if blobs != 0 || chunks != 0 {
+		t.Errorf("Expected unreferenced blobs to be deleted, got %d blobs, %d chunks", blobs, chunks)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	dbConn, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+
+	compressible := bytes.Repeat([]byte("log line\n"), db.ChunkSize/4)
+	random := make([]byte, 1000)
+	rand.Read(random)
+
+	write := func(name string, content []byte) {
+		f, _ := fs.Create(name)
+		f.Write(content)
+		if err := f.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+	write("/plain.log", []byte("stored before compression was enabled"))
+	driver.encoding.Codec = db.CodecGzip
+	write("/app.log", compressible)
+	write("/random.bin", random)
+
+	codecs := map[string]string{}
+	rows, _ := dbConn.Query("SELECT f.name, c.codec FROM files f JOIN blob_chunks c ON c.hash = f.blob_hash WHERE c.chunk_index = 0")
+	for rows.Next() {
+		var name, codec string
+		rows.Scan(&name, &codec)
+		codecs[name] = codec
+	}
+	rows.Close()
+	if codecs["plain.log"] != db.CodecNone || codecs["app.log"] != db.CodecGzip || codecs["random.bin"] != db.CodecNone {
+		t.Errorf("Unexpected chunk codecs: %v", codecs)
+	}
+
+	for name, want := range map[string][]byte{"/app.log": compressible, "/random.bin": random} {
+		f, _ := fs.Open(name)
+		got, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("Content of %s does not round trip: %v", name, err)
+		}
+		if fi, _ := fs.Stat(name); fi.Size() != int64(len(want)) {
+			t.Errorf("Expected logical size %d for %s, got %d", len(want), name, fi.Size())
+		}
+	}
+
+	stats, err := db.GetStorageStats(dbConn)
+	if err != nil {
+		t.Fatalf("GetStorageStats failed: %v", err)
+	}
+	if stats.UniqueBytes != stats.LogicalBytes || stats.StoredBytes >= stats.LogicalBytes/2 {
+		t.Errorf("Expected compression savings, got %+v", stats)
+	}
+
+	// Modifying a compressed file works on the decoded content
+	f, _ := fs.OpenFile("/app.log", os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte("tail"))
+	f.Close()
+	f, _ = fs.Open("/app.log")
+	got, _ := io.ReadAll(f)
+	f.Close()
+	if !bytes.Equal(got, append(compressible, "tail"...)) {
+		t.Errorf("Append to compressed file lost content")
+	}
+}
+
+func TestComputeHash(t *testing.T) {
+	dbConn, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+
+	hasher := fs.(ftpserver.ClientDriverExtensionHasher)
+
+	content := []byte("integrity check")
+	f, _ := fs.Create("/sum.txt")
+	f.Write(content)
+	f.Close()
+
+	sha := sha256.Sum256(content)
+	md := md5.Sum(content)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(content))
+	part := sha256.Sum256(content[4:9])
+
+	for _, tc := range []struct {
+		algo       ftpserver.HASHAlgo
+		start, end int64
+		want       string
+	}{
+		{ftpserver.HASHAlgoSHA256, 0, int64(len(content)), hex.EncodeToString(sha[:])},
+		{ftpserver.HASHAlgoMD5, 0, int64(len(content)), hex.EncodeToString(md[:])},
+		{ftpserver.HASHAlgoCRC32, 0, int64(len(content)), hex.EncodeToString(crc)},
+		{ftpserver.HASHAlgoSHA256, 4, 9, hex.EncodeToString(part[:])},
+	} {
+		got, err := hasher.ComputeHash("/sum.txt", tc.algo, tc.start, tc.end)
+		if err != nil {
+			t.Fatalf("ComputeHash(%v) failed: %v", tc.algo, err)
+		}
+		if got != tc.want {
+			t.Errorf("ComputeHash(%v, %d, %d) = %s, want %s", tc.algo, tc.start, tc.end, got, tc.want)
+		}
+	}
+
+	// Whole-file digests are recorded when the content is stored
+	var storedMD5 string
+	dbConn.QueryRow("SELECT b.md5 FROM blobs b JOIN files f ON f.blob_hash = b.hash JOIN file_paths p ON p.id = f.id WHERE p.path = '/sum.txt'").Scan(&storedMD5)
+	if storedMD5 != hex.EncodeToString(md[:]) {
+		t.Errorf("Expected stored MD5 %x, got %q", md, storedMD5)
+	}
+}
+
 func TestReaddir(t *testing.T) {
 	_, driver, cleanup := setupTestDB(t)
 	defer cleanup()
-	fs, _ := driver.AuthUser(nil, "", "")
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
 
 	fs.Mkdir("/dir", 0755)
 
@@ -151,41 +823,442 @@ func TestReaddir(t *testing.T) {
 	if !names["f1.txt"] || !names["f2.txt"] {
 		t.Errorf("Missing files in Readdir")
 	}
-}
-
-func TestRemove(t *testing.T) {
-	_, driver, cleanup := setupTestDB(t)
-	defer cleanup()
-	fs, _ := driver.AuthUser(nil, "", "")
 
-	fs.Create("/file.txt")
-	err := fs.Remove("/file.txt")
-	if err != nil {
-		t.Errorf("Remove file failed: %v", err)
+	// Repeated calls continue where the previous one stopped
+	f3, _ := fs.Create("/dir/f3.txt")
+	f3.Close()
+	dirFile, _ = fs.Open("/dir")
+	defer dirFile.Close()
+	var pages [][]string
+	for {
+		names, err := dirFile.Readdirnames(2)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Readdirnames failed: %v", err)
+		}
+		pages = append(pages, names)
 	}
-	_, err = fs.Stat("/file.txt")
-	if !os.IsNotExist(err) {
-		t.Errorf("File should not exist")
+	if fmt.Sprint(pages) != "[[f1.txt f2.txt] [f3.txt]]" {
+		t.Errorf("Expected two pages, got %v", pages)
+	}
+	if infos, err := dirFile.Readdir(-1); err != nil || len(infos) != 0 {
+		t.Errorf("Expected nothing left without an error, got %v, %v", infos, err)
 	}
 
-	fs.Mkdir("/dir", 0755)
-	err = fs.Remove("/dir")
+	// Directories larger than a page are read in full
+	fs.Mkdir("/big", 0755)
+	big, _ := fs.Stat("/big")
+	_, err = driver.db.Exec(`
+		WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < ?)
+		INSERT INTO files (parent_id, name, mod_time) SELECT ?, printf('f%05d', i), 0 FROM n
+	`, readdirPageSize*2+5, big.Sys().(Facts).Unique)
 	if err != nil {
-		t.Errorf("Remove dir failed: %v", err)
+		t.Fatalf("Failed to fill directory: %v", err)
 	}
-	_, err = fs.Stat("/dir")
-	if !os.IsNotExist(err) {
-		t.Errorf("Dir should not exist")
+	bigDir, _ := fs.Open("/big")
+	defer bigDir.Close()
+	infos, err = bigDir.Readdir(0)
+	if err != nil || len(infos) != readdirPageSize*2+5 {
+		t.Fatalf("Expected %d entries, got %d, %v", readdirPageSize*2+5, len(infos), err)
+	}
+	for i := 1; i < len(infos); i++ {
+		if infos[i-1].Name() >= infos[i].Name() {
+			t.Fatalf("Entries out of order at %d: %s, %s", i, infos[i-1].Name(), infos[i].Name())
+		}
 	}
 }
 
-func TestSizeLimit(t *testing.T) {
+func TestFacts(t *testing.T) {
 	_, driver, cleanup := setupTestDB(t)
 	defer cleanup()
-	fs, _ := driver.AuthUser(nil, "", "")
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
 
-	f, _ := fs.Create("/large.txt")
-	defer f.Close()
+	fs.Mkdir("/dir", 0755)
+	f, _ := fs.Create("/dir/notes.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	if err := fs.(*SQLiteFs).Link("/dir/notes.txt", "/dir/copy.txt"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+
+	fi, err := fs.Stat("/dir/notes.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	facts, ok := fi.Sys().(Facts)
+	if !ok {
+		t.Fatalf("Expected Sys to return Facts, got %T", fi.Sys())
+	}
+	sum := sha256.Sum256([]byte("hello"))
+	if facts.Type != "file" || facts.Size != 5 || facts.Perm != "rwadf" ||
+		facts.MediaType != "text/plain" || facts.SHA256 != hex.EncodeToString(sum[:]) || facts.Unique == "" {
+		t.Errorf("Unexpected facts %+v", facts)
+	}
+	want := "type=file;size=5;modify=" + fi.ModTime().UTC().Format("20060102150405.999") +
+		";create=" + facts.Create.Format("20060102150405.999") + ";perm=rwadf;unique=" + facts.Unique + ";media-type=text/plain;X.sha256=" + facts.SHA256 + ";"
+	if facts.String() != want {
+		t.Errorf("Expected %q, got %q", want, facts.String())
+	}
+
+	// Listings carry the same facts, and hard links share a unique id
+	dir, _ := fs.Open("/dir")
+	infos, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("Readdir failed: %v, %v", infos, err)
+	}
+	for _, info := range infos {
+		if got := info.Sys().(Facts); got.Unique != facts.Unique || got.SHA256 != facts.SHA256 || got.Perm != facts.Perm {
+			t.Errorf("Expected %s to share the facts %+v, got %+v", info.Name(), facts, got)
+		}
+	}
+
+	fi, _ = fs.Stat("/dir")
+	if facts := fi.Sys().(Facts); facts.Type != "dir" || !strings.HasPrefix(facts.Perm, "elcmp") ||
+		facts.MediaType != "" || facts.SHA256 != "" {
+		t.Errorf("Unexpected directory facts %+v", facts)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	_, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// Metrics are global, so only their changes are checked
+	logins := testutil.ToFloat64(loginsTotal.WithLabelValues("success"))
+	failures := testutil.ToFloat64(loginsTotal.WithLabelValues("failure"))
+	uploads := testutil.ToFloat64(transfersTotal.WithLabelValues("upload", "ok"))
+	downloads := testutil.ToFloat64(transfersTotal.WithLabelValues("download", "ok"))
+	sent, received := testutil.ToFloat64(bytesDownloaded), testutil.ToFloat64(bytesUploaded)
+	notFound := testutil.ToFloat64(errorsTotal.WithLabelValues("stat", "not_found"))
+
+	fs, err := driver.AuthUser(nil, "anonymous", "")
+	if err != nil {
+		t.Fatalf("AuthUser failed: %v", err)
+	}
+	driver.AuthUser(nil, "nobody", "wrong")
+
+	f, _ := fs.Create("/data.bin")
+	f.Write([]byte("hello world"))
+	f.Close()
+	f, _ = fs.Open("/data.bin")
+	io.ReadAll(f)
+	f.Close()
+	// Reading without Read, as HASH does, is not a transfer
+	f, _ = fs.Open("/data.bin")
+	f.ReadAt(make([]byte, 5), 0)
+	f.Close()
+	fs.Stat("/missing")
+
+	for _, c := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"logins", testutil.ToFloat64(loginsTotal.WithLabelValues("success")) - logins, 1},
+		{"failed logins", testutil.ToFloat64(loginsTotal.WithLabelValues("failure")) - failures, 1},
+		{"uploads", testutil.ToFloat64(transfersTotal.WithLabelValues("upload", "ok")) - uploads, 1},
+		{"downloads", testutil.ToFloat64(transfersTotal.WithLabelValues("download", "ok")) - downloads, 1},
+		{"bytes received", testutil.ToFloat64(bytesUploaded) - received, 11},
+		{"bytes sent", testutil.ToFloat64(bytesDownloaded) - sent, 11},
+		{"stat errors", testutil.ToFloat64(errorsTotal.WithLabelValues("stat", "not_found")) - notFound, 1},
+	} {
+		if c.got != c.want {
+			t.Errorf("Expected %s to grow by %v, got %v", c.name, c.want, c.got)
+		}
+	}
+	if testutil.CollectAndCount(opSeconds, "sealed_ftpd_fs_operation_duration_seconds") == 0 {
+		t.Error("Expected operation timings to be recorded")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	_, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+
+	fs.Create("/file.txt")
+	err := fs.Remove("/file.txt")
+	if err != nil {
+		t.Errorf("Remove file failed: %v", err)
+	}
+	_, err = fs.Stat("/file.txt")
+	if !os.IsNotExist(err) {
+		t.Errorf("File should not exist")
+	}
+
+	fs.Mkdir("/dir", 0755)
+	err = fs.Remove("/dir")
+	if err != nil {
+		t.Errorf("Remove dir failed: %v", err)
+	}
+	_, err = fs.Stat("/dir")
+	if !os.IsNotExist(err) {
+		t.Errorf("Dir should not exist")
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	dbConn, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	driver.trashRetention = 0
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+
+	if err := fs.MkdirAll("/a_/b/c", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	for _, name := range []string{"/a_/top.txt", "/a_/b/c/deep.txt"} {
+		f, _ := fs.Create(name)
+		f.Write([]byte("data"))
+		f.Close()
+	}
+	// "_" must not act as a wildcard and pull in this sibling
+	fs.MkdirAll("/ab/keep", 0755)
+
+	if err := fs.RemoveAll("/a_"); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	var count int
+	dbConn.QueryRow("SELECT COUNT(*) FROM file_paths WHERE path = '/a_' OR path LIKE '/a\\_/%' ESCAPE '\\'").Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected subtree to be removed, %d rows left", count)
+	}
+	if _, err := fs.Stat("/ab/keep"); err != nil {
+		t.Errorf("Sibling directory was removed: %v", err)
+	}
+	if err := fs.RemoveAll("/missing"); err != nil {
+		t.Errorf("RemoveAll of a missing path should succeed, got %v", err)
+	}
+
+	// With the trash enabled the subtree moves there as one entry
+	driver.trashRetention = time.Hour
+	if err := fs.RemoveAll("/ab"); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	trash := fmt.Sprintf("/.trash/%d/", AnonymousUID)
+	dir, _ := fs.Open(trash)
+	names, _ := dir.Readdirnames(-1)
+	if len(names) != 1 {
+		t.Fatalf("Expected one trash entry, got %v", names)
+	}
+	if _, err := fs.Stat(trash + names[0] + "/keep"); err != nil {
+		t.Errorf("Expected subtree contents in the trash: %v", err)
+	}
+
+	// A subdirectory the session cannot write protects the whole tree
+	root := driver.rootFs()
+	root.MkdirAll("/locked/inner", 0755)
+	if err := fs.RemoveAll("/locked"); !os.IsPermission(err) {
+		t.Errorf("Expected RemoveAll to be denied, got %v", err)
+	}
+	if _, err := fs.Stat("/locked/inner"); err != nil {
+		t.Errorf("Denied RemoveAll must not remove anything: %v", err)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	_, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	driver.trashRetention = time.Hour
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+
+	fs.Mkdir("/dir", 0755)
+	f, _ := fs.Create("/dir/file.txt")
+	f.Write([]byte("keep me"))
+	f.Close()
+
+	if err := fs.Remove("/dir/file.txt"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := fs.Stat("/dir/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("Removed file should not exist at its old path")
+	}
+
+	// Deletions go to the deleting user's part of the trash. Each listing
+	// opens it afresh, as a directory handle is read once
+	trash := fmt.Sprintf("/.trash/%d/", AnonymousUID)
+	trashNames := func() []string {
+		t.Helper()
+		dir, err := fs.Open(trash)
+		if err != nil {
+			t.Fatalf("Open trash failed: %v", err)
+		}
+		defer dir.Close()
+		names, _ := dir.Readdirnames(-1)
+		return names
+	}
+	names := trashNames()
+	if len(names) != 1 || !strings.HasSuffix(names[0], "-file.txt") {
+		t.Fatalf("Expected trashed file to be listed, got %v", names)
+	}
+	trashed := trash + names[0]
+
+	var original string
+	var deletedAt sql.NullInt64
+	driver.db.QueryRow("SELECT f.original_path, f.deleted_at FROM files f JOIN file_paths p ON p.id = f.id WHERE p.path = ?", trashed).Scan(&original, &deletedAt)
+	if original != "/dir/file.txt" || !deletedAt.Valid {
+		t.Errorf("Expected original path and deletion time to be recorded, got %q, %v", original, deletedAt)
+	}
+
+	// Nothing can be written into the trash
+	if _, err := fs.Create(trash + "new.txt"); !os.IsPermission(err) {
+		t.Errorf("Expected create in trash to be denied, got %v", err)
+	}
+	if _, err := fs.OpenFile(trashed, os.O_WRONLY|os.O_APPEND, 0); !os.IsPermission(err) {
+		t.Errorf("Expected writing a trashed file to be denied, got %v", err)
+	}
+	if err := fs.Rename("/dir", "/.trash/dir"); !os.IsPermission(err) {
+		t.Errorf("Expected rename into trash to be denied, got %v", err)
+	}
+	for _, dir := range []string{"/.trash", trash} {
+		if err := fs.Remove(dir); !os.IsPermission(err) {
+			t.Errorf("Expected removing %s to be denied, got %v", dir, err)
+		}
+	}
+
+	// Renaming out of the trash restores the file
+	if err := fs.Rename(trashed, "/dir/file.txt"); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	f, err := fs.Open("/dir/file.txt")
+	if err != nil {
+		t.Fatalf("Open restored file failed: %v", err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "keep me" {
+		t.Errorf("Expected restored content, got %q", data)
+	}
+	driver.db.QueryRow("SELECT f.deleted_at FROM files f JOIN file_paths p ON p.id = f.id WHERE p.path = '/dir/file.txt'").Scan(&deletedAt)
+	if deletedAt.Valid {
+		t.Errorf("Expected deleted_at to be cleared on restore")
+	}
+
+	// The purger only removes entries past the retention
+	fs.Remove("/dir/file.txt")
+	if err := driver.PurgeTrash(); err != nil {
+		t.Fatalf("PurgeTrash failed: %v", err)
+	}
+	if names := trashNames(); len(names) != 1 {
+		t.Errorf("Expected fresh trash entry to survive the purge, got %v", names)
+	}
+	driver.trashRetention = time.Nanosecond
+	if err := driver.PurgeTrash(); err != nil {
+		t.Fatalf("PurgeTrash failed: %v", err)
+	}
+	if names := trashNames(); len(names) != 0 {
+		t.Errorf("Expected expired trash entry to be purged, got %v", names)
+	}
+
+	// Removing from inside the trash deletes for good
+	driver.trashRetention = time.Hour
+	fs.Mkdir("/empty", 0755)
+	fs.Remove("/empty")
+	names = trashNames()
+	if len(names) != 1 {
+		t.Fatalf("Expected trashed directory, got %v", names)
+	}
+	if err := fs.Remove(trash + names[0]); err != nil {
+		t.Fatalf("Remove from trash failed: %v", err)
+	}
+	if names := trashNames(); len(names) != 0 {
+		t.Errorf("Expected trash to be empty, got %v", names)
+	}
+}
+
+func TestSharedTrash(t *testing.T) {
+	dbConn, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	driver.trashRetention = time.Hour
+
+	// Two accounts share the root and a world-writable directory in it
+	sessions := map[string]*SQLiteFs{}
+	for _, name := range []string{"alice", "bob"} {
+		if err := db.CreateUser(dbConn, name, "secret"); err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+		if err := db.SetUserHome(dbConn, name, "/"); err != nil {
+			t.Fatalf("SetUserHome failed: %v", err)
+		}
+		fs, err := driver.AuthUser(nil, name, "secret")
+		if err != nil {
+			t.Fatalf("AuthUser failed: %v", err)
+		}
+		sessions[name] = fs.(*SQLiteFs)
+	}
+	alice, bob := sessions["alice"], sessions["bob"]
+	root := driver.rootFs()
+	root.Mkdir("/shared", 0777)
+	root.Chmod("/shared", 0777)
+	for _, fs := range sessions {
+		f, err := fs.Create(fmt.Sprintf("/shared/%d.txt", fs.user.uid))
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		f.Write([]byte("mine"))
+		f.Close()
+		if err := fs.Remove(fmt.Sprintf("/shared/%d.txt", fs.user.uid)); err != nil {
+			t.Fatalf("Remove failed: %v", err)
+		}
+	}
+
+	// The trash itself belongs to the server, whoever deleted first
+	fi, err := root.Stat("/.trash")
+	if err != nil {
+		t.Fatalf("Stat trash failed: %v", err)
+	}
+	if facts := fi.Sys().(Facts); facts.UID != 0 || fi.Mode().Perm() != 0755 {
+		t.Errorf("Expected the trash to be 0755 and owned by the server, got %o owned by %d", fi.Mode().Perm(), facts.UID)
+	}
+
+	aliceTrash := fmt.Sprintf("/.trash/%d", alice.user.uid)
+	bobTrash := fmt.Sprintf("/.trash/%d", bob.user.uid)
+	entries := func(fs *SQLiteFs, dir string) []string {
+		t.Helper()
+		f, err := fs.Open(dir)
+		if err != nil {
+			t.Fatalf("Open %s failed: %v", dir, err)
+		}
+		defer f.Close()
+		names, _ := f.Readdirnames(-1)
+		return names
+	}
+	aliceEntry := aliceTrash + "/" + entries(alice, aliceTrash)[0]
+	bobEntries := entries(bob, bobTrash)
+	if len(bobEntries) != 1 {
+		t.Fatalf("Expected bob's deletion in his own trash, got %v", bobEntries)
+	}
+
+	// Nobody reaches into another user's deletions
+	if _, err := bob.Open(aliceTrash); !os.IsPermission(err) {
+		t.Errorf("Expected listing another user's trash to be denied, got %v", err)
+	}
+	if _, err := bob.Open(aliceEntry); !os.IsPermission(err) {
+		t.Errorf("Expected reading another user's deletion to be denied, got %v", err)
+	}
+	if err := bob.Rename(aliceEntry, "/shared/stolen.txt"); !os.IsPermission(err) {
+		t.Errorf("Expected restoring another user's deletion to be denied, got %v", err)
+	}
+	if err := bob.Remove(aliceEntry); !os.IsPermission(err) {
+		t.Errorf("Expected purging another user's deletion to be denied, got %v", err)
+	}
+
+	// Each user restores their own
+	if err := bob.Rename(bobTrash+"/"+bobEntries[0], "/shared/restored.txt"); err != nil {
+		t.Errorf("Restore by the deleter failed: %v", err)
+	}
+	if err := alice.Rename(aliceEntry, "/shared/restored-too.txt"); err != nil {
+		t.Errorf("Restore by the deleter failed: %v", err)
+	}
+}
+
+func TestSizeLimit(t *testing.T) {
+	_, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+
+	f, _ := fs.Create("/large.txt")
+	defer f.Close()
 
 	// Write 1 byte over limit
 	largeData := make([]byte, 10*1024*1024+1)
@@ -195,10 +1268,250 @@ func TestSizeLimit(t *testing.T) {
 	}
 }
 
+func TestFailedUploadKeepsOriginal(t *testing.T) {
+	_, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	driver.maxFileSize = 16
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+
+	f, _ := fs.Create("/keep.txt")
+	f.Write([]byte("original"))
+	f.Close()
+
+	readBack := func() string {
+		r, err := fs.Open("/keep.txt")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer r.Close()
+		data, _ := io.ReadAll(r)
+		return string(data)
+	}
+
+	// Oversized re-upload
+	f, _ = fs.OpenFile("/keep.txt", os.O_WRONLY|os.O_TRUNC, 0644)
+	if _, err := f.Write(make([]byte, 17)); err != ftpserver.ErrStorageExceeded {
+		t.Errorf("Expected ErrStorageExceeded, got %v", err)
+	}
+	f.Close()
+	if got := readBack(); got != "original" {
+		t.Errorf("Expected original content after oversized upload, got %q", got)
+	}
+
+	// Oversized append
+	f, _ = fs.OpenFile("/keep.txt", os.O_WRONLY|os.O_APPEND, 0644)
+	if _, err := f.Write(make([]byte, 9)); err != ftpserver.ErrStorageExceeded {
+		t.Errorf("Expected ErrStorageExceeded, got %v", err)
+	}
+	f.Close()
+	if got := readBack(); got != "original" {
+		t.Errorf("Expected original content after oversized append, got %q", got)
+	}
+
+	// Aborted transfer; readers see the old content until a successful Close
+	f, _ = fs.OpenFile("/keep.txt", os.O_WRONLY|os.O_TRUNC, 0644)
+	f.Write([]byte("partial"))
+	if got := readBack(); got != "original" {
+		t.Errorf("Expected original content during upload, got %q", got)
+	}
+	f.(*SqliteFile).TransferError(io.ErrUnexpectedEOF)
+	f.Close()
+	if got := readBack(); got != "original" {
+		t.Errorf("Expected original content after aborted upload, got %q", got)
+	}
+
+	// A rejected new file is not left behind
+	f, _ = fs.Create("/new.txt")
+	f.Write(make([]byte, 17))
+	f.Close()
+	if _, err := fs.Stat("/new.txt"); !os.IsNotExist(err) {
+		t.Errorf("Expected rejected new file to be removed, got %v", err)
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	_, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+
+	f, _ := fs.Create("/at.txt")
+	f.Write([]byte("hello world"))
+	if _, err := f.WriteAt([]byte("WORLD"), 6); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	// The position is unaffected, so this appends
+	f.Write([]byte("!"))
+	// Writing past a chunk boundary leaves a hole that reads as zeros
+	if _, err := f.WriteAt([]byte("end"), db.ChunkSize+10); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	f.Close()
+
+	r, _ := fs.Open("/at.txt")
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if len(data) != db.ChunkSize+13 {
+		t.Fatalf("Expected size %d, got %d", db.ChunkSize+13, len(data))
+	}
+	if string(data[:12]) != "hello WORLD!" || string(data[db.ChunkSize+10:]) != "end" {
+		t.Errorf("Unexpected content %q...%q", data[:12], data[db.ChunkSize+10:])
+	}
+	if data[db.ChunkSize] != 0 {
+		t.Error("Expected hole to read as zeros")
+	}
+
+	f, _ = fs.OpenFile("/at.txt", os.O_WRONLY|os.O_APPEND, 0644)
+	if _, err := f.WriteAt([]byte("x"), 0); err == nil {
+		t.Error("Expected WriteAt to fail in append mode")
+	}
+	f.Close()
+}
+
+func TestInterruptedUploadResumes(t *testing.T) {
+	_, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+
+	// The connection drops after the first part
+	f, _ := fs.OpenFile("/big.bin", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	f.Write([]byte("first part, "))
+	f.(*SqliteFile).TransferError(io.ErrUnexpectedEOF)
+	f.Close()
+
+	fi, err := fs.Stat("/big.bin")
+	if err != nil {
+		t.Fatalf("Expected partial upload to be kept: %v", err)
+	}
+
+	// REST <size> followed by STOR opens without O_TRUNC and seeks
+	f, _ = fs.OpenFile("/big.bin", os.O_WRONLY|os.O_CREATE, 0644)
+	f.Seek(fi.Size(), io.SeekStart)
+	f.Write([]byte("second part"))
+	f.Close()
+
+	r, _ := fs.Open("/big.bin")
+	r.Seek(6, io.SeekStart)
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "part, second part" {
+		t.Errorf("Unexpected resumed content %q", data)
+	}
+}
+
+func TestStorageQuota(t *testing.T) {
+	dbConn, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	driver.maxFileSize = 80
+	driver.SetStorageQuota(100)
+	driver.trashRetention = time.Hour
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+
+	// Per-file limit comes from the driver configuration
+	f, _ := fs.Create("/too-big.txt")
+	if _, err := f.Write(make([]byte, 81)); err != ftpserver.ErrStorageExceeded {
+		t.Errorf("Expected ErrStorageExceeded for max file size, got %v", err)
+	}
+	f.Close()
+
+	f, _ = fs.Create("/first.txt")
+	if _, err := f.Write(make([]byte, 60)); err != nil {
+		t.Fatalf("Write within quota failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close within quota failed: %v", err)
+	}
+
+	used, err := db.UsedBytes(dbConn)
+	if err != nil {
+		t.Fatalf("UsedBytes failed: %v", err)
+	}
+	if used != 60 {
+		t.Errorf("Expected 60 used bytes, got %d", used)
+	}
+
+	f, _ = fs.Create("/second.txt")
+	if _, err := f.Write(make([]byte, 60)); err != ftpserver.ErrStorageExceeded {
+		t.Errorf("Expected ErrStorageExceeded for quota, got %v", err)
+	}
+	f.Close()
+	if _, err := fs.Stat("/second.txt"); !os.IsNotExist(err) {
+		t.Errorf("File over quota should have been removed")
+	}
+
+	// Overwriting an existing file only counts the growth
+	f, _ = fs.OpenFile("/first.txt", os.O_WRONLY|os.O_TRUNC, 0)
+	if _, err := f.Write(make([]byte, 80)); err != nil {
+		t.Fatalf("Overwrite within quota failed: %v", err)
+	}
+	f.Close()
+
+	// Trashed files keep using space until they are purged
+	if err := fs.Remove("/first.txt"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	used, _ = db.UsedBytes(dbConn)
+	if used != 80 {
+		t.Errorf("Expected 80 used bytes while in the trash, got %d", used)
+	}
+	if _, err := db.PurgeTrash(dbConn, time.Now()); err != nil {
+		t.Fatalf("PurgeTrash failed: %v", err)
+	}
+	used, _ = db.UsedBytes(dbConn)
+	if used != 0 {
+		t.Errorf("Expected 0 used bytes after purge, got %d", used)
+	}
+
+	// With versioning, replaced content stays stored and counted, minus the
+	// revisions pruned to make room for it
+	driver.maxVersions = 1
+	for _, size := range []int{40, 50} {
+		f, _ = fs.Create("/versioned.txt")
+		if _, err := f.Write(make([]byte, size)); err != nil {
+			t.Fatalf("Write of %d bytes failed: %v", size, err)
+		}
+		f.Close()
+	}
+	used, _ = db.UsedBytes(dbConn)
+	if used != 90 {
+		t.Errorf("Expected the file and its revision to use 90 bytes, got %d", used)
+	}
+	f, _ = fs.Create("/versioned.txt")
+	if _, err := f.Write(make([]byte, 20)); err != nil {
+		t.Errorf("Expected the 40 byte revision to make room, got %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	used, _ = db.UsedBytes(dbConn)
+	if used != 70 {
+		t.Errorf("Expected the file and its revision to use 70 bytes, got %d", used)
+	}
+
+	// With two revisions kept nothing is pruned, so even a smaller file does
+	// not fit once the 50 byte revision stays as well
+	driver.maxVersions = 2
+	f, _ = fs.Create("/versioned.txt")
+	if _, err := f.Write(make([]byte, 35)); err != ftpserver.ErrStorageExceeded {
+		t.Errorf("Expected ErrStorageExceeded with the old content kept as a revision, got %v", err)
+	}
+	f.Close()
+	f, _ = fs.Create("/versioned.txt")
+	if _, err := f.Write(make([]byte, 10)); err != nil {
+		t.Fatalf("Write of a smaller file failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	used, _ = db.UsedBytes(dbConn)
+	if used != 80 {
+		t.Errorf("Expected the file and two revisions to use 80 bytes, got %d", used)
+	}
+}
+
 func TestRename(t *testing.T) {
 	_, driver, cleanup := setupTestDB(t)
 	defer cleanup()
-	fs, _ := driver.AuthUser(nil, "", "")
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
 
 	// Create file
 	f, _ := fs.Create("/old.txt")
@@ -223,10 +1536,332 @@ func TestRename(t *testing.T) {
 	}
 }
 
+func TestPathCacheFollowsChanges(t *testing.T) {
+	_, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	driver.trashRetention = 0
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+
+	fs.MkdirAll("/src/sub", 0755)
+	f, _ := fs.Create("/src/sub/file.txt")
+	f.Close()
+	// Resolving the file caches the directories on the way
+	if _, err := fs.Stat("/src/sub/file.txt"); err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+
+	if err := fs.Rename("/src", "/dst"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if _, err := fs.Stat("/src/sub/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("Expected the old path to be gone, got %v", err)
+	}
+	if _, err := fs.Stat("/dst/sub/file.txt"); err != nil {
+		t.Errorf("Expected the file under the new path: %v", err)
+	}
+
+	// A directory recreated under a removed name is a different entry
+	if err := fs.RemoveAll("/dst"); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	fs.MkdirAll("/dst/sub", 0755)
+	if _, err := fs.Stat("/dst/sub/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("Expected the removed file to be gone, got %v", err)
+	}
+	f, err := fs.Create("/dst/sub/new.txt")
+	if err != nil {
+		t.Fatalf("Create in recreated directory failed: %v", err)
+	}
+	f.Close()
+}
+
+func TestRenameDirectoryTree(t *testing.T) {
+	dbConn, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	driver.trashRetention = 0
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+
+	if err := fs.MkdirAll("/a%/b/c/d", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	f, _ := fs.Create("/a%/b/c/d/deep.txt")
+	f.Write([]byte("deep"))
+	f.Close()
+	// "%" must not act as a wildcard and pull in this sibling
+	fs.MkdirAll("/ax/keep", 0755)
+
+	if err := fs.Rename("/a%", "/moved"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if _, err := fs.Stat("/moved/b/c/d/deep.txt"); err != nil {
+		t.Errorf("Expected deep file under the new path: %v", err)
+	}
+	if _, err := fs.Stat("/ax/keep"); err != nil {
+		t.Errorf("Sibling directory was moved: %v", err)
+	}
+	// Only the moved directory itself was rewritten
+	var updated int
+	dbConn.QueryRow("SELECT COUNT(*) FROM files WHERE name = 'moved'").Scan(&updated)
+	if updated != 1 {
+		t.Errorf("Expected the moved directory to be a single row, got %d", updated)
+	}
+
+	if err := fs.Rename("/moved", "/moved/b/c/loop"); err == nil {
+		t.Error("Expected moving a directory into itself to fail")
+	}
+	if err := fs.Rename("/moved", "/missing/dir"); !os.IsNotExist(err) {
+		t.Errorf("Expected missing parent to fail with ErrNotExist, got %v", err)
+	}
+	if err := fs.Rename("/ax/keep", "/moved/b/c/d/deep.txt/x"); !os.IsNotExist(err) {
+		t.Errorf("Expected file parent to fail with ErrNotExist, got %v", err)
+	}
+	if err := fs.Rename("/moved", "/ax"); !os.IsExist(err) {
+		t.Errorf("Expected directory target to fail with ErrExist, got %v", err)
+	}
+	if err := fs.Rename("/moved", "/moved"); err != nil {
+		t.Errorf("Renaming onto itself should be a no-op, got %v", err)
+	}
+}
+
+func TestRenameReplace(t *testing.T) {
+	_, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	driver.trashRetention = time.Hour
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+
+	for name, content := range map[string]string{"/src.txt": "new", "/dst.txt": "old"} {
+		f, _ := fs.Create(name)
+		f.Write([]byte(content))
+		f.Close()
+	}
+
+	if err := fs.Rename("/src.txt", "/dst.txt"); err != nil {
+		t.Fatalf("Rename onto existing file failed: %v", err)
+	}
+	f, err := fs.Open("/dst.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "new" {
+		t.Errorf("Expected replaced content %q, got %q", "new", data)
+	}
+	if _, err := fs.Stat("/src.txt"); !os.IsNotExist(err) {
+		t.Error("Source still exists after replace")
+	}
+
+	// The replaced file is kept in the trash
+	dir, _ := fs.Open(fmt.Sprintf("/.trash/%d", AnonymousUID))
+	names, _ := dir.Readdirnames(-1)
+	if len(names) != 1 || !strings.HasSuffix(names[0], "-dst.txt") {
+		t.Errorf("Expected replaced file in the trash, got %v", names)
+	}
+
+	// A file never replaces a directory
+	fs.Mkdir("/dir", 0755)
+	if err := fs.Rename("/dst.txt", "/dir"); !os.IsExist(err) {
+		t.Errorf("Expected ErrExist replacing a directory, got %v", err)
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	dbConn, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	driver.trashRetention = 0
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+	links, ok := fs.(afero.Symlinker)
+	if !ok {
+		t.Fatal("Expected the filesystem to support symbolic links")
+	}
+
+	fs.MkdirAll("/releases/v2", 0755)
+	f, _ := fs.Create("/releases/v2/app.bin")
+	f.Write([]byte("version 2"))
+	f.Close()
+
+	if err := links.SymlinkIfPossible("v2", "/releases/latest"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if target, err := links.ReadlinkIfPossible("/releases/latest"); err != nil || target != "v2" {
+		t.Errorf("Expected target v2, got %q, %v", target, err)
+	}
+	fi, _, err := links.LstatIfPossible("/releases/latest")
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Expected Lstat to describe the link, got %v, %v", fi, err)
+	}
+	if fi, err := fs.Stat("/releases/latest"); err != nil || !fi.IsDir() {
+		t.Errorf("Expected Stat to follow the link to a directory, got %v, %v", fi, err)
+	}
+
+	// Links are followed through directories, and absolute targets stay
+	// below the session root
+	f, err = fs.Open("/releases/latest/app.bin")
+	if err != nil {
+		t.Fatalf("Open through link failed: %v", err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "version 2" {
+		t.Errorf("Expected content through the link, got %q", data)
+	}
+	links.SymlinkIfPossible("/releases/latest/app.bin", "/app")
+	if fi, err := fs.Stat("/app"); err != nil || fi.Size() != 9 {
+		t.Errorf("Expected absolute link to resolve, got %v, %v", fi, err)
+	}
+
+	// Repointing the link is a rename over the old one
+	fs.Mkdir("/releases/v3", 0755)
+	links.SymlinkIfPossible("v3", "/releases/next")
+	if err := fs.Rename("/releases/next", "/releases/latest"); err != nil {
+		t.Fatalf("Rename over link failed: %v", err)
+	}
+	if _, err := fs.Stat("/releases/latest/app.bin"); !os.IsNotExist(err) {
+		t.Errorf("Expected the link to point to v3, got %v", err)
+	}
+
+	// Removing a link leaves its target alone
+	if err := fs.Remove("/app"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := fs.Stat("/releases/v2/app.bin"); err != nil {
+		t.Errorf("Expected the target to survive: %v", err)
+	}
+
+	links.SymlinkIfPossible("/loop", "/loop")
+	if _, err := fs.Stat("/loop"); err == nil {
+		t.Error("Expected a link loop to fail")
+	}
+	if err := links.SymlinkIfPossible("v2", "/releases/v3"); !os.IsExist(err) {
+		t.Errorf("Expected ErrExist for an existing name, got %v", err)
+	}
+
+	var count int
+	dbConn.QueryRow("SELECT COUNT(*) FROM files WHERE link_target IS NOT NULL").Scan(&count)
+	if count != 2 {
+		t.Errorf("Expected 2 symbolic links stored, got %d", count)
+	}
+}
+
+func TestSymlinkedPathsInMoves(t *testing.T) {
+	dbConn, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	driver.trashRetention = 0
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
+	links := fs.(afero.Symlinker)
+
+	fs.MkdirAll("/real/sub", 0755)
+	links.SymlinkIfPossible("/real", "/link")
+
+	// Moving a directory below itself through a link is refused
+	if err := fs.Rename("/link/sub", "/real/sub/inner"); err == nil {
+		t.Fatal("Expected a move below itself through a link to fail")
+	}
+	if problems, err := db.Check(dbConn, false); err != nil || len(problems) != 0 {
+		t.Errorf("Expected a consistent tree, got %v, %v", problems, err)
+	}
+
+	// Paths cached with links resolved are dropped by moves and removals
+	// made through the link
+	if _, err := fs.Stat("/real/sub"); err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if err := fs.Rename("/link/sub", "/moved"); err != nil {
+		t.Fatalf("Rename through link failed: %v", err)
+	}
+	if _, err := fs.Stat("/real/sub"); !os.IsNotExist(err) {
+		t.Errorf("Expected the moved directory to be gone from its old path, got %v", err)
+	}
+	if err := fs.Mkdir("/real/sub", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	fs.Stat("/real/sub")
+	if err := fs.RemoveAll("/link/sub"); err != nil {
+		t.Fatalf("RemoveAll through link failed: %v", err)
+	}
+	if _, err := fs.Stat("/real/sub"); !os.IsNotExist(err) {
+		t.Errorf("Expected the removed directory to be gone, got %v", err)
+	}
+	fs.Mkdir("/real/sub", 0755)
+	fs.Stat("/real/sub")
+	if err := fs.Remove("/link/sub"); err != nil {
+		t.Fatalf("Remove through link failed: %v", err)
+	}
+	if _, err := fs.Stat("/real/sub"); !os.IsNotExist(err) {
+		t.Errorf("Expected the removed directory to be gone, got %v", err)
+	}
+	if _, err := fs.Stat("/moved"); err != nil {
+		t.Errorf("Expected the moved directory at its new path: %v", err)
+	}
+}
+
+func TestHardLinks(t *testing.T) {
+	dbConn, driver, cleanup := setupTestDB(t)
+	defer cleanup()
+	driver.trashRetention = 0
+	fs := driver.rootFs()
+
+	f, _ := fs.Create("/artifact.tar")
+	f.Write([]byte("original"))
+	f.Close()
+	if err := fs.Link("/artifact.tar", "/latest.tar"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+	if err := fs.Link("/latest.tar", "/also.tar"); err != nil {
+		t.Fatalf("Link to a link failed: %v", err)
+	}
+
+	// Writing through one name changes all of them
+	f, _ = fs.OpenFile("/latest.tar", os.O_WRONLY|os.O_TRUNC, 0)
+	f.Write([]byte("rebuilt"))
+	f.Close()
+	for _, name := range []string{"/artifact.tar", "/also.tar"} {
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Fatalf("Open %s failed: %v", name, err)
+		}
+		data, _ := io.ReadAll(f)
+		f.Close()
+		if string(data) != "rebuilt" {
+			t.Errorf("Expected %s to share the content, got %q", name, data)
+		}
+	}
+	fs.Chmod("/also.tar", 0600)
+	if fi, _ := fs.Stat("/artifact.tar"); fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected names to share their mode, got %v", fi.Mode())
+	}
+
+	used, _ := db.UsedBytes(dbConn)
+	if used != int64(len("rebuilt")) {
+		t.Errorf("Expected the content to be counted once, got %d bytes", used)
+	}
+
+	// The content goes with the last name
+	fs.Remove("/artifact.tar")
+	fs.Remove("/latest.tar")
+	if _, err := fs.Stat("/also.tar"); err != nil {
+		t.Errorf("Expected the remaining name to survive: %v", err)
+	}
+	fs.Remove("/also.tar")
+	var rows int
+	dbConn.QueryRow("SELECT COUNT(*) FROM files WHERE is_dir = 0").Scan(&rows)
+	if rows != 0 {
+		t.Errorf("Expected the body to be released, %d rows left", rows)
+	}
+
+	fs.Mkdir("/dir", 0755)
+	if err := fs.Link("/dir", "/dir2"); err == nil {
+		t.Error("Expected linking a directory to fail")
+	}
+	if problems, err := db.Check(dbConn, false); err != nil || len(problems) != 0 {
+		t.Errorf("Expected a consistent database, got %v, %v", problems, err)
+	}
+}
+
 func TestConcurrentWrites(t *testing.T) {
 	_, driver, cleanup := setupTestDB(t)
 	defer cleanup()
-	fs, _ := driver.AuthUser(nil, "", "")
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
 
 	// Simply create the file first
 	f, _ := fs.Create("/concurrent.txt")
@@ -257,7 +1892,7 @@ func TestConcurrentWrites(t *testing.T) {
 func TestConcurrentReads(t *testing.T) {
 	_, driver, cleanup := setupTestDB(t)
 	defer cleanup()
-	fs, _ := driver.AuthUser(nil, "", "")
+	fs, _ := driver.AuthUser(nil, "anonymous", "")
 
 	// Create file
 	f, _ := fs.Create("/shared.txt")
@@ -2,17 +2,23 @@ package tests
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
 	"net/textproto" // Added for FTP errors
 	"os"
+	"path"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/colinrgodsey/sealed-ftpd/pkg/config"
 	"github.com/colinrgodsey/sealed-ftpd/pkg/db"
 	"github.com/colinrgodsey/sealed-ftpd/pkg/vfs"
 
@@ -26,11 +32,10 @@ import (
 // checkDbFile directly queries the database for file info
 func checkDbFile(t *testing.T, dbConn *sql.DB, path string, expectedSize int, expectedModTime time.Time) {
 	var size int
-	var modTimeStr string
-	var content sql.NullString // Use NullString to check if content is NULL
+	var modTime int64
 
-	row := dbConn.QueryRow("SELECT size, mod_time, content FROM files WHERE path = ?", path)
-	err := row.Scan(&size, &modTimeStr, &content)
+	row := dbConn.QueryRow("SELECT f.size, f.mod_time FROM files f JOIN file_paths p ON p.id = f.id WHERE p.path = ?", path)
+	err := row.Scan(&size, &modTime)
 	if err != nil {
 		t.Errorf("checkDbFile: Failed to query file %s from DB: %v", path, err)
 		return
@@ -40,15 +45,8 @@ func checkDbFile(t *testing.T, dbConn *sql.DB, path string, expectedSize int, ex
 		t.Errorf("checkDbFile: File size mismatch for %s. Expected %d, got %d", path, expectedSize, size)
 	}
 
-	// Parse the stored time from DB
-	parsedModTime, err := time.Parse(time.RFC3339, modTimeStr)
-	if err != nil {
-		parsedModTime, err = time.Parse("2006-01-02 15:04:05", modTimeStr)
-		if err != nil {
-			t.Errorf("checkDbFile: Failed to parse mod_time '%s' for %s: %v", modTimeStr, path, err)
-			return
-		}
-	}
+	// The stored time is in Unix nanoseconds
+	parsedModTime := time.Unix(0, modTime)
 
 	// Compare year, month, day, hour, minute, second, nanosecond
 	// Ignore nanoseconds for comparison if not consistently stored
@@ -58,7 +56,8 @@ func checkDbFile(t *testing.T, dbConn *sql.DB, path string, expectedSize int, ex
 }
 
 // setupServer starts the FTP server in a goroutine and returns its address and the DB connection
-func setupServer(t *testing.T, dbPath string) (addr string, dbConn *sql.DB, cleanup func()) {
+// Optional configure functions adjust the server configuration before it starts.
+func setupServer(t *testing.T, dbPath string, configure ...func(*config.Config)) (addr string, dbConn *sql.DB, cleanup func()) {
 	// Initialize the database
 	sqliteDB, err := db.InitDB(dbPath)
 	if err != nil {
@@ -77,7 +76,16 @@ func setupServer(t *testing.T, dbPath string) (addr string, dbConn *sql.DB, clea
 	listenAddr := fmt.Sprintf("127.0.0.1:%d", port)
 	connectionTimeout := 5 * time.Second
 
-	mainDriver := vfs.NewMainDriver(sqliteDB, 30000, 30009, listenAddr, connectionTimeout) // Pass listenAddr and timeout
+	cfg := config.Default()
+	cfg.PassivePortStart = 30000
+	cfg.PassivePortEnd = 30009
+	cfg.ListenAddr = listenAddr
+	cfg.ConnectionTimeout = connectionTimeout
+	cfg.AllowAnonymous = true
+	for _, fn := range configure {
+		fn(cfg)
+	}
+	mainDriver := vfs.NewMainDriver(sqliteDB, cfg, nil)
 
 	ftpServer := ftpserver.NewFtpServer(mainDriver)
 
@@ -120,7 +128,7 @@ func TestIntegration(t *testing.T) {
 	}
 	defer c.Quit()
 
-	// Login (no auth required)
+	// Login (anonymous access is enabled for tests)
 	err = c.Login("anonymous", "password")
 	if err != nil {
 		t.Fatalf("FTP login failed: %v", err)
@@ -302,7 +310,7 @@ func TestLargeFileUploadExceedsLimit(t *testing.T) {
 	}
 
 	// Create content slightly larger than MaxFileSize (10MB)
-	largeContent := make([]byte, vfs.MaxFileSize+1)
+	largeContent := make([]byte, config.DefaultMaxFileSize+1)
 	for i := range largeContent {
 		largeContent[i] = byte(i % 256)
 	}
@@ -336,7 +344,7 @@ func TestLargeFileUploadExceedsLimit(t *testing.T) {
 	// We verify that the file does not exist or is empty on the server.
 	// Check database directly for largefile.txt to ensure it's not created
 	var count int
-	err = dbConn.QueryRow("SELECT COUNT(*) FROM files WHERE path = ?", "/largefile.txt").Scan(&count)
+	err = dbConn.QueryRow("SELECT COUNT(*) FROM file_paths WHERE path = ?", "/largefile.txt").Scan(&count)
 	if err != nil {
 		t.Fatalf("Failed to query DB for largefile.txt: %v", err)
 	}
@@ -344,3 +352,691 @@ func TestLargeFileUploadExceedsLimit(t *testing.T) {
 		t.Error("Large file was created in DB despite exceeding size limit")
 	}
 }
+
+func TestUserLogin(t *testing.T) {
+	dbPath := t.TempDir() + "/test-user-login.db"
+	serverAddr, dbConn, cleanup := setupServer(t, dbPath)
+	defer cleanup()
+
+	if err := db.CreateUser(dbConn, "alice", "s3cret"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+
+	c, err := ftp.Dial(serverAddr, ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("FTP dial failed: %v", err)
+	}
+	if err := c.Login("alice", "wrong"); err == nil {
+		t.Error("Login with wrong password succeeded")
+	}
+	c.Quit()
+
+	c, err = ftp.Dial(serverAddr, ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("FTP dial failed: %v", err)
+	}
+	defer c.Quit()
+	if err := c.Login("alice", "s3cret"); err != nil {
+		t.Fatalf("Login with valid credentials failed: %v", err)
+	}
+	if pwd, err := c.CurrentDir(); err != nil || pwd != "/" {
+		t.Errorf("Expected PWD '/', got %q, %v", pwd, err)
+	}
+
+	// Uploads land in the user's home directory
+	if err := c.Stor("mine.txt", strings.NewReader("hello")); err != nil {
+		t.Fatalf("STOR failed: %v", err)
+	}
+	var count int
+	dbConn.QueryRow("SELECT COUNT(*) FROM file_paths WHERE path = '/home/alice/mine.txt'").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected upload to be stored at /home/alice/mine.txt")
+	}
+
+	var lastLogin sql.NullTime
+	if err := dbConn.QueryRow("SELECT last_login FROM users WHERE username = 'alice'").Scan(&lastLogin); err != nil {
+		t.Fatalf("Failed to query last_login: %v", err)
+	}
+	if !lastLogin.Valid {
+		t.Error("Expected last_login to be recorded")
+	}
+}
+
+func TestSiteRmdirRecursive(t *testing.T) {
+	dbPath := t.TempDir() + "/test-site-rmdir.db"
+	serverAddr, _, cleanup := setupServer(t, dbPath)
+	defer cleanup()
+
+	c, err := ftp.Dial(serverAddr, ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("FTP dial failed: %v", err)
+	}
+	defer c.Quit()
+	if err := c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatalf("FTP login failed: %v", err)
+	}
+	c.MakeDir("/tree")
+	c.MakeDir("/tree/sub")
+	if err := c.Stor("/tree/sub/file.txt", strings.NewReader("x")); err != nil {
+		t.Fatalf("STOR failed: %v", err)
+	}
+
+	// The client library has no raw command support, so talk to the server directly
+	conn, err := textproto.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	expect := func(code int, format string, args ...any) string {
+		t.Helper()
+		if format != "" {
+			if err := conn.PrintfLine(format, args...); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+		}
+		_, msg, err := conn.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("Unexpected response to %q: %v", fmt.Sprintf(format, args...), err)
+		}
+		return msg
+	}
+	expect(220, "")
+	expect(331, "USER anonymous")
+	expect(230, "PASS anonymous")
+	expect(550, "SITE RMDIR /tree")
+	expect(250, "SITE RMDIR -r /tree")
+
+	entries, err := c.List("/")
+	if err != nil {
+		t.Fatalf("LIST failed: %v", err)
+	}
+	for _, e := range entries {
+		if e.Name == "tree" {
+			t.Error("tree still exists after SITE RMDIR -r")
+		}
+	}
+}
+
+func TestRetrieveVersion(t *testing.T) {
+	dbPath := t.TempDir() + "/test-versions.db"
+	serverAddr, _, cleanup := setupServer(t, dbPath, func(cfg *config.Config) {
+		cfg.MaxVersions = 5
+	})
+	defer cleanup()
+
+	c, err := ftp.Dial(serverAddr, ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("FTP dial failed: %v", err)
+	}
+	defer c.Quit()
+	if err := c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatalf("FTP login failed: %v", err)
+	}
+
+	for _, content := range []string{"first", "second"} {
+		if err := c.Stor("report.txt", strings.NewReader(content)); err != nil {
+			t.Fatalf("STOR failed: %v", err)
+		}
+	}
+
+	entries, err := c.List("/.versions/report.txt")
+	if err != nil {
+		t.Fatalf("LIST of versions failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 version, got %d", len(entries))
+	}
+
+	r, err := c.Retr("/.versions/report.txt/" + entries[0].Name)
+	if err != nil {
+		t.Fatalf("RETR of version failed: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "first" {
+		t.Errorf("Expected previous content 'first', got %q", data)
+	}
+
+	if err := c.Stor("/.versions/report.txt/"+entries[0].Name, strings.NewReader("x")); err == nil {
+		t.Error("STOR into the versions tree should fail")
+	}
+}
+
+func TestRestartedTransfers(t *testing.T) {
+	dbPath := t.TempDir() + "/test-rest.db"
+	serverAddr, _, cleanup := setupServer(t, dbPath)
+	defer cleanup()
+
+	c, err := ftp.Dial(serverAddr, ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("FTP dial failed: %v", err)
+	}
+	defer c.Quit()
+	if err := c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatalf("FTP login failed: %v", err)
+	}
+
+	if err := c.Stor("resume.txt", strings.NewReader("hello ")); err != nil {
+		t.Fatalf("STOR failed: %v", err)
+	}
+	size, err := c.FileSize("resume.txt")
+	if err != nil {
+		t.Fatalf("SIZE failed: %v", err)
+	}
+	// REST + STOR continues the upload where it stopped
+	if err := c.StorFrom("resume.txt", strings.NewReader("world"), uint64(size)); err != nil {
+		t.Fatalf("STOR with REST failed: %v", err)
+	}
+
+	r, err := c.Retr("resume.txt")
+	if err != nil {
+		t.Fatalf("RETR failed: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "hello world" {
+		t.Errorf("Expected resumed content 'hello world', got %q", data)
+	}
+
+	// REST + RETR downloads the remainder only
+	r, err = c.RetrFrom("resume.txt", 6)
+	if err != nil {
+		t.Fatalf("RETR with REST failed: %v", err)
+	}
+	data, _ = io.ReadAll(r)
+	r.Close()
+	if string(data) != "world" {
+		t.Errorf("Expected partial download 'world', got %q", data)
+	}
+}
+
+func TestHashCommands(t *testing.T) {
+	dbPath := t.TempDir() + "/test-hash.db"
+	serverAddr, _, cleanup := setupServer(t, dbPath)
+	defer cleanup()
+
+	c, err := ftp.Dial(serverAddr, ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("FTP dial failed: %v", err)
+	}
+	defer c.Quit()
+	if err := c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatalf("FTP login failed: %v", err)
+	}
+	if err := c.Stor("/sum.txt", strings.NewReader("checksum me")); err != nil {
+		t.Fatalf("STOR failed: %v", err)
+	}
+	sha := sha256.Sum256([]byte("checksum me"))
+	md := md5.Sum([]byte("checksum me"))
+
+	conn, err := textproto.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	expect := func(code int, format string, args ...any) string {
+		t.Helper()
+		if format != "" {
+			if err := conn.PrintfLine(format, args...); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+		}
+		_, msg, err := conn.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("Unexpected response to %q: %v", fmt.Sprintf(format, args...), err)
+		}
+		return msg
+	}
+	expect(220, "")
+	expect(331, "USER anonymous")
+	expect(230, "PASS anonymous")
+
+	if msg := expect(250, "XSHA256 /sum.txt"); !strings.Contains(msg, hex.EncodeToString(sha[:])) {
+		t.Errorf("Unexpected XSHA256 reply %q", msg)
+	}
+	if msg := expect(250, "XMD5 /sum.txt"); !strings.Contains(msg, hex.EncodeToString(md[:])) {
+		t.Errorf("Unexpected XMD5 reply %q", msg)
+	}
+	if msg := expect(213, "HASH /sum.txt"); !strings.Contains(msg, "SHA-256 0-11 "+hex.EncodeToString(sha[:])) {
+		t.Errorf("Unexpected HASH reply %q", msg)
+	}
+}
+
+func TestSiteSymlink(t *testing.T) {
+	dbPath := t.TempDir() + "/test-symlink.db"
+	serverAddr, dbConn, cleanup := setupServer(t, dbPath)
+	defer cleanup()
+
+	c, err := ftp.Dial(serverAddr, ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("FTP dial failed: %v", err)
+	}
+	defer c.Quit()
+	if err := c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatalf("FTP login failed: %v", err)
+	}
+	if err := c.MakeDir("/v1"); err != nil {
+		t.Fatalf("MKD failed: %v", err)
+	}
+	if err := c.Stor("/v1/app.bin", strings.NewReader("release one")); err != nil {
+		t.Fatalf("STOR failed: %v", err)
+	}
+
+	conn, err := textproto.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	expect := func(code int, format string, args ...any) {
+		t.Helper()
+		if format != "" {
+			if err := conn.PrintfLine(format, args...); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+		}
+		if _, _, err := conn.ReadResponse(code); err != nil {
+			t.Fatalf("Unexpected response to %q: %v", fmt.Sprintf(format, args...), err)
+		}
+	}
+	expect(220, "")
+	expect(331, "USER anonymous")
+	expect(230, "PASS anonymous")
+	expect(200, "SITE SYMLINK /v1 /latest")
+	// Relative targets are stored as given, relative to the link
+	expect(250, "CWD /v1")
+	expect(200, "SITE SYMLINK app.bin current.bin")
+	expect(501, "SITE SYMLINK app.bin")
+	var target string
+	dbConn.QueryRow("SELECT link_target FROM files WHERE name = 'current.bin'").Scan(&target)
+	if target != "app.bin" {
+		t.Errorf("Expected the relative target app.bin to be kept, got %q", target)
+	}
+
+	r, err := c.Retr("/latest/app.bin")
+	if err != nil {
+		t.Fatalf("RETR through link failed: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "release one" {
+		t.Errorf("Expected content through the link, got %q", data)
+	}
+	r, err = c.Retr("/latest/current.bin")
+	if err != nil {
+		t.Fatalf("RETR through relative link failed: %v", err)
+	}
+	data, _ = io.ReadAll(r)
+	r.Close()
+	if string(data) != "release one" {
+		t.Errorf("Expected content through the relative link, got %q", data)
+	}
+}
+
+func TestSetTimestamps(t *testing.T) {
+	dbPath := t.TempDir() + "/test-timestamps.db"
+	serverAddr, dbConn, cleanup := setupServer(t, dbPath)
+	defer cleanup()
+
+	c, err := ftp.Dial(serverAddr, ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("FTP dial failed: %v", err)
+	}
+	defer c.Quit()
+	if err := c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatalf("FTP login failed: %v", err)
+	}
+	if err := c.Stor("/mirror.txt", strings.NewReader("mirrored")); err != nil {
+		t.Fatalf("STOR failed: %v", err)
+	}
+
+	conn, err := textproto.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	expect := func(code int, format string, args ...any) string {
+		t.Helper()
+		if format != "" {
+			if err := conn.PrintfLine(format, args...); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+		}
+		_, msg, err := conn.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("Unexpected response to %q: %v", fmt.Sprintf(format, args...), err)
+		}
+		return msg
+	}
+	expect(220, "")
+	expect(331, "USER anonymous")
+	expect(230, "PASS anonymous")
+	expect(213, "MFMT 20200102030405 /mirror.txt")
+	expect(213, "SITE MFCT 20190102030405.25 /mirror.txt")
+	expect(501, "SITE MFCT yesterday /mirror.txt")
+	expect(550, "SITE MFCT 20190102030405 /missing.txt")
+
+	var modTime, createTime int64
+	err = dbConn.QueryRow("SELECT f.mod_time, f.create_time FROM files f JOIN file_paths p ON p.id = f.id WHERE p.path = '/mirror.txt'").
+		Scan(&modTime, &createTime)
+	if err != nil {
+		t.Fatalf("Failed to query timestamps: %v", err)
+	}
+	if want := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC); modTime != want.UnixNano() {
+		t.Errorf("Expected mod_time %v, got %v", want, time.Unix(0, modTime).UTC())
+	}
+	if want := time.Date(2019, 1, 2, 3, 4, 5, 250000000, time.UTC); createTime != want.UnixNano() {
+		t.Errorf("Expected create_time %v, got %v", want, time.Unix(0, createTime).UTC())
+	}
+	if mtime, err := c.GetTime("/mirror.txt"); err != nil || !mtime.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("Expected MDTM to report the new time, got %v, %v", mtime, err)
+	}
+
+	if msg := expect(211, "FEAT"); !strings.Contains(msg, "MFCT") {
+		t.Errorf("Expected FEAT to list MFCT, got %q", msg)
+	}
+	expect(213, "MFCT 20180102030405.5 /mirror.txt")
+	expect(501, "MFCT yesterday /mirror.txt")
+	dbConn.QueryRow("SELECT f.create_time FROM files f JOIN file_paths p ON p.id = f.id WHERE p.path = '/mirror.txt'").Scan(&createTime)
+	if want := time.Date(2018, 1, 2, 3, 4, 5, 500000000, time.UTC); createTime != want.UnixNano() {
+		t.Errorf("Expected MFCT to set create_time %v, got %v", want, time.Unix(0, createTime).UTC())
+	}
+}
+
+// parseMLSxEntry splits an MLSD line or MLST entry into its facts, keyed by
+// lower-case name, and the entry name.
+func parseMLSxEntry(t *testing.T, line string) (map[string]string, string) {
+	t.Helper()
+	list, name, ok := strings.Cut(strings.TrimPrefix(line, " "), " ")
+	if !ok {
+		t.Fatalf("Malformed MLSx entry %q", line)
+	}
+	facts := map[string]string{}
+	for _, fact := range strings.Split(strings.TrimSuffix(list, ";"), ";") {
+		k, v, ok := strings.Cut(fact, "=")
+		if !ok {
+			t.Fatalf("Malformed fact %q in %q", fact, line)
+		}
+		facts[strings.ToLower(k)] = v
+	}
+	return facts, name
+}
+
+func TestListingFacts(t *testing.T) {
+	dbPath := t.TempDir() + "/test-facts.db"
+	serverAddr, _, cleanup := setupServer(t, dbPath)
+	defer cleanup()
+
+	c, err := ftp.Dial(serverAddr, ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("FTP dial failed: %v", err)
+	}
+	defer c.Quit()
+	if err := c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatalf("FTP login failed: %v", err)
+	}
+	if err := c.MakeDir("/docs"); err != nil {
+		t.Fatalf("MKD failed: %v", err)
+	}
+	if err := c.Stor("/docs/report.txt", strings.NewReader("quarterly numbers")); err != nil {
+		t.Fatalf("STOR failed: %v", err)
+	}
+	sha := sha256.Sum256([]byte("quarterly numbers"))
+
+	conn, err := textproto.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	expect := func(code int, format string, args ...any) string {
+		t.Helper()
+		if format != "" {
+			if err := conn.PrintfLine(format, args...); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+		}
+		_, msg, err := conn.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("Unexpected response to %q: %v", fmt.Sprintf(format, args...), err)
+		}
+		return msg
+	}
+	expect(220, "")
+	expect(331, "USER anonymous")
+	expect(230, "PASS anonymous")
+
+	checkFile := func(facts map[string]string, name string) {
+		t.Helper()
+		if name != "report.txt" {
+			t.Errorf("Expected entry report.txt, got %q", name)
+		}
+		want := map[string]string{
+			"type":       "file",
+			"size":       "17",
+			"media-type": "text/plain",
+			"x.sha256":   hex.EncodeToString(sha[:]),
+		}
+		for k, v := range want {
+			if facts[k] != v {
+				t.Errorf("Expected fact %s=%s, got %q in %v", k, v, facts[k], facts)
+			}
+		}
+		for _, k := range []string{"modify", "create", "perm", "unique"} {
+			if facts[k] == "" {
+				t.Errorf("Expected fact %s in %v", k, facts)
+			}
+		}
+		if !strings.Contains(facts["perm"], "r") {
+			t.Errorf("Expected a readable perm fact, got %q", facts["perm"])
+		}
+	}
+
+	// MLST answers on the control connection, with the entry on the only
+	// line starting with a space
+	msg := expect(250, "MLST /docs/report.txt")
+	var entry string
+	for _, line := range strings.Split(msg, "\n") {
+		if strings.HasPrefix(line, " ") {
+			entry = line
+		}
+	}
+	facts, name := parseMLSxEntry(t, entry)
+	checkFile(facts, path.Base(name))
+	unique := facts["unique"]
+
+	// MLSD answers on a passive data connection
+	msg = expect(229, "EPSV")
+	port := msg[strings.Index(msg, "(|||")+4 : strings.LastIndex(msg, "|)")]
+	data, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("Data connection failed: %v", err)
+	}
+	expect(150, "MLSD /docs")
+	listing, err := io.ReadAll(data)
+	data.Close()
+	if err != nil {
+		t.Fatalf("Reading MLSD data failed: %v", err)
+	}
+	expect(226, "")
+	lines := strings.Split(strings.TrimSuffix(string(listing), "\r\n"), "\r\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one MLSD entry, got %q", listing)
+	}
+	facts, name = parseMLSxEntry(t, lines[0])
+	checkFile(facts, name)
+	if facts["unique"] != unique {
+		t.Errorf("Expected MLSD and MLST to agree on unique, got %q and %q", facts["unique"], unique)
+	}
+
+	facts, _ = parseMLSxEntry(t, strings.TrimSpace(strings.Split(expect(250, "MLST /docs"), "\n")[1]))
+	if facts["type"] != "dir" || !strings.HasPrefix(facts["perm"], "el") {
+		t.Errorf("Expected a listable directory, got %v", facts)
+	}
+
+	if msg := expect(212, "STAT /docs"); !strings.Contains(msg, "report.txt") {
+		t.Errorf("Expected STAT to list report.txt, got %q", msg)
+	}
+}
+
+func TestLargeDirectoryListing(t *testing.T) {
+	dbPath := t.TempDir() + "/test-large-dir.db"
+	serverAddr, dbConn, cleanup := setupServer(t, dbPath)
+	defer cleanup()
+
+	c, err := ftp.Dial(serverAddr, ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("FTP dial failed: %v", err)
+	}
+	defer c.Quit()
+	if err := c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatalf("FTP login failed: %v", err)
+	}
+	if err := c.MakeDir("/big"); err != nil {
+		t.Fatalf("MKD failed: %v", err)
+	}
+	// More entries than the server reads from the directory at once
+	const count = 2500
+	_, err = dbConn.Exec(`
+		WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < ?)
+		INSERT INTO files (parent_id, name, mod_time)
+		SELECT (SELECT id FROM file_paths WHERE path = '/big'), printf('f%05d', i), 0 FROM n
+	`, count)
+	if err != nil {
+		t.Fatalf("Failed to fill directory: %v", err)
+	}
+
+	names, err := c.NameList("/big")
+	if err != nil || len(names) != count {
+		t.Fatalf("Expected %d names from NLST, got %d, %v", count, len(names), err)
+	}
+	entries, err := c.List("/big")
+	if err != nil || len(entries) != count {
+		t.Fatalf("Expected %d entries from MLSD, got %d, %v", count, len(entries), err)
+	}
+	for i, e := range entries {
+		if want := fmt.Sprintf("f%05d", i+1); e.Name != want {
+			t.Fatalf("Expected entry %d to be %s, got %s", i, want, e.Name)
+		}
+	}
+}
+
+func TestExplicitTLS(t *testing.T) {
+	dbPath := t.TempDir() + "/test-explicit-tls.db"
+	serverAddr, _, cleanup := setupServer(t, dbPath, func(cfg *config.Config) {
+		cfg.TLSSelfSigned = true
+		cfg.TLSRequireControl = true
+		cfg.TLSRequireData = true
+	})
+	defer cleanup()
+
+	// A cleartext login must be refused
+	c, err := ftp.Dial(serverAddr, ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("FTP dial failed: %v", err)
+	}
+	if err := c.Login("anonymous", "password"); err == nil {
+		t.Error("Cleartext login succeeded although TLS is required")
+	}
+	c.Quit()
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	c, err = ftp.Dial(serverAddr, ftp.DialWithTimeout(5*time.Second), ftp.DialWithExplicitTLS(tlsConfig))
+	if err != nil {
+		t.Fatalf("FTP dial with AUTH TLS failed: %v", err)
+	}
+	defer c.Quit()
+	if err := c.Login("anonymous", "password"); err != nil {
+		t.Fatalf("Login over TLS failed: %v", err)
+	}
+
+	content := "encrypted upload"
+	if err := c.Stor("secret.txt", strings.NewReader(content)); err != nil {
+		t.Fatalf("STOR over TLS failed: %v", err)
+	}
+	r, err := c.Retr("secret.txt")
+	if err != nil {
+		t.Fatalf("RETR over TLS failed: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(got) != content {
+		t.Errorf("Expected %q over TLS, got %q (%v)", content, got, err)
+	}
+}
+
+func TestDataTLSRequired(t *testing.T) {
+	dbPath := t.TempDir() + "/test-data-tls.db"
+	serverAddr, _, cleanup := setupServer(t, dbPath, func(cfg *config.Config) {
+		cfg.TLSSelfSigned = true
+		cfg.TLSRequireData = true
+	})
+	defer cleanup()
+
+	// Transfers need a protected data channel
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	c, err := ftp.Dial(serverAddr, ftp.DialWithTimeout(5*time.Second), ftp.DialWithExplicitTLS(tlsConfig))
+	if err != nil {
+		t.Fatalf("FTP dial with AUTH TLS failed: %v", err)
+	}
+	defer c.Quit()
+	if err := c.Login("anonymous", "password"); err != nil {
+		t.Fatalf("Login over TLS failed: %v", err)
+	}
+	if err := c.Stor("sum.txt", strings.NewReader("checksum me")); err != nil {
+		t.Fatalf("STOR over TLS failed: %v", err)
+	}
+
+	plain, err := ftp.Dial(serverAddr, ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("FTP dial failed: %v", err)
+	}
+	defer plain.Quit()
+	if err := plain.Login("anonymous", "password"); err != nil {
+		t.Fatalf("Cleartext login failed although only data needs TLS: %v", err)
+	}
+	if r, err := plain.Retr("sum.txt"); err == nil {
+		r.Close()
+		t.Error("Cleartext RETR succeeded although data needs TLS")
+	}
+	if _, err := plain.List(""); err == nil {
+		t.Error("Cleartext LIST succeeded although data needs TLS")
+	}
+
+	// but commands answered on the control channel do not
+	conn, err := textproto.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.ReadResponse(220)
+	conn.Cmd("USER anonymous")
+	conn.ReadResponse(331)
+	conn.Cmd("PASS anonymous")
+	conn.ReadResponse(230)
+	conn.Cmd("HASH /sum.txt")
+	sha := sha256.Sum256([]byte("checksum me"))
+	if _, msg, err := conn.ReadResponse(213); err != nil || !strings.Contains(msg, hex.EncodeToString(sha[:])) {
+		t.Errorf("Expected HASH on a cleartext session to work, got %q, %v", msg, err)
+	}
+}
+
+func TestImplicitTLS(t *testing.T) {
+	dbPath := t.TempDir() + "/test-implicit-tls.db"
+	serverAddr, _, cleanup := setupServer(t, dbPath, func(cfg *config.Config) {
+		cfg.TLSSelfSigned = true
+		cfg.TLSMode = "implicit"
+	})
+	defer cleanup()
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	c, err := ftp.Dial(serverAddr, ftp.DialWithTimeout(5*time.Second), ftp.DialWithTLS(tlsConfig))
+	if err != nil {
+		t.Fatalf("FTP dial with implicit TLS failed: %v", err)
+	}
+	defer c.Quit()
+	if err := c.Login("anonymous", "password"); err != nil {
+		t.Fatalf("Login over implicit TLS failed: %v", err)
+	}
+	if _, err := c.List(""); err != nil {
+		t.Errorf("LIST over implicit TLS failed: %v", err)
+	}
+}
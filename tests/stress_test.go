@@ -14,6 +14,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/colinrgodsey/sealed-ftpd/pkg/config"
 	"github.com/colinrgodsey/sealed-ftpd/pkg/db"
 	"github.com/colinrgodsey/sealed-ftpd/pkg/vfs"
 
@@ -46,7 +47,13 @@ func setupStressServer(t *testing.T, dbPath string) (addr string, dbConn *sql.DB
 	connectionTimeout := 30 * time.Second // Increased timeout for stress
 
 	// Wider passive port range to accommodate many concurrent data transfers
-	mainDriver := vfs.NewMainDriver(sqliteDB, 40000, 50000, listenAddr, connectionTimeout)
+	cfg := config.Default()
+	cfg.PassivePortStart = 40000
+	cfg.PassivePortEnd = 50000
+	cfg.ListenAddr = listenAddr
+	cfg.ConnectionTimeout = connectionTimeout
+	cfg.AllowAnonymous = true
+	mainDriver := vfs.NewMainDriver(sqliteDB, cfg, nil)
 
 	ftpServer := ftpserver.NewFtpServer(mainDriver)
 
@@ -0,0 +1,21 @@
+module github.com/fclairamb/ftpserverlib
+
+go 1.24.0
+
+toolchain go1.25.5
+
+require (
+	github.com/secsy/goftp v0.0.0-20200609142545-aa2de14babf4
+	github.com/spf13/afero v1.15.0
+	github.com/stretchr/testify v1.11.1
+	golang.org/x/sys v0.39.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/secsy/goftp => github.com/drakkan/goftp v0.0.0-20201220151643-27b7174e8caf
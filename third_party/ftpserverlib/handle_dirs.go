@@ -0,0 +1,499 @@
+package ftpserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// thrown if listing with a filePath isn't supported (MLSD, NLST)
+var errFileList = errors.New("listing a file isn't allowed")
+
+// the order matter, put parameters with more characters first
+var supportedlistArgs = []string{"-al", "-la", "-a", "-l"} //nolint:gochecknoglobals
+
+func (c *clientHandler) absPath(p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+
+	return path.Join(c.Path(), p)
+}
+
+// getRelativePath returns the specified path as relative to the
+// current working directory. The specified path must be cleaned
+func (c *clientHandler) getRelativePath(inputPath string) string {
+	var builder strings.Builder
+	base := c.Path()
+
+	for {
+		if base == inputPath {
+			return builder.String()
+		}
+
+		if !strings.HasSuffix(base, "/") {
+			base += "/"
+		}
+
+		if strings.HasPrefix(inputPath, base) {
+			builder.WriteString(strings.TrimPrefix(inputPath, base))
+
+			return builder.String()
+		}
+
+		if base == "/" || base == "./" {
+			return inputPath
+		}
+
+		builder.WriteString("../")
+
+		base = path.Dir(path.Clean(base))
+	}
+}
+
+func (c *clientHandler) handleCWD(param string) error {
+	pathAbsolute := c.absPath(param)
+
+	if stat, err := c.driver.Stat(pathAbsolute); err == nil {
+		if stat.IsDir() {
+			c.SetPath(pathAbsolute)
+			c.writeMessage(StatusFileOK, "CD worked on "+pathAbsolute)
+		} else {
+			c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Can't change directory to %s: Not a Directory", pathAbsolute))
+		}
+	} else {
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("CD issue: %v", err))
+	}
+
+	return nil
+}
+
+func (c *clientHandler) handleMKD(param string) error {
+	pathAbsolute := c.absPath(param)
+	if err := c.driver.Mkdir(pathAbsolute, 0o755); err == nil {
+		// handleMKD confirms to "quote-doubling"
+		// https://tools.ietf.org/html/rfc959 , page 63
+		c.writeMessage(StatusPathCreated, fmt.Sprintf(`Created dir "%s"`, quoteDoubling(pathAbsolute)))
+	} else {
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf(`Could not create "%s" : %v`, quoteDoubling(pathAbsolute), err))
+	}
+
+	return nil
+}
+
+func (c *clientHandler) handleMKDIR(params string) {
+	if params == "" {
+		c.writeMessage(StatusSyntaxErrorNotRecognised, "Missing path")
+
+		return
+	}
+
+	p := c.absPath(params)
+
+	if err := c.driver.MkdirAll(p, 0o755); err == nil {
+		c.writeMessage(StatusFileOK, "Created dir "+p)
+	} else {
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Couldn't create dir %s: %v", p, err))
+	}
+}
+
+func (c *clientHandler) handleRMD(param string) error {
+	var err error
+
+	pathAbsolute := c.absPath(param)
+
+	if rmd, ok := c.driver.(ClientDriverExtensionRemoveDir); ok {
+		err = rmd.RemoveDir(pathAbsolute)
+	} else {
+		err = c.driver.Remove(pathAbsolute)
+	}
+
+	if err == nil {
+		c.writeMessage(StatusFileOK, "Deleted dir "+pathAbsolute)
+	} else {
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Could not delete dir %s: %v", pathAbsolute, err))
+	}
+
+	return nil
+}
+
+func (c *clientHandler) handleRMDIR(params string) {
+	if params == "" {
+		c.writeMessage(StatusSyntaxErrorNotRecognised, "Missing path")
+
+		return
+	}
+
+	p := c.absPath(params)
+
+	if err := c.driver.RemoveAll(p); err == nil {
+		c.writeMessage(StatusFileOK, "Removed dir "+p)
+	} else {
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Couldn't remove dir %s: %v", p, err))
+	}
+}
+
+func (c *clientHandler) handleCDUP(_ string) error {
+	parent, _ := path.Split(c.Path())
+	if parent != "/" && strings.HasSuffix(parent, "/") {
+		parent = parent[0 : len(parent)-1]
+	}
+
+	if _, err := c.driver.Stat(parent); err == nil {
+		c.SetPath(parent)
+		c.writeMessage(StatusFileOK, "CDUP worked on "+parent)
+	} else {
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("CDUP issue: %v", err))
+	}
+
+	return nil
+}
+
+func (c *clientHandler) handlePWD(_ string) error {
+	c.writeMessage(StatusPathCreated, fmt.Sprintf(`"%s" is the current directory`, quoteDoubling(c.Path())))
+
+	return nil
+}
+
+func (c *clientHandler) checkLISTArgs(args string) string {
+	result := args
+	param := strings.ToLower(args)
+
+	for _, arg := range supportedlistArgs {
+		if strings.HasPrefix(param, arg) {
+			// a check for a non-existent directory error is more appropriate here
+			// but we cannot assume that the driver implementation will return an
+			// os.IsNotExist error.
+			if _, err := c.driver.Stat(args); err != nil {
+				params := strings.SplitN(args, " ", 2)
+				if len(params) == 1 {
+					result = ""
+				} else {
+					result = params[1]
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+func (c *clientHandler) handleLIST(param string) error {
+	info := fmt.Sprintf("LIST %v", param)
+
+	if files, _, err := c.getFileList(param, true); err == nil || errors.Is(err, io.EOF) {
+		defer c.closeFileList(files)
+
+		if tr, errTr := c.TransferOpen(info); errTr == nil {
+			err = c.dirTransferLIST(tr, files)
+			c.TransferClose(err)
+
+			return nil
+		}
+	} else {
+		if !c.isCommandAborted() {
+			c.writeMessage(StatusFileActionNotTaken, fmt.Sprintf("Could not list: %v", err))
+		}
+	}
+
+	return nil
+}
+
+func (c *clientHandler) handleNLST(param string) error {
+	info := fmt.Sprintf("NLST %v", param)
+
+	if files, parentDir, err := c.getFileList(param, true); err == nil || errors.Is(err, io.EOF) {
+		defer c.closeFileList(files)
+
+		if tr, errTrOpen := c.TransferOpen(info); errTrOpen == nil {
+			err = c.dirTransferNLST(tr, files, parentDir)
+			c.TransferClose(err)
+
+			return nil
+		}
+	} else {
+		if !c.isCommandAborted() {
+			c.writeMessage(StatusFileActionNotTaken, fmt.Sprintf("Could not list: %v", err))
+		}
+	}
+
+	return nil
+}
+
+func (c *clientHandler) dirTransferNLST(writer io.Writer, files *fileList, parentDir string) error {
+	return files.send(writer, "couldn't send NLST data", func(file os.FileInfo) error {
+		// Based on RFC 959 NLST is intended to return information that can be used
+		// by a program to further process the files automatically.
+		// So we return paths relative to the current working directory
+		if _, err := fmt.Fprintf(writer, "%s\r\n", path.Join(c.getRelativePath(parentDir), file.Name())); err != nil {
+			return newNetworkError("couldn't send NLST data", err)
+		}
+
+		return nil
+	})
+}
+
+func (c *clientHandler) handleMLSD(param string) error {
+	if c.server.settings.DisableMLSD && !c.isCommandAborted() {
+		c.writeMessage(StatusSyntaxErrorNotRecognised, "MLSD has been disabled")
+
+		return nil
+	}
+
+	info := fmt.Sprintf("MLSD %v", param)
+
+	if files, _, err := c.getFileList(param, false); err == nil || errors.Is(err, io.EOF) {
+		defer c.closeFileList(files)
+
+		if tr, errTr := c.TransferOpen(info); errTr == nil {
+			err = c.dirTransferMLSD(tr, files)
+			c.TransferClose(err)
+
+			return nil
+		}
+	} else {
+		if !c.isCommandAborted() {
+			c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Could not list: %v", err))
+		}
+	}
+
+	return nil
+}
+
+const (
+	dateFormatStatTime      = "Jan _2 15:04"          // LIST date formatting with hour and minute
+	dateFormatStatYear      = "Jan _2  2006"          // LIST date formatting with year
+	dateFormatStatOldSwitch = time.Hour * 24 * 30 * 6 // 6 months ago
+	dateFormatMLSD          = "20060102150405"        // MLSD date formatting
+	fakeUser                = "ftp"
+	fakeGroup               = "ftp"
+)
+
+func (c *clientHandler) fileStat(file os.FileInfo) string {
+	modTime := file.ModTime()
+
+	var dateFormat string
+
+	if c.connectedAt.Sub(modTime) > dateFormatStatOldSwitch {
+		dateFormat = dateFormatStatYear
+	} else {
+		dateFormat = dateFormatStatTime
+	}
+
+	return fmt.Sprintf(
+		"%s 1 %s %s %12d %s %s",
+		file.Mode(),
+		fakeUser,
+		fakeGroup,
+		file.Size(),
+		file.ModTime().Format(dateFormat),
+		file.Name(),
+	)
+}
+
+// fclairamb (2018-02-13): #64: Removed extra empty line
+func (c *clientHandler) dirTransferLIST(writer io.Writer, files *fileList) error {
+	return files.send(writer, "error writing LIST entry", func(file os.FileInfo) error {
+		if _, err := fmt.Fprintf(writer, "%s\r\n", c.fileStat(file)); err != nil {
+			return fmt.Errorf("error writing LIST entry: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// fclairamb (2018-02-13): #64: Removed extra empty line
+func (c *clientHandler) dirTransferMLSD(writer io.Writer, files *fileList) error {
+	return files.send(writer, "error writing MLSD entry", func(file os.FileInfo) error {
+		return c.writeMLSxEntry(writer, file)
+	})
+}
+
+func (c *clientHandler) writeMLSxEntry(writer io.Writer, file os.FileInfo) error {
+	if facts, ok := file.Sys().(FileInfoExtensionMLSx); ok {
+		_, err := fmt.Fprintf(writer, "%s %s\r\n", facts.MLSxFacts(), file.Name())
+		if err != nil {
+			err = fmt.Errorf("error writing MLSD entry: %w", err)
+		}
+
+		return err
+	}
+
+	var listType string
+	if file.IsDir() {
+		listType = "dir"
+	} else {
+		listType = "file"
+	}
+
+	_, err := fmt.Fprintf(
+		writer,
+		"Type=%s;Size=%d;Modify=%s; %s\r\n",
+		listType,
+		file.Size(),
+		file.ModTime().UTC().Format(dateFormatMLSD),
+		file.Name(),
+	)
+	if err != nil {
+		err = fmt.Errorf("error writing MLSD entry: %w", err)
+	}
+
+	return err
+}
+
+// listPageSize is the number of entries read from a directory at a time
+// while a listing is sent
+const listPageSize = 1000
+
+// fileList holds the entries of a listing. A directory opened through the
+// driver is read a page at a time as the listing is sent, so that large
+// directories aren't held in memory as a whole.
+type fileList struct {
+	page      []os.FileInfo // entries read but not sent yet
+	directory afero.File    // nil when the entries aren't read from a directory
+	path      string
+	done      bool // the directory has been read to the end
+}
+
+// next returns the next entries of the listing, or io.EOF after the last one
+func (l *fileList) next() ([]os.FileInfo, error) {
+	if len(l.page) > 0 {
+		page := l.page
+		l.page = nil
+
+		return page, nil
+	}
+
+	if l.directory == nil || l.done {
+		return nil, io.EOF
+	}
+
+	page, err := l.directory.Readdir(listPageSize)
+	if errors.Is(err, io.EOF) || (err == nil && len(page) == 0) {
+		l.done = true
+	} else if err != nil {
+		return nil, newFileAccessError("couldn't read directory", err)
+	}
+
+	if len(page) == 0 {
+		return nil, io.EOF
+	}
+
+	return page, nil
+}
+
+// each calls fn for every entry of the listing, in order
+func (l *fileList) each(fn func(os.FileInfo) error) error {
+	for {
+		page, err := l.next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		for _, file := range page {
+			if err := fn(file); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// send calls write for every entry of the listing, making sure the data
+// connection is written to even when the listing is empty
+func (l *fileList) send(writer io.Writer, errMsg string, write func(os.FileInfo) error) error {
+	if _, err := writer.Write([]byte("")); err != nil {
+		return newNetworkError(errMsg, err)
+	}
+
+	return l.each(write)
+}
+
+func (c *clientHandler) getFileList(param string, filePathAllowed bool) (*fileList, string, error) {
+	if !c.server.settings.DisableLISTArgs {
+		param = c.checkLISTArgs(param)
+	}
+	// directory or filePath
+	listPath := c.absPath(param)
+	c.SetListPath(listPath)
+
+	// return list of single file if directoryPath points to file and filePathAllowed
+	info, err := c.driver.Stat(listPath)
+	if err != nil {
+		return nil, "", newFileAccessError("couldn't stat", err)
+	}
+
+	if !info.IsDir() {
+		if filePathAllowed {
+			return &fileList{page: []os.FileInfo{info}}, path.Dir(c.getListPath()), nil
+		}
+
+		return nil, "", errFileList
+	}
+
+	files, err := c.openFileList(listPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return files, c.getListPath(), nil
+}
+
+// openFileList opens the listing of a directory, to be closed with
+// closeFileList. The first page is read right away, so that a directory that
+// can't be read is reported before anything is sent.
+func (c *clientHandler) openFileList(directoryPath string) (*fileList, error) {
+	if driverFileList, ok := c.driver.(ClientDriverExtensionFileList); ok {
+		files, err := driverFileList.ReadDir(directoryPath)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		return &fileList{page: files}, nil
+	}
+
+	directory, err := c.driver.Open(directoryPath)
+	if err != nil {
+		return nil, newFileAccessError("couldn't open directory", err)
+	}
+
+	files := &fileList{directory: directory, path: directoryPath}
+
+	files.page, err = files.next()
+	if err != nil && !errors.Is(err, io.EOF) {
+		c.closeFileList(files)
+
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func (c *clientHandler) closeFileList(files *fileList) {
+	if files.directory != nil {
+		c.closeDirectory(files.path, files.directory)
+	}
+}
+
+func (c *clientHandler) closeDirectory(directoryPath string, directory afero.File) {
+	if errClose := directory.Close(); errClose != nil {
+		c.logger.Error("Couldn't close directory", "err", errClose, "directory", directoryPath)
+	}
+}
+
+func quoteDoubling(s string) string {
+	if !strings.Contains(s, "\"") {
+		return s
+	}
+
+	return strings.ReplaceAll(s, "\"", `""`)
+}
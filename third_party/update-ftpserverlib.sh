@@ -0,0 +1,22 @@
+#!/bin/sh
+# Recreates ftpserverlib/ from the pinned upstream release and the patches in
+# patches/ftpserverlib, applied in order. Running it on an unchanged tree
+# leaves git status clean.
+set -eu
+
+VERSION=v0.28.0
+
+cd "$(dirname "$0")"
+src=$(go mod download -json "github.com/fclairamb/ftpserverlib@$VERSION" | sed -n 's/^[[:space:]]*"Dir": "\(.*\)",$/\1/p')
+if [ -z "$src" ]; then
+	echo "failed to download ftpserverlib $VERSION" >&2
+	exit 1
+fi
+
+rm -rf ftpserverlib
+mkdir ftpserverlib
+cp "$src"/*.go "$src"/go.mod "$src"/go.sum "$src"/license.txt "$src"/README.md ftpserverlib/
+chmod -R u+w ftpserverlib
+for p in patches/ftpserverlib/*.patch; do
+	patch -d ftpserverlib -p1 --quiet --no-backup-if-mismatch <"$p"
+done